@@ -3,13 +3,14 @@ module Inventory
 go 1.22.0
 
 require (
+	github.com/ALbikov-R/4ServicesGRPC v1.0.0
+	github.com/golang-migrate/migrate/v4 v4.17.0
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
+	google.golang.org/grpc v1.62.1
 )
 
 require (
-	github.com/ALbikov-R/4ServicesGRPC v1.0.0 // indirect
-	github.com/golang-migrate/migrate/v4 v4.17.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
@@ -18,6 +19,7 @@ require (
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240304212257-790db918fca8 // indirect
-	google.golang.org/grpc v1.62.1 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
+
+replace github.com/ALbikov-R/4ServicesGRPC => ../grpc
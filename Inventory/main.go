@@ -4,28 +4,33 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+	"github.com/ALbikov-R/4ServicesGRPC/money"
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Product struct {
-	ID       string `json:"item_id"`
-	Name     string `json:"name"`
-	Quantity int    `json:"quantity"`
-	Price    string `json:"price"`
+	ID       string      `json:"item_id"`
+	Name     string      `json:"name"`
+	Quantity int         `json:"quantity"`
+	Price    money.Money `json:"price"`
 }
 type Fproduct struct {
 	Product
@@ -37,6 +42,8 @@ var (
 	db *sql.DB
 )
 
+var ErrUnknownField = errors.New("update_mask contains an unknown field")
+
 type grpcServer struct {
 	pb.UnimplementedInvOrdServer
 }
@@ -46,15 +53,19 @@ func (s *grpcServer) SendProduct(ctx context.Context, in *pb.CreateRequest) (*pb
 		ID:       in.GetProd().GetId(),
 		Name:     in.GetProd().GetName(),
 		Quantity: int(in.GetProd().GetQuantity()),
-		Price:    in.GetProd().GetPrice(),
+		Price:    money.FromProto(in.GetProd().GetPrice()),
+	}
+	if err := prod.Price.Validate(); err != nil {
+		return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
 	}
 	_, err := Insert(prod)
 	if err != nil {
+		// Повторная доставка из outbox Product: ошибка не возвращается, чтобы отправитель не повторял попытки
 		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
-			return &pb.StatusReply{Flag: false, Message: "item already exists"}, err
-		} else {
-			log.Fatal(err)
+			log.Printf("item - %s already exists\n", prod.ID)
+			return &pb.StatusReply{Flag: false, Message: "item already exists"}, nil
 		}
+		return nil, err
 	}
 	log.Printf("item - %s success created\n", prod.ID)
 
@@ -63,7 +74,7 @@ func (s *grpcServer) SendProduct(ctx context.Context, in *pb.CreateRequest) (*pb
 func (s *grpcServer) DelProduct(ctx context.Context, in *pb.IdRequest) (*pb.StatusReply, error) {
 	count, err := DeleteID(in.GetId())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if count == 0 {
 		log.Printf("the resource with the specified ID %s does not exist.\n", in.GetId())
@@ -75,19 +86,18 @@ func (s *grpcServer) DelProduct(ctx context.Context, in *pb.IdRequest) (*pb.Stat
 func (s *grpcServer) GetProduct(ctx context.Context, in *pb.IdRequest) (*pb.GetProdReply, error) {
 	prod, err := GetDataID(in.GetId())
 	if err != nil {
-		if err != sql.ErrNoRows {
+		if err == sql.ErrNoRows {
 			log.Printf("item not found\n")
-			return nil, fmt.Errorf("item not found")
-		} else {
-			log.Fatal(err)
+			return nil, status.Error(codes.NotFound, "item not found")
 		}
+		return nil, err
 	}
 	log.Printf("item - %s success sended\n", prod.ID)
 	return &pb.GetProdReply{Prod: &pb.Product{
 		Id:       prod.ID,
 		Name:     prod.Name,
 		Quantity: int32(prod.Quantity),
-		Price:    prod.Price,
+		Price:    prod.Price.Proto(),
 	}}, nil
 }
 func (s *grpcServer) UpdProduct(ctx context.Context, in *pb.CreateRequest) (*pb.StatusReply, error) {
@@ -95,16 +105,24 @@ func (s *grpcServer) UpdProduct(ctx context.Context, in *pb.CreateRequest) (*pb.
 		ID:       in.GetProd().GetId(),
 		Name:     in.GetProd().GetName(),
 		Quantity: int(in.GetProd().GetQuantity()),
-		Price:    in.GetProd().GetPrice(),
+		Price:    money.FromProto(in.GetProd().GetPrice()),
 	}
-	_, err := UpdateID(prod)
+	if updatesPrice(in.GetUpdateMask()) {
+		if err := prod.Price.Validate(); err != nil {
+			return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
+		}
+	}
+	// Без update_mask продукт заменяется целиком, иначе меняются только перечисленные поля
+	count, err := UpdateFields(prod, in.GetUpdateMask())
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("item not found\n")
-			return nil, fmt.Errorf("item not found")
-		} else {
-			log.Fatal(err)
+		if err == ErrUnknownField {
+			return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
 		}
+		return nil, err
+	}
+	if count == 0 {
+		log.Printf("item not found\n")
+		return &pb.StatusReply{Flag: false, Message: "item not found"}, nil
 	}
 	log.Printf("item - %s success updated\n", prod.ID)
 	return &pb.StatusReply{Flag: true, Message: "success updated"}, nil
@@ -115,6 +133,7 @@ func main() {
 	defer db.Close()
 	log.Println("Подключение к PostgreSQL успешно!")
 	ch := make(chan error)
+	go ExpireReservations(time.Minute)
 	go gStart(ch)
 	go restStart(ch)
 	for i := 0; i < 2; i++ {
@@ -175,12 +194,13 @@ func GETInv(w http.ResponseWriter, r *http.Request) {
 func GETInvID(w http.ResponseWriter, r *http.Request) {
 	prod, err := GetDataID(mux.Vars(r)["id"])
 	if err != nil {
-		if err != sql.ErrNoRows {
+		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
-			return
 		} else {
-			log.Fatal(err)
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
 		}
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -189,6 +209,10 @@ func GETInvID(w http.ResponseWriter, r *http.Request) {
 func CreateInv(w http.ResponseWriter, r *http.Request) {
 	var prod Product
 	_ = json.NewDecoder(r.Body).Decode(&prod)
+	if err := prod.Price.Validate(); err != nil {
+		PriceError(w, err)
+		return
+	}
 	_, err := Insert(prod)
 	if err != nil {
 		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
@@ -211,6 +235,10 @@ func CreateInv(w http.ResponseWriter, r *http.Request) {
 func UpdInv(w http.ResponseWriter, r *http.Request) {
 	var prod Product
 	_ = json.NewDecoder(r.Body).Decode(&prod)
+	if err := prod.Price.Validate(); err != nil {
+		PriceError(w, err)
+		return
+	}
 	_, err := UpdateID(prod)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -270,7 +298,8 @@ func ConnectDd() *sql.DB {
 	return db
 }
 func Insert(item Product) (int64, error) {
-	res, err := db.Exec("INSERT INTO inventory (id, naming, quantity, price) VALUES ($1,$2,$3,$4)", item.ID, item.Name, item.Quantity, item.Price)
+	res, err := db.Exec("INSERT INTO inventory (id, naming, quantity, price_amount, price_currency) VALUES ($1,$2,$3,$4,$5)",
+		item.ID, item.Name, item.Quantity, item.Price.Amount, item.Price.Currency)
 	if err != nil {
 		return -1, err
 	}
@@ -281,17 +310,17 @@ func Insert(item Product) (int64, error) {
 	return rowcount, nil
 }
 func GetDataID(IDNAME string) (Product, error) { //Обработать ошибку после работы функции
-	rows := db.QueryRow("SELECT * FROM inventory WHERE id=$1", IDNAME)
+	rows := db.QueryRow("SELECT id, naming, quantity, price_amount, price_currency FROM inventory WHERE id=$1", IDNAME)
 	var prod Product
 	// Обработка результатов запроса
-	err := rows.Scan(&prod.ID, &prod.Name, &prod.Quantity, &prod.Price)
+	err := rows.Scan(&prod.ID, &prod.Name, &prod.Quantity, &prod.Price.Amount, &prod.Price.Currency)
 	if err != nil {
 		return Product{}, err
 	}
 	return prod, nil
 }
 func GetData() []Product {
-	rows, err := db.Query("SELECT * FROM inventory")
+	rows, err := db.Query("SELECT id, naming, quantity, price_amount, price_currency FROM inventory")
 	if err != nil {
 		panic(err)
 	}
@@ -299,9 +328,10 @@ func GetData() []Product {
 	var prod []Product
 	// Обработка результатов запроса
 	for rows.Next() {
-		var id, name, price string
+		var id, name string
 		var quantity int
-		err := rows.Scan(&id, &name, &quantity, &price)
+		var price money.Money
+		err := rows.Scan(&id, &name, &quantity, &price.Amount, &price.Currency)
 		if err != nil {
 			panic(err)
 		}
@@ -315,8 +345,41 @@ func UpdateID(item Product) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	res, err := db.Exec("UPDATE inventory SET naming = $2, quantity =$3, price = $4 WHERE id=$1",
-		item.ID, item.Name, item.Quantity, item.Price)
+	res, err := db.Exec("UPDATE inventory SET naming = $2, quantity =$3, price_amount = $4, price_currency = $5 WHERE id=$1",
+		item.ID, item.Name, item.Quantity, item.Price.Amount, item.Price.Currency)
+	if err != nil {
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+// Изменение только перечисленных полей продукта (name, quantity, price), пустой список - все поля
+func UpdateFields(item Product, mask []string) (int64, error) {
+	if len(mask) == 0 {
+		mask = []string{"name", "quantity", "price"}
+	}
+	set := make([]string, 0, len(mask))
+	args := []interface{}{item.ID}
+	for _, field := range mask {
+		switch field {
+		case "name":
+			args = append(args, item.Name)
+			set = append(set, fmt.Sprintf("naming = $%d", len(args)))
+		case "quantity":
+			args = append(args, item.Quantity)
+			set = append(set, fmt.Sprintf("quantity = $%d", len(args)))
+		case "price":
+			args = append(args, item.Price.Amount, item.Price.Currency)
+			set = append(set, fmt.Sprintf("price_amount = $%d, price_currency = $%d", len(args)-1, len(args)))
+		default:
+			return -1, ErrUnknownField
+		}
+	}
+	res, err := db.Exec("UPDATE inventory SET "+strings.Join(set, ", ")+" WHERE id = $1", args...)
 	if err != nil {
 		return -1, err
 	}
@@ -326,6 +389,19 @@ func UpdateID(item Product) (int64, error) {
 	}
 	return rowcount, nil
 }
+
+// Меняет ли UpdProduct цену: пустой update_mask меняет все поля
+func updatesPrice(mask []string) bool {
+	if len(mask) == 0 {
+		return true
+	}
+	for _, field := range mask {
+		if field == "price" {
+			return true
+		}
+	}
+	return false
+}
 func DeleteID(IDNAME string) (int64, error) {
 	res, err := db.Exec("DELETE FROM inventory WHERE id = $1", IDNAME)
 	if err != nil {
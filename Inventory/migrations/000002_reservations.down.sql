@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS reservation_items;
+DROP TABLE IF EXISTS reservations;
\ No newline at end of file
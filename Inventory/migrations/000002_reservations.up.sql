@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS reservations (
+    id VARCHAR(64) PRIMARY KEY,
+    status VARCHAR(16) NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS reservation_items (
+    reservation_id VARCHAR(64) NOT NULL REFERENCES reservations (id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES inventory (id) ON DELETE CASCADE,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (reservation_id, item_id)
+);
+CREATE INDEX IF NOT EXISTS reservations_status_expires_at_idx ON reservations (status, expires_at);
\ No newline at end of file
@@ -0,0 +1,8 @@
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS price VARCHAR(255);
+UPDATE inventory SET price =
+    CASE WHEN price_amount % 100 = 0 THEN (price_amount / 100)::text
+        ELSE to_char(price_amount / 100.0, 'FM999999999999990.00') END ||
+    CASE price_currency WHEN 'RUB' THEN ' руб.' ELSE ' ' || price_currency END;
+ALTER TABLE inventory ALTER COLUMN price SET NOT NULL;
+ALTER TABLE inventory DROP COLUMN price_amount;
+ALTER TABLE inventory DROP COLUMN price_currency;
\ No newline at end of file
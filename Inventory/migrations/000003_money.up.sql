@@ -0,0 +1,52 @@
+-- Перевод цен вида "12500 руб.", "12 500,50 руб.", "99.99 USD", "1,000.50 USD", "1.234,56 EUR"
+-- в сумму в минимальных единицах и код валюты.
+-- Сумма цены в минимальных единицах или NULL, если числа нет или оно неоднозначно. Пробелы
+-- разделяют тысячи. Один знак "." или "," перед 1-2 последними цифрами отделяет дробную часть.
+-- Тысячи разделяются точкой или запятой, только если это однозначно: знак повторяется
+-- ("1,000,000") или дробная часть отделена другим знаком ("1,000.50", "1.234,56").
+-- Цена вида "1,000" или "1.234" (тысяча или единица) не угадывается.
+CREATE OR REPLACE FUNCTION pg_temp.price_amount(price TEXT) RETURNS BIGINT AS $f$
+DECLARE
+    num TEXT := replace(substring(price from '[0-9](?:[0-9 .,]*[0-9])?'), ' ', '');
+BEGIN
+    IF num ~ '^[0-9]+$' THEN
+        NULL;
+    ELSIF num ~ '^[0-9]+[.,][0-9]{1,2}$' THEN
+        num := replace(num, ',', '.');
+    ELSIF num ~ '^[0-9]{1,3}(,[0-9]{3})+(\.[0-9]{1,2})?$' AND num ~ '(,.*,|\.)' THEN
+        num := replace(num, ',', '');
+    ELSIF num ~ '^[0-9]{1,3}(\.[0-9]{3})+(,[0-9]{1,2})?$' AND num ~ '(\..*\.|,)' THEN
+        num := replace(replace(num, '.', ''), ',', '.');
+    ELSE
+        RETURN NULL;
+    END IF;
+    RETURN round(num::numeric * 100);
+END
+$f$ LANGUAGE plpgsql IMMUTABLE;
+-- Цена без числа или с неоднозначным числом не обнуляется: миграция останавливается
+-- и называет такие предметы.
+DO $$
+DECLARE
+    bad TEXT;
+BEGIN
+    SELECT string_agg(id::text || ' (' || price || ')', ', ') INTO bad
+    FROM inventory WHERE pg_temp.price_amount(price) IS NULL;
+    IF bad IS NOT NULL THEN
+        RAISE EXCEPTION 'cannot convert prices of items: %', bad;
+    END IF;
+END
+$$;
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS price_amount BIGINT;
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS price_currency CHAR(3);
+UPDATE inventory SET
+    price_amount = pg_temp.price_amount(price),
+    price_currency = CASE
+        WHEN price ~* '(usd|\$)' THEN 'USD'
+        WHEN price ~* '(eur|€)' THEN 'EUR'
+        ELSE 'RUB'
+    END;
+ALTER TABLE inventory DROP COLUMN price;
+ALTER TABLE inventory ALTER COLUMN price_amount SET NOT NULL;
+ALTER TABLE inventory ALTER COLUMN price_currency SET NOT NULL;
+ALTER TABLE inventory ALTER COLUMN price_currency SET DEFAULT 'RUB';
+ALTER TABLE inventory ADD CONSTRAINT inventory_price_amount_check CHECK (price_amount >= 0);
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS restock_items;
+DROP TABLE IF EXISTS restocks;
\ No newline at end of file
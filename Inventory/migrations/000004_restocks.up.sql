@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS restocks (
+    id VARCHAR(64) PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS restock_items (
+    restock_id VARCHAR(64) NOT NULL REFERENCES restocks (id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES inventory (id) ON DELETE CASCADE,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (restock_id, item_id)
+);
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+// Состояния резерва
+const (
+	ReservationActive    = "active"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+var (
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationClosed   = errors.New("reservation is already closed")
+)
+
+// Время жизни резерва по умолчанию, переопределяется переменной RESERVATION_TTL (в секундах)
+func ReservationTTL() time.Duration {
+	if ttl, err := strconv.Atoi(os.Getenv("RESERVATION_TTL")); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return 15 * time.Minute
+}
+
+func NewReservationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *grpcServer) ReserveStock(ctx context.Context, in *pb.ReserveRequest) (*pb.ReserveReply, error) {
+	id := in.GetReservationId()
+	if id == "" {
+		id = NewReservationID()
+	}
+	ttl := ReservationTTL()
+	if in.GetTtlSeconds() > 0 {
+		ttl = time.Duration(in.GetTtlSeconds()) * time.Second
+	}
+	items := make(map[string]int)
+	for _, item := range in.GetItems() {
+		items[item.GetId()] += int(item.GetQuantity())
+	}
+	lines, expires, ok, err := Reserve(ctx, id, items, ttl)
+	if err != nil {
+		log.Printf("reservation %s failed: %v\n", id, err)
+		return nil, err
+	}
+	reply := &pb.ReserveReply{Flag: ok, ReservationId: id, Lines: lines}
+	if ok {
+		reply.ExpiresAt = expires.Unix()
+		log.Printf("reservation - %s success created\n", id)
+	} else {
+		log.Printf("reservation - %s rejected: not enough stock\n", id)
+	}
+	return reply, nil
+}
+func (s *grpcServer) CommitReservation(ctx context.Context, in *pb.ReservationRequest) (*pb.StatusReply, error) {
+	err := CloseReservation(ctx, in.GetReservationId(), ReservationCommitted)
+	if err != nil {
+		if err == ErrReservationNotFound || err == ErrReservationClosed {
+			log.Printf("reservation %s is not committed: %v\n", in.GetReservationId(), err)
+			return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
+		}
+		return nil, err
+	}
+	log.Printf("reservation - %s success committed\n", in.GetReservationId())
+	return &pb.StatusReply{Flag: true, Message: "success committed"}, nil
+}
+func (s *grpcServer) ReleaseReservation(ctx context.Context, in *pb.ReservationRequest) (*pb.StatusReply, error) {
+	err := CloseReservation(ctx, in.GetReservationId(), ReservationReleased)
+	if err != nil {
+		if err == ErrReservationNotFound || err == ErrReservationClosed {
+			log.Printf("reservation %s is not released: %v\n", in.GetReservationId(), err)
+			return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
+		}
+		return nil, err
+	}
+	log.Printf("reservation - %s success released\n", in.GetReservationId())
+	return &pb.StatusReply{Flag: true, Message: "success released"}, nil
+}
+
+// Резервирование предметов. Если хотя бы одной строки не хватает, ничего не резервируется,
+// а в ответе по каждой строке указано доступное количество.
+// Повторный вызов с тем же кодом резерва возвращает уже созданный резерв, если он ещё
+// действует. Списанный, снятый или истёкший резерв повторно не используется.
+func Reserve(ctx context.Context, id string, items map[string]int, ttl time.Duration) ([]*pb.ReserveLine, time.Time, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var expires time.Time
+	err = tx.QueryRowContext(ctx, "SELECT status, expires_at FROM reservations WHERE id = $1", id).Scan(&status, &expires)
+	if err == nil {
+		lines, err := reservationLines(ctx, tx, id)
+		if status != ReservationActive {
+			for _, line := range lines {
+				line.Available, line.Ok, line.Message = 0, false, "reservation is "+status
+			}
+		}
+		return lines, expires, status == ReservationActive, err
+	}
+	if err != sql.ErrNoRows {
+		return nil, time.Time{}, false, err
+	}
+
+	// Строки блокируются в одном порядке, чтобы параллельные резервы не ждали друг друга по кругу
+	ids := make([]string, 0, len(items))
+	for itemID := range items {
+		ids = append(ids, itemID)
+	}
+	sort.Strings(ids)
+	var lines []*pb.ReserveLine
+	ok := true
+	for _, itemID := range ids {
+		line := &pb.ReserveLine{Id: itemID, Requested: int32(items[itemID])}
+		lines = append(lines, line)
+		if items[itemID] <= 0 {
+			line.Message = "quantity must be greater than zero"
+			ok = false
+			continue
+		}
+		var stock, reserved int
+		err := tx.QueryRowContext(ctx, "SELECT quantity FROM inventory WHERE id = $1 FOR UPDATE", itemID).Scan(&stock)
+		if err == sql.ErrNoRows {
+			line.Message = "item not found"
+			ok = false
+			continue
+		}
+		if err != nil {
+			return nil, time.Time{}, false, err
+		}
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(ri.quantity), 0) FROM reservation_items ri
+			JOIN reservations r ON r.id = ri.reservation_id
+			WHERE ri.item_id = $1 AND r.status = $2 AND r.expires_at > now()`, itemID, ReservationActive).Scan(&reserved)
+		if err != nil {
+			return nil, time.Time{}, false, err
+		}
+		line.Available = int32(stock - reserved)
+		if line.Available < line.Requested {
+			line.Message = "not enough stock"
+			ok = false
+			continue
+		}
+		line.Ok = true
+	}
+	if !ok || len(lines) == 0 {
+		return lines, time.Time{}, false, nil
+	}
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO reservations (id, status, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3)) RETURNING expires_at`,
+		id, ReservationActive, ttl.Seconds()).Scan(&expires)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	for _, itemID := range ids {
+		_, err := tx.ExecContext(ctx, "INSERT INTO reservation_items (reservation_id, item_id, quantity) VALUES ($1,$2,$3)",
+			id, itemID, items[itemID])
+		if err != nil {
+			return nil, time.Time{}, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, time.Time{}, false, err
+	}
+	return lines, expires, true, nil
+}
+
+// Строки уже созданного резерва
+func reservationLines(ctx context.Context, tx *sql.Tx, id string) ([]*pb.ReserveLine, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT item_id, quantity FROM reservation_items WHERE reservation_id = $1 ORDER BY item_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []*pb.ReserveLine
+	for rows.Next() {
+		var line pb.ReserveLine
+		if err := rows.Scan(&line.Id, &line.Requested); err != nil {
+			return nil, err
+		}
+		line.Available = line.Requested
+		line.Ok = true
+		lines = append(lines, &line)
+	}
+	return lines, rows.Err()
+}
+
+// Подтверждение (списание со склада) или отмена активного резерва.
+// Повторное подтверждение или отмена в то же состояние считается успешной.
+func CloseReservation(ctx context.Context, id string, to string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var expired bool
+	err = tx.QueryRowContext(ctx, "SELECT status, expires_at <= now() FROM reservations WHERE id = $1 FOR UPDATE", id).Scan(&status, &expired)
+	if err == sql.ErrNoRows {
+		return ErrReservationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == to || (status == ReservationExpired && to == ReservationReleased) {
+		return nil
+	}
+	if status != ReservationActive {
+		return ErrReservationClosed
+	}
+	if expired {
+		if to == ReservationReleased {
+			to = ReservationExpired
+		} else {
+			if _, err := tx.ExecContext(ctx, "UPDATE reservations SET status = $2 WHERE id = $1", id, ReservationExpired); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			return ErrReservationClosed
+		}
+	}
+	if to == ReservationCommitted {
+		_, err := tx.ExecContext(ctx, `UPDATE inventory SET quantity = inventory.quantity - ri.quantity
+			FROM reservation_items ri WHERE ri.reservation_id = $1 AND ri.item_id = inventory.id`, id)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET status = $2 WHERE id = $1", id, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Периодически помечает просроченные резервы, чтобы они не учитывались при следующих резервированиях
+func ExpireReservations(interval time.Duration) {
+	for {
+		res, err := db.Exec("UPDATE reservations SET status = $1 WHERE status = $2 AND expires_at <= now()",
+			ReservationExpired, ReservationActive)
+		if err != nil {
+			log.Println(err)
+		} else if count, _ := res.RowsAffected(); count > 0 {
+			log.Printf("%d reservations expired\n", count)
+		}
+		time.Sleep(interval)
+	}
+}
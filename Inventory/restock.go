@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+var ErrRestockEmpty = errors.New("restock has no items")
+
+// Возврат предметов на склад, например по принятому возврату заказа
+func (s *grpcServer) RestockItems(ctx context.Context, in *pb.RestockRequest) (*pb.StatusReply, error) {
+	id := in.GetRestockId()
+	if id == "" {
+		id = NewReservationID()
+	}
+	items := make(map[string]int)
+	for _, item := range in.GetItems() {
+		items[item.GetId()] += int(item.GetQuantity())
+	}
+	err := Restock(ctx, id, items)
+	if err != nil {
+		var invalid restockError
+		if errors.As(err, &invalid) || err == ErrRestockEmpty {
+			log.Printf("restock %s rejected: %v\n", id, err)
+			return &pb.StatusReply{Flag: false, Message: err.Error()}, nil
+		}
+		log.Printf("restock %s failed: %v\n", id, err)
+		return nil, err
+	}
+	log.Printf("restock - %s success\n", id)
+	return &pb.StatusReply{Flag: true, Message: "success restocked"}, nil
+}
+
+// Ошибка в строке возврата на склад
+type restockError struct {
+	itemID  string
+	message string
+}
+
+func (e restockError) Error() string {
+	return fmt.Sprintf("item %s: %s", e.itemID, e.message)
+}
+
+// Увеличение остатков в одной транзакции. Повторный вызов с тем же кодом ничего не меняет,
+// поэтому вызывающий сервис может безопасно повторять запрос.
+func Restock(ctx context.Context, id string, items map[string]int) error {
+	if len(items) == 0 {
+		return ErrRestockEmpty
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO restocks (id) VALUES ($1) ON CONFLICT (id) DO NOTHING", id)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil
+	}
+	// Строки блокируются в том же порядке, что и при резервировании
+	ids := make([]string, 0, len(items))
+	for itemID := range items {
+		ids = append(ids, itemID)
+	}
+	sort.Strings(ids)
+	for _, itemID := range ids {
+		if items[itemID] <= 0 {
+			return restockError{itemID, "quantity must be greater than zero"}
+		}
+		var found string
+		err := tx.QueryRowContext(ctx, "SELECT id FROM inventory WHERE id::text = $1 FOR UPDATE", itemID).Scan(&found)
+		if err == sql.ErrNoRows {
+			return restockError{itemID, "item not found"}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE inventory SET quantity = quantity + $2 WHERE id = $1", found, items[itemID]); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO restock_items (restock_id, item_id, quantity) VALUES ($1,$2,$3)",
+			id, found, items[itemID])
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
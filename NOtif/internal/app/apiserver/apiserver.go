@@ -2,7 +2,6 @@ package apiserver
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"notif/internal/app/model"
 	"notif/internal/app/store"
@@ -11,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ALbikov-R/4ServicesGRPC/events"
 	"github.com/IBM/sarama"
 )
 
@@ -19,12 +19,12 @@ type Message struct {
 }
 
 type Receiver struct {
-	Consumer          sarama.Consumer
-	PartitionConsumer sarama.PartitionConsumer
-	Topic             string
-	ShutdownSignal    chan os.Signal
-	WaitGroup         sync.WaitGroup
-	store             *store.Store
+	Consumer           sarama.Consumer
+	PartitionConsumers []sarama.PartitionConsumer
+	Topic              string
+	ShutdownSignal     chan os.Signal
+	WaitGroup          sync.WaitGroup
+	store              *store.Store
 }
 
 // NewReceiver создает новый экземпляр Receiver
@@ -33,20 +33,28 @@ func NewReceiver(brokerList []string, topic string) (*Receiver, error) {
 	config.Consumer.Return.Errors = true
 
 	consumer := connectkafka(brokerList, config)
-	partitionConsumer, err := consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
+	// События заказа распределяются по партициям по коду заказа, читаются все партиции
+	partitions, err := consumer.Partitions(topic)
 	if err != nil {
-		log.Fatal("Error2:", err)
 		return nil, err
 	}
+	var partitionConsumers []sarama.PartitionConsumer
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		partitionConsumers = append(partitionConsumers, partitionConsumer)
+	}
 
 	shutdownSignal := make(chan os.Signal, 1)
 	signal.Notify(shutdownSignal, os.Interrupt)
 
 	return &Receiver{
-		Consumer:          consumer,
-		PartitionConsumer: partitionConsumer,
-		Topic:             topic,
-		ShutdownSignal:    shutdownSignal,
+		Consumer:           consumer,
+		PartitionConsumers: partitionConsumers,
+		Topic:              topic,
+		ShutdownSignal:     shutdownSignal,
 	}, nil
 }
 func connectkafka(brokerList []string, config *sarama.Config) sarama.Consumer {
@@ -60,29 +68,82 @@ func connectkafka(brokerList []string, config *sarama.Config) sarama.Consumer {
 	}
 }
 
-// HandleMessages обрабатывает входящие сообщения
-func (r *Receiver) HandleMessages() {
+// HandleMessages обрабатывает входящие сообщения одной партиции
+func (r *Receiver) HandleMessages(partitionConsumer sarama.PartitionConsumer, done <-chan struct{}) {
 	defer r.WaitGroup.Done()
 	for {
 		select {
-		case msg := <-r.PartitionConsumer.Messages():
-			fmt.Println(string(msg.Value))
-			var message model.Message
-			err := json.Unmarshal(msg.Value, &message)
+		case msg := <-partitionConsumer.Messages():
+			message, err := decodeMessage(msg)
 			if err != nil {
-				log.Fatal("Ошибка парсинга JSON файла из Kafka")
+				log.Printf("Ошибка разбора сообщения из Kafka (offset %d): %v", msg.Offset, err)
+				continue
 			}
 			r.processMessage(message)
-		case err := <-r.PartitionConsumer.Errors():
+		case err := <-partitionConsumer.Errors():
 			log.Printf("Error: %v", err)
-		case <-r.ShutdownSignal:
-			r.PartitionConsumer.Close()
+		case <-done:
+			partitionConsumer.Close()
 			return
 		}
 	}
 }
+
+// decodeMessage разбирает событие в конверте, кодировка указана в заголовке content-type.
+// Сообщения без заголовка отправлены до появления конверта и разбираются как JSON.
+func decodeMessage(msg *sarama.ConsumerMessage) (model.Message, error) {
+	var message model.Message
+	contentType := ""
+	for _, h := range msg.Headers {
+		if string(h.Key) == events.ContentTypeHeader {
+			contentType = string(h.Value)
+		}
+	}
+	if contentType == "" {
+		err := json.Unmarshal(msg.Value, &message)
+		return message, err
+	}
+	event, err := events.Unmarshal(msg.Value, contentType)
+	if err != nil {
+		return message, err
+	}
+	payload, err := events.PayloadJSON(event)
+	if err != nil {
+		return message, err
+	}
+	var fields struct {
+		Subject     string                 `json:"subject"`
+		Description string                 `json:"description"`
+		Order       map[string]interface{} `json:"order"`
+		From        string                 `json:"from"`
+		To          string                 `json:"to"`
+	}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return message, err
+	}
+	message = model.Message{
+		Typemes:       event.Type,
+		Description:   fields.Description,
+		Date:          event.OccurredAt.Local().Format("02-01-2006 15:04:05"),
+		OrderID:       string(msg.Key),
+		Order:         fields.Order,
+		EventID:       event.ID,
+		SchemaVersion: event.SchemaVersion,
+		CorrelationID: event.CorrelationID,
+		Source:        event.Source,
+	}
+	if fields.Subject != "" {
+		message.Typemes = fields.Subject
+	}
+	// В OrderStatusChanged версии 1 нет описания
+	if message.Description == "" && fields.To != "" {
+		message.Description = "Order " + message.OrderID + " " + fields.From + " -> " + fields.To
+	}
+	return message, nil
+}
+
 func (r *Receiver) processMessage(message model.Message) {
-	log.Printf("Received message: %s", message)
+	log.Printf("Received message: %+v", message)
 	r.store.Message().Create(&message)
 }
 
@@ -93,7 +154,14 @@ func (r *Receiver) Start() {
 		log.Fatal("Ошибка с открытием БД")
 	}
 	defer r.store.Close()
-	r.WaitGroup.Add(1)
-	go r.HandleMessages()
+	done := make(chan struct{})
+	for _, partitionConsumer := range r.PartitionConsumers {
+		r.WaitGroup.Add(1)
+		go r.HandleMessages(partitionConsumer, done)
+	}
+	go func() {
+		<-r.ShutdownSignal
+		close(done)
+	}()
 	r.WaitGroup.Wait()
 }
@@ -4,4 +4,12 @@ type Message struct {
 	Typemes     string `json:"typemes"`
 	Description string `json:"description"`
 	Date        string `json:"data"`
+	// Событие заказа: код заказа и заказ целиком
+	OrderID string                 `json:"order_id,omitempty" bson:"order_id,omitempty"`
+	Order   map[string]interface{} `json:"order,omitempty" bson:"order,omitempty"`
+	// Метаданные конверта события
+	EventID       string `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	SchemaVersion int32  `json:"schema_version,omitempty" bson:"schema_version,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty" bson:"correlation_id,omitempty"`
+	Source        string `json:"source,omitempty" bson:"source,omitempty"`
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"testOrder/internal/audit"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// История изменений заказов. Записи только добавляются и не меняются, поэтому история
+// сохраняется и после удаления заказа.
+const HistoryCollection = "order_history"
+
+// Заголовки внутренних запросов: кто выполняет изменение и зачем
+const (
+	ActorHeader  = "X-Actor-ID"
+	ReasonHeader = "X-Change-Reason"
+)
+
+// Исполнитель изменений, которые сервис выполняет сам (сага оформления заказа)
+const ActorSystem = "system"
+
+// Действия с заказом
+const (
+	AuditCreate       = "create"
+	AuditUpdate       = "update"
+	AuditDelete       = "delete"
+	AuditStatusChange = "status_change"
+)
+
+// Запись истории заказа
+type AuditEntry struct {
+	ID            string         `json:"id" bson:"_id"`
+	OrderID       string         `json:"order_id" bson:"order_id"`
+	CustomerID    string         `json:"customer_id,omitempty" bson:"customer_id,omitempty"` //Покупатель заказа, по нему история доступна покупателю
+	Action        string         `json:"action" bson:"action"`
+	Actor         string         `json:"actor" bson:"actor"` //customer:<код>, код сотрудника или сервиса, system
+	At            time.Time      `json:"at" bson:"at"`
+	Reason        string         `json:"reason,omitempty" bson:"reason,omitempty"`
+	CorrelationID string         `json:"correlation_id,omitempty" bson:"correlation_id,omitempty"`
+	Changes       []audit.Change `json:"changes" bson:"changes"` //Изменённые поля заказа
+}
+
+// Запись в историю заказов
+type AuditLog interface {
+	Record(ctx context.Context, entry AuditEntry) error
+}
+
+// Исполнитель запроса: покупатель из X-Customer-ID, для внутренних запросов - X-Actor-ID
+func Actor(r *http.Request) string {
+	if caller := Caller(r); caller != "" {
+		return "customer:" + caller
+	}
+	if actor := r.Header.Get(ActorHeader); actor != "" {
+		return actor
+	}
+	return "internal"
+}
+
+// Запись истории об изменении заказа before -> after; nil - заказа нет (до создания
+// или после удаления). История переходов в заказе не сравнивается: каждый переход
+// записывается отдельно.
+func NewAuditEntry(action string, before, after *Order, actor, reason, correlationID string) (AuditEntry, error) {
+	entry := AuditEntry{
+		ID:            NewOrderID(),
+		Action:        action,
+		Actor:         actor,
+		At:            time.Now().UTC().Truncate(time.Millisecond),
+		Reason:        reason,
+		CorrelationID: correlationID,
+	}
+	var b, a interface{}
+	for _, o := range []*Order{before, after} {
+		if o != nil {
+			entry.OrderID, entry.CustomerID = o.ID, o.CustomerID
+		}
+	}
+	if before != nil {
+		snapshot := *before
+		snapshot.History = nil
+		b = snapshot
+	}
+	if after != nil {
+		snapshot := *after
+		snapshot.History = nil
+		a = snapshot
+	}
+	var err error
+	entry.Changes, err = audit.Diff(b, a)
+	return entry, err
+}
+
+// Запись о переходе заказа между состояниями
+func StatusAuditEntry(order Order, change StatusChange, actor, correlationID string) AuditEntry {
+	return AuditEntry{
+		ID:            NewOrderID(),
+		OrderID:       order.ID,
+		CustomerID:    order.CustomerID,
+		Action:        AuditStatusChange,
+		Actor:         actor,
+		At:            change.At.Truncate(time.Millisecond),
+		Reason:        change.Reason,
+		CorrelationID: correlationID,
+		Changes:       []audit.Change{{Path: "status", Before: string(change.From), After: string(change.To)}},
+	}
+}
+
+// Запись изменения заказа в историю. Изменение уже выполнено, поэтому ошибка записи
+// только пишется в лог.
+func RecordAudit(action string, before, after *Order, actor, reason, correlationID string) {
+	entry, err := NewAuditEntry(action, before, after, actor, reason, correlationID)
+	if err == nil {
+		err = mongoAuditLog{}.Record(context.Background(), entry)
+	}
+	if err != nil {
+		log.Printf("history of order %s: %v\n", entry.OrderID, err)
+	}
+}
+
+// Запись перехода заказа в историю
+func RecordStatusChange(order Order, change StatusChange, actor, correlationID string) {
+	if err := (mongoAuditLog{}).Record(context.Background(), StatusAuditEntry(order, change, actor, correlationID)); err != nil {
+		log.Printf("history of order %s: %v\n", order.ID, err)
+	}
+}
+
+// AuditLog в MongoDB. Повторная запись с тем же кодом не считается ошибкой, так сага,
+// продолженная после перезапуска, не дублирует записи.
+type mongoAuditLog struct{}
+
+func historyCollection() *mongo.Collection {
+	// Поля до и после изменения читаются как объекты, а не как упорядоченные списки пар
+	return client.Database(DataBaseName).Collection(HistoryCollection,
+		options.Collection().SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true}))
+}
+
+func (mongoAuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	_, err := historyCollection().InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// История заказа, сначала ранние записи. Покупателю доступна только история его заказов.
+func OrderHistory(ctx context.Context, orderID, caller string) ([]AuditEntry, error) {
+	filter := bson.M{"order_id": orderID}
+	if caller != "" {
+		filter["customer_id"] = caller
+	}
+	cur, err := historyCollection().Find(ctx, filter,
+		options.Find().SetSort(primitive.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	entries := []AuditEntry{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Получить историю изменений заказа, в том числе удалённого
+func GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	entries, err := OrderHistory(r.Context(), mux.Vars(r)["id"], Caller(r))
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if len(entries) == 0 {
+		// Заказ создан до появления истории
+		order, err := FindId(mux.Vars(r)["id"])
+		if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+			err = mongo.ErrNoDocuments
+		}
+		if err == mongo.ErrNoDocuments {
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+			return
+		}
+		if err != nil {
+			InternalError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Заголовок с кодом покупателя, от имени которого выполняется запрос. Его выставляет шлюз
+// после аутентификации; запросы без заголовка считаются внутренними (Product, сотрудники).
+const CustomerHeader = "X-Customer-ID"
+
+var (
+	ErrNoCustomer       = errors.New("order must have a customer")
+	ErrCustomerMismatch = errors.New("customer of the cart does not match the caller")
+)
+
+// Покупатель, от имени которого выполняется запрос, пустая строка - внутренний вызов
+func Caller(r *http.Request) string {
+	return r.Header.Get(CustomerHeader)
+}
+
+// Фильтр заказа с кодом id: покупателю доступны только его заказы
+func ownedFilter(id, caller string) bson.M {
+	filter := bson.M{"_id": id}
+	if caller != "" {
+		filter["customer_id"] = caller
+	}
+	return filter
+}
+
+// Покупатель заказа: из заголовка вызывающего или из корзины
+func OrderCustomer(r *http.Request, cart Cart) (string, error) {
+	caller := Caller(r)
+	switch {
+	case caller != "" && cart.CustomerID != "" && cart.CustomerID != caller:
+		return "", ErrCustomerMismatch
+	case caller != "":
+		return caller, nil
+	case cart.CustomerID != "":
+		return cart.CustomerID, nil
+	}
+	return "", ErrNoCustomer
+}
+
+// Получить заказы покупателя
+func GetCustomerOrders(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if caller := Caller(r); caller != "" && caller != id {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Customers can only list their own orders.")
+		return
+	}
+	query, err := ParseOrderQuery(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	query.CustomerID = id
+	page, err := FindOrders(query)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	DefaultKafkaRetries = 5                      // Повторы отправки внутри продюсера
+	DefaultKafkaBackoff = 100 * time.Millisecond // Пауза перед первым повтором, дальше удваивается
+	MaxKafkaBackoff     = 10 * time.Second
+	SpoolInterval       = 10 * time.Second // Период повторной отправки сообщений из спула
+	SpoolMaxBackoff     = 5 * time.Minute
+)
+
+// Метрики доставки, доступны по GET /debug/vars
+var (
+	kafkaSent      = expvar.NewInt("kafka_messages_sent")
+	kafkaFailed    = expvar.NewInt("kafka_messages_failed") // Неудачные отправки, включая повторы из спула
+	kafkaSpoolSize = expvar.NewInt("kafka_spool_size")
+)
+
+// Настройки продюсера: подтверждение всеми репликами, повторы с растущей паузой.
+// KAFKA_RETRIES - число повторов, KAFKA_RETRY_BACKOFF - первая пауза в миллисекундах.
+func ProducerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Retry.Max = DefaultKafkaRetries
+	if n, err := strconv.Atoi(os.Getenv("KAFKA_RETRIES")); err == nil && n >= 0 {
+		config.Producer.Retry.Max = n
+	}
+	backoff := DefaultKafkaBackoff
+	if ms, err := strconv.Atoi(os.Getenv("KAFKA_RETRY_BACKOFF")); err == nil && ms > 0 {
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	config.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
+		return doubled(backoff, retries, MaxKafkaBackoff)
+	}
+	return config
+}
+
+// Пауза base, удвоенная n-1 раз, но не больше limit
+func doubled(base time.Duration, n int, limit time.Duration) time.Duration {
+	for i := 1; i < n && base < limit; i++ {
+		base *= 2
+	}
+	if base > limit {
+		base = limit
+	}
+	return base
+}
+
+// Более ранние сообщения с тем же ключом ждут повторной отправки в спуле
+var ErrKeySpooled = errors.New("earlier messages with the same key are in the spool")
+
+// Отправка сообщения. Если продюсер уже закрыт, сообщение сразу сохраняется в спул. Если в спуле
+// есть сообщения с тем же ключом, новое встаёт за ними, чтобы события заказа не обогнали друг друга.
+func (p *Producer) Send(message *sarama.ProducerMessage) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		if err := p.spool.Save("", message, sarama.ErrClosedClient); err != nil {
+			log.Printf("kafka message is lost: %v\n", err)
+		}
+		return
+	}
+	queued, err := p.spool.Queue(message)
+	if err != nil {
+		log.Printf("kafka message is lost: %v\n", err)
+		return
+	}
+	if !queued {
+		p.prod.Input() <- message
+	}
+}
+
+// Чтение результатов отправки. Сообщение, которое не удалось отправить после всех повторов,
+// сохраняется в спул; отправленное из спула удаляется из него.
+func (p *Producer) track() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for msg := range p.prod.Successes() {
+			kafkaSent.Add(1)
+			if name, ok := msg.Metadata.(string); ok {
+				p.spool.Remove(name)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for perr := range p.prod.Errors() {
+			kafkaFailed.Add(1)
+			name, _ := perr.Msg.Metadata.(string)
+			log.Printf("kafka message to %s is not delivered: %v\n", perr.Msg.Topic, perr.Err)
+			if err := p.spool.Save(name, perr.Msg, perr.Err); err != nil {
+				log.Printf("kafka message is lost: %v\n", err)
+			}
+		}
+	}()
+	wg.Wait()
+	close(p.done)
+}
+
+// Периодическая повторная отправка сообщений из спула
+func (p *Producer) ResendSpooled(interval time.Duration) {
+	for {
+		names, err := p.spool.Due(time.Now())
+		if err != nil {
+			log.Println(err)
+		}
+		for _, name := range names {
+			msg, err := p.spool.Load(name)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			p.mu.RLock()
+			if p.closed {
+				p.mu.RUnlock()
+				return
+			}
+			p.prod.Input() <- msg
+			p.mu.RUnlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Закрытие продюсера: ожидание результатов всех отправленных сообщений
+func (p *Producer) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.prod.AsyncClose()
+	p.mu.Unlock()
+	<-p.done
+}
+
+// Сообщение в спуле
+type SpooledMessage struct {
+	Topic       string            `json:"topic"`
+	Key         []byte            `json:"key,omitempty"`
+	Value       []byte            `json:"value"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attempts    int               `json:"attempts"`
+	LastError   string            `json:"last_error"`
+	CreatedAt   time.Time         `json:"created_at"`
+	NextAttempt time.Time         `json:"next_attempt"`
+}
+
+// Спул: каталог с неотправленными сообщениями, по файлу на сообщение. Имена файлов
+// начинаются со времени создания, поэтому сообщения повторяются в порядке их появления.
+// Сообщения с одним ключом отправляются по одному: следующее - только после успешной
+// отправки предыдущего.
+type Spool struct {
+	dir      string
+	mu       sync.Mutex
+	inFlight map[string]bool   // Отправлены из спула, результат ещё не получен
+	keys     map[string]string // Ключ сообщения по имени файла
+	pending  map[string]int    // Число сообщений в спуле по ключу
+	seq      int
+}
+
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, inFlight: map[string]bool{}, keys: map[string]string{}, pending: map[string]int{}}
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var msg SpooledMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("spool %s: %v\n", name, err)
+			continue
+		}
+		s.track(name, string(msg.Key))
+	}
+	kafkaSpoolSize.Set(int64(len(names)))
+	if len(names) > 0 {
+		log.Printf("%d kafka messages in spool %s\n", len(names), dir)
+	}
+	return s, nil
+}
+
+func (s *Spool) names() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = filepath.Base(f)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Учёт ключа сообщения, сохранённого в файл name
+func (s *Spool) track(name, key string) {
+	if _, ok := s.keys[name]; ok {
+		return
+	}
+	s.keys[name] = key
+	if key != "" {
+		s.pending[key]++
+	}
+}
+
+// Сохранение неотправленного сообщения. name - имя файла, если сообщение уже в спуле.
+// Файл записывается во временный и переименовывается, чтобы не остаться недописанным.
+func (s *Spool) Save(name string, message *sarama.ProducerMessage, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(name, message, cause)
+}
+
+// Сохранение нового сообщения, если в спуле уже есть сообщения с тем же ключом.
+// Возвращает true, если сообщение сохранено и отправлять его сейчас не нужно.
+func (s *Spool) Queue(message *sarama.ProducerMessage) (bool, error) {
+	if message.Key == nil {
+		return false, nil
+	}
+	key, err := message.Key.Encode()
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[string(key)] == 0 {
+		return false, nil
+	}
+	return true, s.save("", message, ErrKeySpooled)
+}
+
+func (s *Spool) save(name string, message *sarama.ProducerMessage, cause error) error {
+	var msg SpooledMessage
+	existing := false
+	if name != "" {
+		delete(s.inFlight, name)
+		if data, err := os.ReadFile(filepath.Join(s.dir, name)); err == nil {
+			existing = json.Unmarshal(data, &msg) == nil
+		}
+	}
+	if !existing {
+		var err error
+		if msg, err = spooled(message); err != nil {
+			return err
+		}
+		if name == "" {
+			s.seq++
+			name = fmt.Sprintf("%020d-%06d.json", msg.CreatedAt.UnixNano(), s.seq%1000000)
+		}
+		kafkaSpoolSize.Add(1)
+	}
+	msg.Attempts++
+	msg.LastError = cause.Error()
+	msg.NextAttempt = time.Now().UTC().Add(doubled(SpoolInterval, msg.Attempts, SpoolMaxBackoff))
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if !existing {
+		s.track(name, string(msg.Key))
+	}
+	return nil
+}
+
+func spooled(message *sarama.ProducerMessage) (SpooledMessage, error) {
+	msg := SpooledMessage{Topic: message.Topic, CreatedAt: time.Now().UTC()}
+	var err error
+	if message.Key != nil {
+		if msg.Key, err = message.Key.Encode(); err != nil {
+			return msg, err
+		}
+	}
+	if message.Value != nil {
+		if msg.Value, err = message.Value.Encode(); err != nil {
+			return msg, err
+		}
+	}
+	if len(message.Headers) > 0 {
+		msg.Headers = map[string]string{}
+		for _, h := range message.Headers {
+			msg.Headers[string(h.Key)] = string(h.Value)
+		}
+	}
+	return msg, nil
+}
+
+// Удаление отправленного сообщения
+func (s *Spool) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, name)
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	kafkaSpoolSize.Add(-1)
+	if key := s.keys[name]; key != "" {
+		if s.pending[key]--; s.pending[key] == 0 {
+			delete(s.pending, key)
+		}
+	}
+	delete(s.keys, name)
+}
+
+// Сообщения, которые пора отправить повторно. Они помечаются отправленными до получения
+// результата, чтобы не отправить одно сообщение дважды. Из сообщений с одним ключом
+// выбирается только самое раннее, и только если никакое из них сейчас не отправляется.
+func (s *Spool) Due(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	var due []string
+	blocked := map[string]bool{} // Ключи, более раннее сообщение которых ещё в спуле
+	for _, name := range names {
+		key := s.keys[name]
+		if key != "" {
+			if blocked[key] {
+				continue
+			}
+			blocked[key] = true
+		}
+		if s.inFlight[name] {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return due, err
+		}
+		var msg SpooledMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("spool %s: %v\n", name, err)
+			continue
+		}
+		if msg.NextAttempt.After(now) {
+			continue
+		}
+		s.inFlight[name] = true
+		due = append(due, name)
+	}
+	return due, nil
+}
+
+// Сообщение из спула для отправки, в Metadata - имя файла
+func (s *Spool) Load(name string) (*sarama.ProducerMessage, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		s.mu.Lock()
+		delete(s.inFlight, name)
+		s.mu.Unlock()
+		return nil, err
+	}
+	var msg SpooledMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	message := &sarama.ProducerMessage{Topic: msg.Topic, Value: sarama.ByteEncoder(msg.Value), Metadata: name}
+	if msg.Key != nil {
+		message.Key = sarama.ByteEncoder(msg.Key)
+	}
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		message.Headers = append(message.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(msg.Headers[k])})
+	}
+	return message, nil
+}
+
+// Каталог спула, KAFKA_SPOOL_DIR
+func SpoolDir() string {
+	if dir := strings.TrimSpace(os.Getenv("KAFKA_SPOOL_DIR")); dir != "" {
+		return dir
+	}
+	return "spool"
+}
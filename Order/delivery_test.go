@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+func spoolMessage(key, value string) *sarama.ProducerMessage {
+	message := &sarama.ProducerMessage{Topic: "Order", Value: sarama.StringEncoder(value)}
+	if key != "" {
+		message.Key = sarama.StringEncoder(key)
+	}
+	return message
+}
+
+func spoolValue(t *testing.T, s *Spool, name string) string {
+	t.Helper()
+	message, err := s.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := message.Value.Encode()
+	return string(value)
+}
+
+// Сообщения одного заказа уходят из спула по одному и в порядке появления,
+// новые сообщения заказа встают в спуле за ранними
+func TestSpoolKeepsKeyOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("", spoolMessage("order-1", "created"), sarama.ErrOutOfBrokers); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := s.Queue(spoolMessage("order-1", "updated")); err != nil || !queued {
+		t.Fatalf("Queue = %v, %v, want the message of a spooled order to be queued", queued, err)
+	}
+	if queued, err := s.Queue(spoolMessage("order-2", "created")); err != nil || queued {
+		t.Fatalf("Queue = %v, %v, want the message of another order to be sent", queued, err)
+	}
+	if queued, err := s.Queue(spoolMessage("", "notification")); err != nil || queued {
+		t.Fatalf("Queue = %v, %v, want a message without key to be sent", queued, err)
+	}
+
+	// Очередь переживает перезапуск сервиса
+	s, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	due, err := s.Due(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || spoolValue(t, s, due[0]) != "created" {
+		t.Fatalf("due = %v, want only the first message of the order", due)
+	}
+	first := due[0]
+	if due, _ = s.Due(later); len(due) != 0 {
+		t.Fatalf("due = %v while the first message is being sent", due)
+	}
+
+	// Повторная неудача оставляет сообщение первым
+	if err := s.Save(first, spoolMessage("order-1", "created"), sarama.ErrOutOfBrokers); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = s.Due(later.Add(time.Hour)); !reflect.DeepEqual(due, []string{first}) {
+		t.Fatalf("due = %v, want %v again", due, []string{first})
+	}
+
+	s.Remove(first)
+	due, _ = s.Due(later.Add(time.Hour))
+	if len(due) != 1 || spoolValue(t, s, due[0]) != "updated" {
+		t.Fatalf("due = %v, want the next message of the order", due)
+	}
+	s.Remove(due[0])
+	if queued, err := s.Queue(spoolMessage("order-1", "deleted")); err != nil || queued {
+		t.Fatalf("Queue = %v, %v, want the message to be sent once the spool is empty", queued, err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/ALbikov-R/4ServicesGRPC/events"
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/proto"
+)
+
+// Типы событий заказа
+const (
+	EventOrderCreated       = events.TypeOrderCreated
+	EventOrderUpdated       = events.TypeOrderUpdated
+	EventOrderDeleted       = events.TypeOrderDeleted
+	EventOrderStatusChanged = events.TypeOrderStatusChanged
+)
+
+// Источник событий в конверте
+const EventSource = "order"
+
+// Заголовок с кодом корреляции: связывает запрос и все вызванные им события
+const CorrelationHeader = "X-Correlation-ID"
+
+// Публикация событий заказа
+type EventPublisher interface {
+	Publish(event string, order Order, description, correlationID string)
+}
+
+// EventPublisher в Kafka
+type kafkaEvents struct{}
+
+func (kafkaEvents) Publish(event string, order Order, description, correlationID string) {
+	PublishOrderEvent(event, order, description, correlationID)
+}
+
+// Кодировка событий: EVENT_ENCODING=protobuf или json (по умолчанию)
+func EventEncoding() string {
+	if os.Getenv("EVENT_ENCODING") == "protobuf" {
+		return events.ContentTypeProto
+	}
+	return events.ContentTypeJSON
+}
+
+// Код корреляции запроса из заголовка X-Correlation-ID или новый, если его нет.
+// Код возвращается клиенту в том же заголовке.
+func CorrelationID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(CorrelationHeader)
+	if id == "" || len(id) > 128 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(CorrelationHeader, id)
+	return id
+}
+
+// Событие заказа с полным заказом. Ключ сообщения - код заказа, поэтому все события
+// одного заказа попадают в одну партицию и читаются в порядке отправки.
+func PublishOrderEvent(event string, order Order, description, correlationID string) {
+	if description == "" {
+		description = "Order " + order.ID
+	}
+	var payload proto.Message = &events.OrderEvent{Order: OrderToProto(order), Description: description}
+	if event == EventOrderStatusChanged && len(order.History) > 0 {
+		last := order.History[len(order.History)-1]
+		payload = &events.OrderStatusChanged{Order: OrderToProto(order), From: string(last.From), To: string(last.To), Reason: last.Reason, Description: description}
+	}
+	if err := SendEvent(event, order.ID, correlationID, payload); err != nil {
+		log.Printf("event %s of order %s: %v\n", event, order.ID, err)
+	}
+}
+
+// Отправка события в конверте. key - ключ сообщения Kafka, пустой, если событие
+// не относится к заказу.
+func SendEvent(eventType, key, correlationID string, payload proto.Message) error {
+	e, err := events.New(eventType, EventSource, correlationID, payload)
+	if err != nil {
+		return err
+	}
+	encoding := EventEncoding()
+	value, err := events.Marshal(e, encoding)
+	if err != nil {
+		return err
+	}
+	message := &sarama.ProducerMessage{
+		Topic:   topicName,
+		Value:   sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{{Key: []byte(events.ContentTypeHeader), Value: []byte(encoding)}},
+	}
+	if key != "" {
+		message.Key = sarama.StringEncoder(key)
+	}
+	producer.Send(message)
+	return nil
+}
+
+// Заказ в формате нагрузки события
+func OrderToProto(order Order) *events.Order {
+	o := &events.Order{
+		Id:         order.ID,
+		CreatedAt:  order.Data.UnixMilli(),
+		CustomerId: order.CustomerID,
+		Status:     string(order.Status),
+		Totals: &events.OrderTotals{
+			Currency:    order.Totals.Currency,
+			Subtotal:    order.Totals.Subtotal,
+			Discount:    order.Totals.Discount,
+			Tax:         order.Totals.Tax,
+			TaxIncluded: order.Totals.TaxIncluded,
+			Shipping:    order.Totals.Shipping,
+			GrandTotal:  order.Totals.GrandTotal,
+		},
+	}
+	for _, d := range order.Totals.Discounts {
+		o.Totals.Discounts = append(o.Totals.Discounts, &events.Discount{Name: d.Name, Amount: d.Amount})
+	}
+	for _, h := range order.History {
+		o.History = append(o.History, &events.StatusChange{From: string(h.From), To: string(h.To), At: h.At.UnixMilli(), Reason: h.Reason})
+	}
+	for _, p := range order.Product {
+		o.Lines = append(o.Lines, &events.OrderLine{
+			ItemId:   p.ItemID,
+			Name:     p.Name,
+			Quantity: int32(p.Quantity),
+			Price:    &events.Money{Amount: p.Price.Amount, Currency: p.Price.Currency},
+			Total:    &events.Money{Amount: p.Total.Amount, Currency: p.Total.Currency},
+		})
+	}
+	return o
+}
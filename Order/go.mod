@@ -3,14 +3,17 @@ module testOrder
 go 1.22.0
 
 require (
+	github.com/ALbikov-R/4ServicesGRPC v1.0.0
 	github.com/IBM/sarama v1.43.0
 	github.com/gorilla/mux v1.8.1
+	github.com/jung-kurt/gofpdf v1.16.2
 	go.mongodb.org/mongo-driver v1.14.0
+	google.golang.org/grpc v1.62.1
+	google.golang.org/protobuf v1.32.0
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 )
 
 require (
-	github.com/ALbikov-R/4ServicesGRPC v1.0.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/eapache/go-resiliency v1.6.0 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20230731223053-c322873962e3 // indirect
@@ -39,6 +42,6 @@ require (
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240123012728-ef4313101c80 // indirect
-	google.golang.org/grpc v1.62.1 // indirect
-	google.golang.org/protobuf v1.32.0 // indirect
 )
+
+replace github.com/ALbikov-R/4ServicesGRPC => ../grpc
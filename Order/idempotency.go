@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Заголовок с ключом идемпотентности
+const IdempotencyHeader = "Idempotency-Key"
+
+// Коллекция с ответами на запросы с ключом, просроченные документы удаляет TTL индекс
+const IdempotencyCollection = "idempotency"
+
+// Запрос с ключом считается выполняющимся не дольше этого времени
+const IdempotencyLock = time.Minute
+
+var (
+	ErrKeyReused     = errors.New("idempotency key is already used with a different request")
+	ErrKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// Время хранения ответа, переопределяется переменной IDEMPOTENCY_TTL (в секундах)
+func IdempotencyTTL() time.Duration {
+	if ttl, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL")); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// Запрос с ключом и ответ на него (Status 0 - ответа ещё нет)
+type IdempotencyRecord struct {
+	ID          string    `bson:"_id"` //Область и ключ
+	Hash        string    `bson:"hash"`
+	Status      int       `bson:"status"`
+	ContentType string    `bson:"content_type"`
+	Body        []byte    `bson:"body"`
+	LockedUntil time.Time `bson:"locked_until"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// Ответ обработчика, который записывается, прежде чем уйти клиенту
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+func (r *recordedResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// Область ключей идемпотентности маршрута route: ключи каждого покупателя отдельны,
+// чтобы повтор чужого ключа не вернул ответ с чужим заказом. Внутренние вызовы - в общей области.
+func callerScope(route string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if caller := Caller(r); caller != "" {
+			return route + " customer:" + caller
+		}
+		return route
+	}
+}
+
+// Обработчик, повтор которого с тем же заголовком Idempotency-Key возвращает первый ответ
+// без повторного выполнения. scope отделяет ключи разных клиентов.
+// Ответы 5xx не сохраняются, такой запрос можно повторить с тем же ключом.
+func Idempotent(scope func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid idempotency key", "The "+IdempotencyHeader+" header must not be longer than 255 characters.")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The request body could not be read.")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		id := scope(r) + "\n" + key
+
+		stored, err := ClaimIdempotencyKey(context.TODO(), id, hex.EncodeToString(sum[:]))
+		switch {
+		case err == ErrKeyReused:
+			ErrorResponse(w, http.StatusConflict, "Idempotency key reused", "The key was already used with a different request.")
+			return
+		case err == ErrKeyInProgress:
+			w.Header().Set("Retry-After", "1")
+			ErrorResponse(w, http.StatusConflict, "Request in progress", "The request with this key is still being processed, retry later.")
+			return
+		case err != nil:
+			InternalError(w, err)
+			return
+		case stored != nil:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &recordedResponse{header: http.Header{}}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		collection := client.Database(DataBaseName).Collection(IdempotencyCollection)
+		if rec.status >= 500 {
+			_, err = collection.DeleteOne(context.TODO(), bson.M{"_id": id, "status": 0})
+		} else {
+			_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{
+				"status":       rec.status,
+				"content_type": rec.header.Get("Content-Type"),
+				"body":         rec.body.Bytes(),
+			}})
+		}
+		if err != nil {
+			log.Printf("idempotency key %s: %v\n", key, err)
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// Захват ключа для выполнения запроса. Если запрос с этим ключом уже выполнен,
+// возвращается сохранённый ответ.
+func ClaimIdempotencyKey(ctx context.Context, id, hash string) (*IdempotencyRecord, error) {
+	collection := client.Database(DataBaseName).Collection(IdempotencyCollection)
+	now := time.Now().UTC()
+	rec := IdempotencyRecord{ID: id, Hash: hash, LockedUntil: now.Add(IdempotencyLock), ExpiresAt: now.Add(IdempotencyTTL())}
+	_, err := collection.InsertOne(ctx, rec)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	var old IdempotencyRecord
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&old); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrKeyInProgress // Удалён после неудачного выполнения, повтор займёт ключ заново
+		}
+		return nil, err
+	}
+	// Документ меняется, только если его не успел изменить параллельный запрос с тем же ключом
+	filter := bson.M{"_id": id, "locked_until": old.LockedUntil, "status": old.Status}
+	var res *mongo.UpdateResult
+	switch {
+	case !old.ExpiresAt.After(now):
+		// Просроченный ключ ещё не удалён TTL индексом, запрос выполняется как новый
+		res, err = collection.ReplaceOne(ctx, filter, rec)
+	case old.Hash != hash:
+		return nil, ErrKeyReused
+	case old.Status != 0:
+		return &old, nil
+	case old.LockedUntil.After(now):
+		return nil, ErrKeyInProgress
+	default:
+		// Прошлое выполнение прервано
+		res, err = collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"locked_until": rec.LockedUntil}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrKeyInProgress
+	}
+	return nil, nil
+}
@@ -0,0 +1,183 @@
+// Package audit сравнивает два состояния документа и возвращает список изменённых полей.
+//
+// Документы сравниваются в виде JSON: путь поля составляется из имён полей JSON через точку,
+// элементы массивов объектов с полем item_id или id сопоставляются по нему
+// (product[item_id=1].quantity), остальные - по номеру (history[0]).
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Изменение поля. Before пусто у добавленного поля, After - у удалённого.
+type Change struct {
+	Path   string      `json:"path" bson:"path"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// Поля, по которым сопоставляются элементы массивов
+var keys = []string{"item_id", "id"}
+
+// Изменения от before к after. nil означает отсутствующий документ: при создании
+// все поля after считаются добавленными, при удалении все поля before - удалёнными.
+func Diff(before, after interface{}) ([]Change, error) {
+	b, err := normalize(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := normalize(after)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		b = map[string]interface{}{}
+	}
+	if a == nil {
+		a = map[string]interface{}{}
+	}
+	changes := []Change{}
+	diff("", b, a, &changes)
+	return changes, nil
+}
+
+// Значение в виде JSON: объекты - map, массивы - срезы, целые числа - int64
+func normalize(v interface{}) (interface{}, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var res interface{}
+	if err := dec.Decode(&res); err != nil {
+		return nil, err
+	}
+	return numbers(res), nil
+}
+
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = numbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = numbers(item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+func diff(path string, before, after interface{}, changes *[]Change) {
+	bm, bok := before.(map[string]interface{})
+	am, aok := after.(map[string]interface{})
+	if bok && aok {
+		names := make([]string, 0, len(bm)+len(am))
+		for k := range bm {
+			names = append(names, k)
+		}
+		for k := range am {
+			if _, ok := bm[k]; !ok {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			diff(join(path, k), bm[k], am[k], changes)
+		}
+		return
+	}
+	bs, bok := before.([]interface{})
+	as, aok := after.([]interface{})
+	if bok && aok {
+		diffSlices(path, bs, as, changes)
+		return
+	}
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, Change{Path: path, Before: before, After: after})
+	}
+}
+
+// Массивы объектов с общим ключом сравниваются по ключу, остальные - по номеру элемента
+func diffSlices(path string, before, after []interface{}, changes *[]Change) {
+	if key := commonKey(before, after); key != "" {
+		index := make(map[string]interface{}, len(after))
+		for _, item := range after {
+			index[keyOf(item, key)] = item
+		}
+		seen := make(map[string]bool, len(before))
+		for _, item := range before {
+			k := keyOf(item, key)
+			seen[k] = true
+			diff(fmt.Sprintf("%s[%s=%s]", path, key, k), item, index[k], changes)
+		}
+		for _, item := range after {
+			if k := keyOf(item, key); !seen[k] {
+				diff(fmt.Sprintf("%s[%s=%s]", path, key, k), nil, item, changes)
+			}
+		}
+		return
+	}
+	for i := 0; i < len(before) || i < len(after); i++ {
+		var b, a interface{}
+		if i < len(before) {
+			b = before[i]
+		}
+		if i < len(after) {
+			a = after[i]
+		}
+		diff(fmt.Sprintf("%s[%d]", path, i), b, a, changes)
+	}
+}
+
+// Ключ, который есть у всех элементов обоих массивов и не повторяется
+func commonKey(before, after []interface{}) string {
+	for _, key := range keys {
+		ok := len(before)+len(after) > 0
+		for _, items := range [][]interface{}{before, after} {
+			seen := make(map[string]bool, len(items))
+			for _, item := range items {
+				m, isMap := item.(map[string]interface{})
+				if !isMap {
+					ok = false
+					break
+				}
+				if _, has := m[key]; !has || seen[keyOf(item, key)] {
+					ok = false
+					break
+				}
+				seen[keyOf(item, key)] = true
+			}
+		}
+		if ok {
+			return key
+		}
+	}
+	return ""
+}
+
+func keyOf(item interface{}, key string) string {
+	return fmt.Sprint(item.(map[string]interface{})[key])
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,72 @@
+package invoice
+
+import (
+	"html/template"
+	"io"
+)
+
+var page = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"amount": FormatAmount,
+	"date":   FormatDate,
+	"inc":    func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; margin: 40px; color: #222; }
+h1 { font-size: 24px; margin: 0 0 4px; }
+table { border-collapse: collapse; width: 100%; margin-top: 24px; }
+th, td { padding: 6px 8px; border-bottom: 1px solid #ddd; text-align: left; }
+.num { text-align: right; white-space: nowrap; }
+.parties { display: flex; justify-content: space-between; margin-top: 24px; }
+.totals td { border: none; }
+.grand td { font-weight: bold; border-top: 2px solid #222; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.Number}}</h1>
+<div>Issued: {{date .IssuedAt}}</div>
+<div>Order: {{.OrderID}} of {{date .OrderDate}}</div>
+<div class="parties">
+<div>
+<strong>Seller</strong><br>
+{{.Seller.Name}}<br>
+{{.Seller.Address}}<br>
+Tax ID: {{.Seller.TaxID}}
+{{- with .Seller.Email}}<br>{{.}}{{end}}
+{{- with .Seller.Phone}}<br>{{.}}{{end}}
+{{- with .Seller.Bank}}<br>{{.}}{{end}}
+</div>
+<div>
+<strong>Customer</strong><br>
+{{.CustomerID}}
+</div>
+</div>
+<table>
+<tr><th>#</th><th>Item</th><th>Code</th><th class="num">Quantity</th><th class="num">Unit price</th><th class="num">Total</th></tr>
+{{- $cur := .Totals.Currency}}
+{{- range $i, $l := .Lines}}
+<tr><td>{{inc $i}}</td><td>{{$l.Name}}</td><td>{{$l.ItemID}}</td><td class="num">{{$l.Quantity}}</td><td class="num">{{amount $l.UnitPrice $cur}}</td><td class="num">{{amount $l.Total $cur}}</td></tr>
+{{- end}}
+</table>
+<table class="totals">
+<tr><td></td><td class="num">Subtotal</td><td class="num">{{amount .Totals.Subtotal $cur}}</td></tr>
+{{- range .Totals.Discounts}}
+<tr><td></td><td class="num">Discount: {{.Name}}</td><td class="num">-{{amount .Amount $cur}}</td></tr>
+{{- end}}
+{{- if .Totals.Shipping}}
+<tr><td></td><td class="num">Shipping</td><td class="num">{{amount .Totals.Shipping $cur}}</td></tr>
+{{- end}}
+<tr><td></td><td class="num">{{if .Totals.TaxIncluded}}Tax included{{else}}Tax{{end}}</td><td class="num">{{amount .Totals.Tax $cur}}</td></tr>
+<tr class="grand"><td></td><td class="num">Total due</td><td class="num">{{amount .Totals.GrandTotal $cur}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// Вывод счёта в HTML
+func HTML(w io.Writer, inv Invoice) error {
+	return page.Execute(w, inv)
+}
@@ -0,0 +1,123 @@
+// Package invoice описывает счёт по заказу и выводит его в HTML и PDF.
+//
+// Счёт - снимок заказа на момент выставления: строки, итоги, дата заказа и реквизиты
+// продавца не меняются, даже если заказ или реквизиты изменятся позже.
+package invoice
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"testOrder/internal/pricing"
+)
+
+// Реквизиты продавца
+type Seller struct {
+	Name    string `json:"name" bson:"name"`
+	Address string `json:"address" bson:"address"`
+	TaxID   string `json:"tax_id" bson:"tax_id"`
+	Email   string `json:"email,omitempty" bson:"email,omitempty"`
+	Phone   string `json:"phone,omitempty" bson:"phone,omitempty"`
+	Bank    string `json:"bank,omitempty" bson:"bank,omitempty"` //Банковские реквизиты
+}
+
+// Строка счёта, суммы в минимальных единицах валюты
+type Line struct {
+	ItemID    string `json:"item_id" bson:"item_id"`
+	Name      string `json:"name" bson:"name"`
+	Quantity  int    `json:"quantity" bson:"quantity"`
+	UnitPrice int64  `json:"unit_price" bson:"unit_price"`
+	Total     int64  `json:"total" bson:"total"`
+}
+
+// Счёт по заказу
+type Invoice struct {
+	Seq        int64          `json:"seq" bson:"seq"`       //Порядковый номер
+	Number     string         `json:"number" bson:"number"` //Номер с префиксом
+	IssuedAt   time.Time      `json:"issued_at" bson:"issued_at"`
+	OrderID    string         `json:"order_id" bson:"order_id"`
+	OrderDate  time.Time      `json:"order_date" bson:"order_date"`
+	CustomerID string         `json:"customer_id" bson:"customer_id"`
+	Seller     Seller         `json:"seller" bson:"seller"`
+	Lines      []Line         `json:"lines" bson:"lines"`
+	Totals     pricing.Totals `json:"totals" bson:"totals"`
+}
+
+// Настройки счетов: реквизиты продавца, префикс номера и шрифт TrueType для PDF.
+// Без шрифта PDF использует встроенный Helvetica, в котором нет кириллицы.
+type Config struct {
+	Seller Seller `json:"seller"`
+	Prefix string `json:"number_prefix"`
+	Font   string `json:"font"`
+}
+
+var DefaultConfig = Config{
+	Seller: Seller{Name: "4Services LLC", Address: "Moscow, Russia", TaxID: "0000000000"},
+	Prefix: "INV-",
+}
+
+// Загрузка настроек из JSON файла, пустой путь - настройки по умолчанию
+func Load(path string) (Config, error) {
+	if path == "" {
+		return DefaultConfig, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	config := DefaultConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+	if config.Font != "" {
+		if _, err := os.Stat(config.Font); err != nil {
+			return Config{}, err
+		}
+	}
+	return config, nil
+}
+
+// Номер счёта: префикс и порядковый номер, дополненный нулями до шести знаков
+func FormatNumber(prefix string, seq int64) string {
+	return fmt.Sprintf("%s%06d", prefix, seq)
+}
+
+// Дата в виде 02.01.2006
+func FormatDate(t time.Time) string {
+	return t.Format("02.01.2006")
+}
+
+// Число знаков после запятой у валют, отличных от двух
+var exponents = map[string]int{"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "BHD": 3, "KWD": 3, "OMR": 3, "TND": 3}
+
+// Сумма в минимальных единицах в виде "12 500.00 RUB"
+func FormatAmount(amount int64, currency string) string {
+	exp, ok := exponents[currency]
+	if !ok {
+		exp = 2
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-exp], digits[len(digits)-exp:]
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(c)
+	}
+	if exp > 0 {
+		b.WriteString("." + frac)
+	}
+	return sign + b.String() + " " + currency
+}
@@ -0,0 +1,108 @@
+package invoice
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Вывод счёта в PDF формата A4. font - путь к шрифту TrueType с нужными символами,
+// пустая строка - встроенный Helvetica (только латиница, остальные символы заменяются).
+func PDF(w io.Writer, inv Invoice, font string) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetCreationDate(inv.IssuedAt)
+	pdf.SetModificationDate(inv.IssuedAt)
+	pdf.SetTitle("Invoice "+inv.Number, true)
+	family, tr := "Helvetica", pdf.UnicodeTranslatorFromDescriptor("")
+	if font != "" {
+		family, tr = "invoice", func(s string) string { return s }
+		pdf.AddUTF8Font(family, "", font)
+		pdf.AddUTF8Font(family, "B", font)
+	}
+	pdf.AddPage()
+	left, _, right, _ := pdf.GetMargins()
+	width, _ := pdf.GetPageSize()
+	width -= left + right
+	cur := inv.Totals.Currency
+
+	pdf.SetFont(family, "B", 18)
+	pdf.CellFormat(0, 10, tr("Invoice "+inv.Number), "", 1, "L", false, 0, "")
+	pdf.SetFont(family, "", 10)
+	pdf.CellFormat(0, 5, tr("Issued: "+FormatDate(inv.IssuedAt)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 5, tr("Order: "+inv.OrderID+" of "+FormatDate(inv.OrderDate)), "", 1, "L", false, 0, "")
+	pdf.Ln(6)
+
+	seller := inv.Seller.Name + "\n" + inv.Seller.Address + "\nTax ID: " + inv.Seller.TaxID
+	for _, s := range []string{inv.Seller.Email, inv.Seller.Phone, inv.Seller.Bank} {
+		if s != "" {
+			seller += "\n" + s
+		}
+	}
+	y := pdf.GetY()
+	pdf.SetFont(family, "B", 10)
+	pdf.CellFormat(width/2, 5, tr("Seller"), "", 2, "L", false, 0, "")
+	pdf.SetFont(family, "", 10)
+	pdf.MultiCell(width/2, 5, tr(seller), "", "L", false)
+	bottom := pdf.GetY()
+	pdf.SetXY(left+width/2, y)
+	pdf.SetFont(family, "B", 10)
+	pdf.CellFormat(width/2, 5, tr("Customer"), "", 2, "L", false, 0, "")
+	pdf.SetFont(family, "", 10)
+	pdf.MultiCell(width/2, 5, tr(inv.CustomerID), "", "L", false)
+	if pdf.GetY() < bottom {
+		pdf.SetY(bottom)
+	}
+	pdf.Ln(6)
+
+	cols := []float64{8, width - 8 - 30 - 18 - 30 - 32, 30, 18, 30, 32}
+	header := []string{"#", "Item", "Code", "Quantity", "Unit price", "Total"}
+	align := []string{"L", "L", "L", "R", "R", "R"}
+	pdf.SetFont(family, "B", 10)
+	for i, h := range header {
+		pdf.CellFormat(cols[i], 7, tr(h), "B", 0, align[i], false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont(family, "", 10)
+	for i, l := range inv.Lines {
+		row := []string{strconv.Itoa(i + 1), l.Name, l.ItemID, strconv.Itoa(l.Quantity), FormatAmount(l.UnitPrice, cur), FormatAmount(l.Total, cur)}
+		for j, v := range row {
+			pdf.CellFormat(cols[j], 7, fit(pdf, tr, v, cols[j]), "B", 0, align[j], false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	pdf.Ln(4)
+
+	total := func(label, value string, bold bool) {
+		style := ""
+		if bold {
+			style = "B"
+		}
+		pdf.SetFont(family, style, 10)
+		pdf.CellFormat(width-40, 6, tr(label), "", 0, "R", false, 0, "")
+		pdf.CellFormat(40, 6, tr(value), "", 1, "R", false, 0, "")
+	}
+	total("Subtotal", FormatAmount(inv.Totals.Subtotal, cur), false)
+	for _, d := range inv.Totals.Discounts {
+		total("Discount: "+d.Name, "-"+FormatAmount(d.Amount, cur), false)
+	}
+	if inv.Totals.Shipping != 0 {
+		total("Shipping", FormatAmount(inv.Totals.Shipping, cur), false)
+	}
+	if inv.Totals.TaxIncluded {
+		total("Tax included", FormatAmount(inv.Totals.Tax, cur), false)
+	} else {
+		total("Tax", FormatAmount(inv.Totals.Tax, cur), false)
+	}
+	total("Total due", FormatAmount(inv.Totals.GrandTotal, cur), true)
+	return pdf.Output(w)
+}
+
+// Текст, обрезанный до ширины колонки
+func fit(pdf *gofpdf.Fpdf, tr func(string) string, s string, width float64) string {
+	runes := []rune(s)
+	for len(runes) > 0 && pdf.GetStringWidth(tr(string(runes))) > width-2 {
+		runes = runes[:len(runes)-1]
+	}
+	return tr(string(runes))
+}
@@ -0,0 +1,82 @@
+// Package lifecycle описывает состояния заказа и допустимые переходы между ними.
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Status string
+
+// Состояния заказа
+const (
+	Pending   Status = "pending"
+	Failed    Status = "failed"
+	Created   Status = "created"
+	Paid      Status = "paid"
+	Packed    Status = "packed"
+	Shipped   Status = "shipped"
+	Delivered Status = "delivered"
+	Cancelled Status = "cancelled"
+	Returned  Status = "returned"
+)
+
+// Допустимые переходы: отменить можно до отгрузки, вернуть - отгруженный или доставленный заказ.
+// Из cancelled и returned переходов нет. Pending - заказ, который ещё оформляется, из него
+// сервис переводит заказ в created или, если оформление не удалось, в failed.
+var transitions = map[Status][]Status{
+	Pending:   {Created, Failed},
+	Failed:    {},
+	Created:   {Paid, Cancelled},
+	Paid:      {Packed, Cancelled},
+	Packed:    {Shipped, Cancelled},
+	Shipped:   {Delivered, Returned},
+	Delivered: {Returned},
+	Cancelled: {},
+	Returned:  {},
+}
+
+var ErrUnknownStatus = errors.New("unknown order status")
+
+// Недопустимый переход
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order cannot move from %s to %s", e.From, e.To)
+}
+
+func Valid(s Status) bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Состояния, в которые можно перейти из from
+func Allowed(from Status) []Status {
+	return append([]Status{}, transitions[from]...)
+}
+
+// Проверка перехода from -> to
+func Check(from, to Status) error {
+	if !Valid(to) {
+		return ErrUnknownStatus
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to}
+}
+
+// Конечное состояние, из которого переходов нет
+func Final(s Status) bool {
+	return Valid(s) && len(transitions[s]) == 0
+}
+
+// Состояние, которое устанавливает только сам сервис при оформлении заказа
+func System(s Status) bool {
+	return s == Pending || s == Created || s == Failed
+}
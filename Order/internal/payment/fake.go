@@ -0,0 +1,167 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Заголовок с подписью webhook Fake: HMAC-SHA256 тела в hex
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// Токены карт Fake. Любой другой токен проходит успешно.
+const (
+	TokenDeclined          = "tok_declined"           //Авторизация отклонена: card_declined
+	TokenInsufficientFunds = "tok_insufficient_funds" //Авторизация отклонена: insufficient_funds
+	TokenAsync             = "tok_async"              //Списание pending, результат приходит webhook'ом
+	TokenError             = "tok_error"              //Провайдер недоступен
+)
+
+var ErrFakeUnavailable = errors.New("fake provider is unavailable")
+
+// Детерминированный провайдер: результат зависит только от токена карты и предыдущих
+// операций, коды операций выводятся из ключа идемпотентности. Состояние хранится в
+// памяти и теряется при перезапуске.
+type Fake struct {
+	Secret string //Ключ подписи webhook
+
+	mu         sync.Mutex
+	results    map[string]Result     //Ответы по ключу идемпотентности
+	operations map[string]*operation //Операции по коду
+}
+
+type operation struct {
+	token    string
+	amount   int64
+	captured int64
+	refunded int64
+	voided   bool
+}
+
+func NewFake(secret string) *Fake {
+	return &Fake{Secret: secret, results: map[string]Result{}, operations: map[string]*operation{}}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Код операции: префикс и начало хеша ключа идемпотентности
+func fakeReference(prefix, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return prefix + hex.EncodeToString(sum[:12])
+}
+
+// Выполнение операции один раз на ключ идемпотентности
+func (f *Fake) once(key string, do func() (Result, error)) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if res, ok := f.results[key]; ok {
+		return res, nil
+	}
+	res, err := do()
+	if err != nil {
+		return Result{}, err
+	}
+	f.results[key] = res
+	return res, nil
+}
+
+func declined(code, message string) Result {
+	return Result{Status: Declined, Code: code, Message: message}
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (Result, error) {
+	return f.once(req.IdempotencyKey, func() (Result, error) {
+		switch {
+		case req.Token == TokenError:
+			return Result{}, ErrFakeUnavailable
+		case req.Amount <= 0:
+			return declined("invalid_amount", "amount must be greater than zero"), nil
+		case req.Token == TokenDeclined:
+			return declined("card_declined", "the card was declined"), nil
+		case req.Token == TokenInsufficientFunds:
+			return declined("insufficient_funds", "the card has insufficient funds"), nil
+		}
+		ref := fakeReference("auth_", req.IdempotencyKey)
+		f.operations[ref] = &operation{token: req.Token, amount: req.Amount}
+		return Result{Status: Succeeded, Reference: ref}, nil
+	})
+}
+
+func (f *Fake) Capture(ctx context.Context, req Request) (Result, error) {
+	return f.once(req.IdempotencyKey, func() (Result, error) {
+		auth, ok := f.operations[req.Reference]
+		switch {
+		case !ok:
+			return declined("unknown_authorization", "authorization not found"), nil
+		case auth.voided:
+			return declined("authorization_voided", "authorization is voided"), nil
+		case req.Amount <= 0 || auth.captured+req.Amount > auth.amount:
+			return declined("invalid_amount", "amount exceeds the authorized amount"), nil
+		}
+		auth.captured += req.Amount
+		ref := fakeReference("cap_", req.IdempotencyKey)
+		f.operations[ref] = &operation{token: auth.token, amount: req.Amount}
+		if auth.token == TokenAsync {
+			return Result{Status: Pending, Reference: ref}, nil
+		}
+		return Result{Status: Succeeded, Reference: ref}, nil
+	})
+}
+
+func (f *Fake) Refund(ctx context.Context, req Request) (Result, error) {
+	return f.once(req.IdempotencyKey, func() (Result, error) {
+		capture, ok := f.operations[req.Reference]
+		switch {
+		case !ok:
+			return declined("unknown_capture", "capture not found"), nil
+		case req.Amount <= 0 || capture.refunded+req.Amount > capture.amount:
+			return declined("invalid_amount", "amount exceeds the captured amount"), nil
+		}
+		capture.refunded += req.Amount
+		return Result{Status: Succeeded, Reference: fakeReference("ref_", req.IdempotencyKey)}, nil
+	})
+}
+
+func (f *Fake) Void(ctx context.Context, req Request) (Result, error) {
+	return f.once(req.IdempotencyKey, func() (Result, error) {
+		auth, ok := f.operations[req.Reference]
+		switch {
+		case !ok:
+			return declined("unknown_authorization", "authorization not found"), nil
+		case auth.captured > 0:
+			return declined("authorization_captured", "authorization is already captured"), nil
+		}
+		auth.voided = true
+		return Result{Status: Succeeded, Reference: req.Reference}, nil
+	})
+}
+
+// Подпись тела webhook ключом Secret
+func (f *Fake) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *Fake) VerifyWebhook(body []byte, header http.Header) (WebhookEvent, error) {
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || f.Secret == "" {
+		return WebhookEvent{}, ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(f.Sign(body))
+	if !hmac.Equal(signature, expected) {
+		return WebhookEvent{}, ErrInvalidSignature
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return WebhookEvent{}, err
+	}
+	return event, nil
+}
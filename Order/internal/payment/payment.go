@@ -0,0 +1,60 @@
+// Package payment описывает запросы и ответы платёжного провайдера и содержит
+// детерминированный провайдер Fake для локального запуска и тестов.
+//
+// Все суммы целые, в минимальных единицах валюты. Каждый запрос передаёт ключ
+// идемпотентности: повтор запроса с тем же ключом возвращает первый результат и не
+// списывает деньги повторно.
+package payment
+
+import "errors"
+
+// Результат операции у провайдера
+type Status string
+
+const (
+	Succeeded Status = "succeeded"
+	Declined  Status = "declined" //Отклонено банком или провайдером, повтор не поможет
+	Pending   Status = "pending"  //Результат придёт webhook'ом
+)
+
+// Авторизация (блокировка) суммы на карте
+type AuthorizeRequest struct {
+	IdempotencyKey string
+	OrderID        string
+	Amount         int64
+	Currency       string
+	Token          string //Токен карты от платёжной формы провайдера
+}
+
+// Списание, возврат или отмена по ранее выполненной операции
+type Request struct {
+	IdempotencyKey string
+	Reference      string //Код авторизации (capture, void) или списания (refund) у провайдера
+	Amount         int64
+	Currency       string
+}
+
+// Ответ провайдера
+type Result struct {
+	Status    Status
+	Reference string //Код операции у провайдера
+	Code      string //Причина отказа
+	Message   string
+}
+
+// Типы событий webhook
+const (
+	EventCaptureSucceeded = "capture.succeeded"
+	EventCaptureFailed    = "capture.failed"
+)
+
+// Событие webhook об операции, результат которой был pending
+type WebhookEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Reference string `json:"reference"` //Код операции у провайдера
+	Amount    int64  `json:"amount"`
+	Code      string `json:"code,omitempty"`
+}
+
+var ErrInvalidSignature = errors.New("webhook signature is invalid")
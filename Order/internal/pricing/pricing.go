@@ -0,0 +1,97 @@
+// Package pricing рассчитывает итоги заказа по настраиваемым правилам.
+//
+// Порядок расчёта:
+//  1. сумма строки = цена единицы * количество;
+//  2. subtotal = сумма всех строк;
+//  3. discount = сумма подходящих скидок, но не больше subtotal;
+//  4. налоговая база = subtotal - discount;
+//  5. tax: если налог включён в цены, tax = база * ставка / (1 + ставка), иначе tax = база * ставка;
+//  6. shipping = стоимость доставки, если база меньше порога бесплатной доставки;
+//  7. grand_total = база + shipping, плюс tax, если он не включён в цены.
+//
+// Все суммы целые, в минимальных единицах валюты; дробные результаты округляются
+// до ближайшего целого, половина - от нуля.
+package pricing
+
+import "errors"
+
+// Строка заказа для расчёта
+type Line struct {
+	UnitPrice int64
+	Currency  string
+	Quantity  int
+}
+
+// Применённая скидка
+type Discount struct {
+	Name   string `json:"name"`
+	Amount int64  `json:"amount"`
+}
+
+// Итоги заказа в минимальных единицах валюты
+type Totals struct {
+	Currency    string     `json:"currency"`
+	Subtotal    int64      `json:"subtotal"`
+	Discount    int64      `json:"discount"`
+	Discounts   []Discount `json:"discounts"`
+	Tax         int64      `json:"tax"`
+	TaxIncluded bool       `json:"tax_included"`
+	Shipping    int64      `json:"shipping"`
+	GrandTotal  int64      `json:"grand_total"`
+}
+
+var ErrMixedCurrency = errors.New("order lines must have the same currency")
+
+// Округление num/den до ближайшего целого, половина - от нуля (den > 0)
+func DivRound(num, den int64) int64 {
+	if num < 0 {
+		return -DivRound(-num, den)
+	}
+	return (num + den/2) / den
+}
+
+// Расчёт сумм строк и итогов заказа
+func Calculate(lines []Line, rules Rules) ([]int64, Totals, error) {
+	totals := Totals{Discounts: []Discount{}, TaxIncluded: rules.Tax.Included}
+	lineTotals := make([]int64, len(lines))
+	for i, line := range lines {
+		if totals.Currency == "" {
+			totals.Currency = line.Currency
+		} else if line.Currency != totals.Currency {
+			return nil, Totals{}, ErrMixedCurrency
+		}
+		lineTotals[i] = line.UnitPrice * int64(line.Quantity)
+		totals.Subtotal += lineTotals[i]
+	}
+
+	for _, rule := range rules.Discounts {
+		if totals.Subtotal < rule.MinSubtotal {
+			continue
+		}
+		amount := DivRound(totals.Subtotal*rule.RateBP, 10000) + rule.Amount
+		if amount > totals.Subtotal-totals.Discount {
+			amount = totals.Subtotal - totals.Discount
+		}
+		if amount <= 0 {
+			continue
+		}
+		totals.Discount += amount
+		totals.Discounts = append(totals.Discounts, Discount{Name: rule.Name, Amount: amount})
+	}
+	base := totals.Subtotal - totals.Discount
+
+	if rules.Tax.Included {
+		totals.Tax = DivRound(base*rules.Tax.RateBP, 10000+rules.Tax.RateBP)
+	} else {
+		totals.Tax = DivRound(base*rules.Tax.RateBP, 10000)
+	}
+	if len(lines) > 0 && (rules.Shipping.FreeFrom == 0 || base < rules.Shipping.FreeFrom) {
+		totals.Shipping = rules.Shipping.Fee
+	}
+
+	totals.GrandTotal = base + totals.Shipping
+	if !rules.Tax.Included {
+		totals.GrandTotal += totals.Tax
+	}
+	return lineTotals, totals, nil
+}
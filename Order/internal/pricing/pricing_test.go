@@ -0,0 +1,211 @@
+package pricing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDivRound(t *testing.T) {
+	tests := []struct {
+		num, den, want int64
+	}{
+		{num: 10, den: 5, want: 2},
+		{num: 4, den: 3, want: 1},
+		{num: 5, den: 3, want: 2},
+		{num: 5, den: 2, want: 3}, // половина - от нуля
+		{num: -5, den: 2, want: -3},
+		{num: -4, den: 3, want: -1},
+		{num: 0, den: 7, want: 0},
+	}
+	for _, tt := range tests {
+		if got := DivRound(tt.num, tt.den); got != tt.want {
+			t.Errorf("DivRound(%d, %d) = %d, want %d", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+// Примеры расчёта, по которым можно сверить итоги заказа
+func TestCalculate(t *testing.T) {
+	vatIncluded := TaxRule{Name: "VAT", RateBP: 2000, Included: true}
+	vatAdded := TaxRule{Name: "VAT", RateBP: 2000}
+	tests := []struct {
+		name      string
+		lines     []Line
+		rules     Rules
+		want      Totals
+		lineTotal []int64
+	}{
+		{
+			// 12500.00 * 5 = 62500.00, НДС 20% внутри: 62500.00 * 20 / 120 = 10416.666 -> 10416.67
+			name:      "default rules, tax included",
+			lines:     []Line{{UnitPrice: 1250000, Currency: "RUB", Quantity: 5}},
+			rules:     DefaultRules,
+			want:      Totals{Currency: "RUB", Subtotal: 6250000, Discounts: []Discount{}, Tax: 1041667, TaxIncluded: true, GrandTotal: 6250000},
+			lineTotal: []int64{6250000},
+		},
+		{
+			// 19.99 * 3 + 5.00 * 2 = 69.97, налог 20% сверху: 13.994 -> 13.99
+			name:      "tax added",
+			lines:     []Line{{UnitPrice: 1999, Currency: "USD", Quantity: 3}, {UnitPrice: 500, Currency: "USD", Quantity: 2}},
+			rules:     Rules{Tax: vatAdded},
+			want:      Totals{Currency: "USD", Subtotal: 6997, Discounts: []Discount{}, Tax: 1399, GrandTotal: 8396},
+			lineTotal: []int64{5997, 1000},
+		},
+		{
+			// 10.05 * 10% = 1.005 -> 1.01: половина округляется вверх
+			name:      "tax added rounds half up",
+			lines:     []Line{{UnitPrice: 1005, Currency: "RUB", Quantity: 1}},
+			rules:     Rules{Tax: TaxRule{RateBP: 1000}},
+			want:      Totals{Currency: "RUB", Subtotal: 1005, Discounts: []Discount{}, Tax: 101, GrandTotal: 1106},
+			lineTotal: []int64{1005},
+		},
+		{
+			// 10.01 * 20 / 120 = 1.668 -> 1.67
+			name:      "tax included rounds to nearest",
+			lines:     []Line{{UnitPrice: 1001, Currency: "RUB", Quantity: 1}},
+			rules:     Rules{Tax: vatIncluded},
+			want:      Totals{Currency: "RUB", Subtotal: 1001, Discounts: []Discount{}, Tax: 167, TaxIncluded: true, GrandTotal: 1001},
+			lineTotal: []int64{1001},
+		},
+		{
+			// Скидки 10% от 50.00 и 3.00 складываются, налог считается после скидок: 42.00 * 20 / 120 = 7.00
+			name:  "discounts before tax",
+			lines: []Line{{UnitPrice: 2500, Currency: "RUB", Quantity: 2}},
+			rules: Rules{
+				Discounts: []DiscountRule{{Name: "10% from 50", MinSubtotal: 5000, RateBP: 1000}, {Name: "promo", Amount: 300}},
+				Tax:       vatIncluded,
+			},
+			want: Totals{
+				Currency: "RUB", Subtotal: 5000, Discount: 800,
+				Discounts: []Discount{{Name: "10% from 50", Amount: 500}, {Name: "promo", Amount: 300}},
+				Tax:       700, TaxIncluded: true, GrandTotal: 4200,
+			},
+			lineTotal: []int64{5000},
+		},
+		{
+			// Сумма строк меньше порога: процентная скидка не применяется, 46.99 * 20 / 120 = 7.8316 -> 7.83
+			name:  "discount below threshold",
+			lines: []Line{{UnitPrice: 4999, Currency: "RUB", Quantity: 1}},
+			rules: Rules{
+				Discounts: []DiscountRule{{Name: "10% from 50", MinSubtotal: 5000, RateBP: 1000}, {Name: "promo", Amount: 300}},
+				Tax:       vatIncluded,
+			},
+			want: Totals{
+				Currency: "RUB", Subtotal: 4999, Discount: 300,
+				Discounts: []Discount{{Name: "promo", Amount: 300}},
+				Tax:       783, TaxIncluded: true, GrandTotal: 4699,
+			},
+			lineTotal: []int64{4999},
+		},
+		{
+			// 3.33% от 10.00 = 0.333 -> 0.33
+			name:  "percent discount rounds",
+			lines: []Line{{UnitPrice: 1000, Currency: "RUB", Quantity: 1}},
+			rules: Rules{Discounts: []DiscountRule{{Name: "3.33%", RateBP: 333}}},
+			want: Totals{
+				Currency: "RUB", Subtotal: 1000, Discount: 33,
+				Discounts:  []Discount{{Name: "3.33%", Amount: 33}},
+				GrandTotal: 967,
+			},
+			lineTotal: []int64{1000},
+		},
+		{
+			// Скидка не больше суммы строк; следующая скидка уже ничего не уменьшает и не попадает в список.
+			// Доставка платная: сумма после скидок 0 меньше порога.
+			name:  "discount capped by subtotal",
+			lines: []Line{{UnitPrice: 600, Currency: "RUB", Quantity: 1}},
+			rules: Rules{
+				Discounts: []DiscountRule{{Name: "gift card", Amount: 1000}, {Name: "promo", Amount: 100}},
+				Tax:       vatAdded,
+				Shipping:  ShippingRule{Fee: 300, FreeFrom: 5000},
+			},
+			want: Totals{
+				Currency: "RUB", Subtotal: 600, Discount: 600,
+				Discounts: []Discount{{Name: "gift card", Amount: 600}},
+				Shipping:  300, GrandTotal: 300,
+			},
+			lineTotal: []int64{600},
+		},
+		{
+			// Доставка не облагается налогом: 100.00 + 20.00 + 5.00
+			name:      "shipping with tax added",
+			lines:     []Line{{UnitPrice: 10000, Currency: "RUB", Quantity: 1}},
+			rules:     Rules{Tax: vatAdded, Shipping: ShippingRule{Fee: 500}},
+			want:      Totals{Currency: "RUB", Subtotal: 10000, Discounts: []Discount{}, Tax: 2000, Shipping: 500, GrandTotal: 12500},
+			lineTotal: []int64{10000},
+		},
+		{
+			name:      "shipping below free threshold",
+			lines:     []Line{{UnitPrice: 499999, Currency: "RUB", Quantity: 1}},
+			rules:     Rules{Shipping: ShippingRule{Fee: 39900, FreeFrom: 500000}},
+			want:      Totals{Currency: "RUB", Subtotal: 499999, Discounts: []Discount{}, Shipping: 39900, GrandTotal: 539899},
+			lineTotal: []int64{499999},
+		},
+		{
+			name:      "free shipping from threshold",
+			lines:     []Line{{UnitPrice: 250000, Currency: "RUB", Quantity: 2}},
+			rules:     Rules{Shipping: ShippingRule{Fee: 39900, FreeFrom: 500000}},
+			want:      Totals{Currency: "RUB", Subtotal: 500000, Discounts: []Discount{}, GrandTotal: 500000},
+			lineTotal: []int64{500000},
+		},
+		{
+			// Порог считается от суммы после скидок: 5100.00 - 5% = 4845.00 < 5000.00
+			name:  "free shipping threshold after discounts",
+			lines: []Line{{UnitPrice: 510000, Currency: "RUB", Quantity: 1}},
+			rules: Rules{
+				Discounts: []DiscountRule{{Name: "5%", RateBP: 500}},
+				Shipping:  ShippingRule{Fee: 39900, FreeFrom: 500000},
+			},
+			want: Totals{
+				Currency: "RUB", Subtotal: 510000, Discount: 25500,
+				Discounts: []Discount{{Name: "5%", Amount: 25500}},
+				Shipping:  39900, GrandTotal: 524400,
+			},
+			lineTotal: []int64{510000},
+		},
+		{
+			name:      "empty order has no shipping",
+			rules:     Rules{Tax: vatAdded, Shipping: ShippingRule{Fee: 500}},
+			want:      Totals{Discounts: []Discount{}},
+			lineTotal: []int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lineTotals, totals, err := Calculate(tt.lines, tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(totals, tt.want) {
+				t.Errorf("totals = %+v\nwant     %+v", totals, tt.want)
+			}
+			if !reflect.DeepEqual(lineTotals, tt.lineTotal) {
+				t.Errorf("line totals = %v, want %v", lineTotals, tt.lineTotal)
+			}
+		})
+	}
+}
+
+func TestCalculateMixedCurrency(t *testing.T) {
+	lines := []Line{{UnitPrice: 100, Currency: "RUB", Quantity: 1}, {UnitPrice: 100, Currency: "USD", Quantity: 1}}
+	if _, _, err := Calculate(lines, DefaultRules); err != ErrMixedCurrency {
+		t.Errorf("err = %v, want ErrMixedCurrency", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultRules.Validate(); err != nil {
+		t.Errorf("default rules: %v", err)
+	}
+	invalid := []Rules{
+		{Discounts: []DiscountRule{{RateBP: 10001}}},
+		{Discounts: []DiscountRule{{Amount: -1}}},
+		{Tax: TaxRule{RateBP: -1}},
+		{Shipping: ShippingRule{Fee: -1}},
+	}
+	for _, rules := range invalid {
+		if err := rules.Validate(); err != ErrInvalidRules {
+			t.Errorf("%+v: err = %v, want ErrInvalidRules", rules, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Правила расчёта итогов заказа. Все суммы - в минимальных единицах валюты,
+// ставки - в базисных пунктах (1% = 100).
+type Rules struct {
+	Discounts []DiscountRule `json:"discounts"`
+	Tax       TaxRule        `json:"tax"`
+	Shipping  ShippingRule   `json:"shipping"`
+}
+
+// Скидка на заказ, когда сумма строк не меньше MinSubtotal.
+// Процентная скидка (RateBP) и фиксированная (Amount) складываются.
+type DiscountRule struct {
+	Name        string `json:"name"`
+	MinSubtotal int64  `json:"min_subtotal"`
+	RateBP      int64  `json:"rate_bp"`
+	Amount      int64  `json:"amount"`
+}
+
+// Налог на сумму строк после скидок. Included - налог уже входит в цены (как НДС в рознице),
+// тогда он только выделяется и к итогу не прибавляется.
+type TaxRule struct {
+	Name     string `json:"name"`
+	RateBP   int64  `json:"rate_bp"`
+	Included bool   `json:"included"`
+}
+
+// Доставка: фиксированная стоимость, бесплатно при сумме после скидок не меньше FreeFrom (0 - никогда)
+type ShippingRule struct {
+	Fee      int64 `json:"fee"`
+	FreeFrom int64 `json:"free_from"`
+}
+
+// Правила по умолчанию: НДС 20% включён в цены, без скидок и платы за доставку
+var DefaultRules = Rules{
+	Discounts: []DiscountRule{},
+	Tax:       TaxRule{Name: "VAT", RateBP: 2000, Included: true},
+	Shipping:  ShippingRule{},
+}
+
+var ErrInvalidRules = errors.New("pricing rules must not contain negative amounts or rates")
+
+// Загрузка правил из JSON файла, пустой путь - правила по умолчанию
+func Load(path string) (Rules, error) {
+	if path == "" {
+		return DefaultRules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Rules{}, err
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return Rules{}, err
+	}
+	if err := rules.Validate(); err != nil {
+		return Rules{}, err
+	}
+	return rules, nil
+}
+
+func (r Rules) Validate() error {
+	for _, d := range r.Discounts {
+		if d.MinSubtotal < 0 || d.RateBP < 0 || d.RateBP > 10000 || d.Amount < 0 {
+			return ErrInvalidRules
+		}
+	}
+	if r.Tax.RateBP < 0 || r.Shipping.Fee < 0 || r.Shipping.FreeFrom < 0 {
+		return ErrInvalidRules
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"testOrder/internal/invoice"
+	"testOrder/internal/lifecycle"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	InvoiceCollection  = "invoices" // Счета, код документа - код заказа
+	CountersCollection = "counters" // Последовательности номеров
+	InvoiceCounter     = "invoice"
+)
+
+// Номер счёта выдаётся не дольше этого времени, потом его может выдать другой запрос
+const InvoiceLock = time.Minute
+
+var invoiceConfig = invoice.DefaultConfig
+
+var (
+	ErrNotInvoiceable    = errors.New("invoice can only be issued for a placed order that is not cancelled")
+	ErrInvoiceInProgress = errors.New("invoice for this order is being issued")
+)
+
+// Документ счёта: пока номер выдаётся, Invoice пуст, а LockedUntil ограничивает выдачу
+type InvoiceRecord struct {
+	ID          string           `bson:"_id"` //Код заказа
+	Invoice     *invoice.Invoice `bson:"invoice,omitempty"`
+	LockedUntil time.Time        `bson:"locked_until"`
+}
+
+// Состояния заказа, по которым выставляется счёт
+func Invoiceable(s lifecycle.Status) bool {
+	switch s {
+	case lifecycle.Created, lifecycle.Paid, lifecycle.Packed, lifecycle.Shipped, lifecycle.Delivered:
+		return true
+	}
+	return false
+}
+
+// Счёт по заказу: выставленный ранее или новый со следующим номером. Номер выдаётся один
+// раз и сохраняется вместе со снимком заказа, поэтому повторный запрос, изменение или
+// удаление заказа не меняют счёт, а номер не может достаться другому заказу.
+func OrderInvoice(ctx context.Context, id, caller string) (invoice.Invoice, error) {
+	collection := client.Database(DataBaseName).Collection(InvoiceCollection)
+	for attempt := 0; attempt < 20; attempt++ {
+		now := time.Now().UTC()
+		var rec InvoiceRecord
+		err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&rec)
+		switch {
+		case err == nil && rec.Invoice != nil:
+			if caller != "" && rec.Invoice.CustomerID != caller {
+				return invoice.Invoice{}, mongo.ErrNoDocuments
+			}
+			return *rec.Invoice, nil
+		case err == nil && rec.LockedUntil.After(now):
+			// Номер выдаёт параллельный запрос
+			time.Sleep(100 * time.Millisecond)
+			continue
+		case err != nil && err != mongo.ErrNoDocuments:
+			return invoice.Invoice{}, err
+		}
+
+		order, err := FindId(id)
+		if err == nil && caller != "" && order.CustomerID != caller {
+			err = mongo.ErrNoDocuments
+		}
+		if err != nil {
+			return invoice.Invoice{}, err
+		}
+		if !Invoiceable(order.Status) {
+			return invoice.Invoice{}, ErrNotInvoiceable
+		}
+		// Захват выдачи номера: новый документ или документ прерванной выдачи
+		locked := now.Add(InvoiceLock)
+		if rec.ID == "" {
+			_, err = collection.InsertOne(ctx, InvoiceRecord{ID: id, LockedUntil: locked})
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+		} else {
+			var res *mongo.UpdateResult
+			res, err = collection.UpdateOne(ctx,
+				bson.M{"_id": id, "invoice": bson.M{"$exists": false}, "locked_until": rec.LockedUntil},
+				bson.M{"$set": bson.M{"locked_until": locked}})
+			if err == nil && res.MatchedCount == 0 {
+				continue
+			}
+		}
+		if err != nil {
+			return invoice.Invoice{}, err
+		}
+		return issueInvoice(ctx, order, now)
+	}
+	return invoice.Invoice{}, ErrInvoiceInProgress
+}
+
+// Выдача номера и сохранение счёта. Счёт сохраняется, только если его ещё нет, поэтому
+// выданный клиенту счёт не перезаписывается. Номер пропускается (но не используется
+// повторно), если сервис упал между этими шагами или счёт успел сохранить другой запрос.
+func issueInvoice(ctx context.Context, order Order, now time.Time) (invoice.Invoice, error) {
+	seq, err := nextInvoiceNumber(ctx)
+	if err != nil {
+		return invoice.Invoice{}, err
+	}
+	inv := invoice.Invoice{
+		Seq:        seq,
+		Number:     invoice.FormatNumber(invoiceConfig.Prefix, seq),
+		IssuedAt:   now.Truncate(time.Millisecond),
+		OrderID:    order.ID,
+		OrderDate:  order.Data,
+		CustomerID: order.CustomerID,
+		Seller:     invoiceConfig.Seller,
+		Lines:      make([]invoice.Line, len(order.Product)),
+		Totals:     order.Totals,
+	}
+	for i, p := range order.Product {
+		inv.Lines[i] = invoice.Line{ItemID: p.ItemID, Name: p.Name, Quantity: p.Quantity, UnitPrice: p.Price.Amount, Total: p.Total.Amount}
+	}
+	collection := client.Database(DataBaseName).Collection(InvoiceCollection)
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": order.ID, "invoice": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"invoice": inv}})
+	if err != nil {
+		return invoice.Invoice{}, err
+	}
+	if res.MatchedCount == 0 {
+		// Выдача заняла больше InvoiceLock, и параллельный запрос уже сохранил счёт:
+		// клиенту возвращается он, номер этой выдачи пропускается
+		var rec InvoiceRecord
+		if err := collection.FindOne(ctx, bson.M{"_id": order.ID}).Decode(&rec); err != nil {
+			return invoice.Invoice{}, err
+		}
+		if rec.Invoice == nil {
+			return invoice.Invoice{}, ErrInvoiceInProgress
+		}
+		log.Printf("invoice %s for order %s is not saved: %s was issued concurrently\n", inv.Number, order.ID, rec.Invoice.Number)
+		return *rec.Invoice, nil
+	}
+	log.Printf("invoice %s issued for order %s\n", inv.Number, order.ID)
+	return inv, nil
+}
+
+// Следующий номер счёта
+func nextInvoiceNumber(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := client.Database(DataBaseName).Collection(CountersCollection).FindOneAndUpdate(ctx,
+		bson.M{"_id": InvoiceCounter}, bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
+	return counter.Seq, err
+}
+
+// Получить счёт по заказу: HTML по умолчанию, PDF при ?format=pdf или Accept: application/pdf
+func GetInvoice(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+		format = "pdf"
+	}
+	if format != "" && format != "pdf" && format != "html" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", "format must be html or pdf")
+		return
+	}
+	inv, err := OrderInvoice(r.Context(), mux.Vars(r)["id"], Caller(r))
+	if err != nil {
+		switch err {
+		case mongo.ErrNoDocuments:
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		case ErrNotInvoiceable:
+			ErrorResponse(w, http.StatusConflict, "Order cannot be invoiced", err.Error())
+		case ErrInvoiceInProgress:
+			w.Header().Set("Retry-After", "1")
+			ErrorResponse(w, http.StatusConflict, "Invoice in progress", "The invoice is still being issued, retry later.")
+		default:
+			InternalError(w, err)
+		}
+		return
+	}
+	var body bytes.Buffer
+	if format == "pdf" {
+		err = invoice.PDF(&body, inv, invoiceConfig.Font)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `inline; filename="`+inv.Number+`.pdf"`)
+	} else {
+		err = invoice.HTML(&body, inv)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		InternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
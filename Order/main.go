@@ -3,19 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"testOrder/internal/invoice"
+	"testOrder/internal/lifecycle"
+	"testOrder/internal/pricing"
+
+	"github.com/ALbikov-R/4ServicesGRPC/events"
 	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+	"github.com/ALbikov-R/4ServicesGRPC/money"
 	"github.com/IBM/sarama"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc"
@@ -24,31 +31,37 @@ import (
 )
 
 type Order struct {
-	ID      string     `json:"id" bson:"_id"` //Код заказа
-	Data    string     `json:"data"`          //Дата Заказа
-	Product []Products `json:"product"`       //Продукты
+	ID         string           `json:"id" bson:"_id"`                                  //Код заказа
+	Data       time.Time        `json:"data"`                                           //Дата Заказа
+	CustomerID string           `json:"customer_id" bson:"customer_id"`                 //Покупатель
+	Status     lifecycle.Status `json:"status"`                                         //Состояние заказа
+	History    []StatusChange   `json:"history"`                                        //Переходы между состояниями
+	Product    []Products       `json:"product"`                                        //Продукты
+	Totals     pricing.Totals   `json:"totals"`                                         //Итоги заказа
+	Shipments  []Shipment       `json:"shipments,omitempty" bson:"shipments,omitempty"` //Отправления
+	Payments   []PaymentAttempt `json:"payments,omitempty" bson:"payments,omitempty"`   //Попытки оплаты
+
+	ReservationID string `json:"reservation_id,omitempty" bson:"reservation_id,omitempty"` //Резерв в Inventory
 }
 type Products struct {
-	ItemID   string `json:"item_id"`  //Код продукта
-	Name     string `json:"name"`     //Наименование
-	Quantity int    `json:"quantity"` //Количество
-	Price    int    `json:"price"`    //Стоимость
-}
-type InvProd struct {
-	Quantity int    `json:"quantity"` //Количество
-	Price    string `json:"price"`    //Стоимость
+	ItemID   string      `json:"item_id"`  //Код продукта
+	Name     string      `json:"name"`     //Наименование
+	Quantity int         `json:"quantity"` //Количество
+	Price    money.Money `json:"price"`    //Стоимость единицы
+	Total    money.Money `json:"total"`    //Стоимость строки
 }
 type Producer struct {
 	prod    sarama.AsyncProducer
 	signals chan os.Signal
+	spool   *Spool       //Сообщения, которые не удалось отправить
+	mu      sync.RWMutex //Отправка не пересекается с закрытием
+	closed  bool
+	done    chan struct{} //Закрывается, когда прочитаны результаты всех отправок
 }
 type Cart struct {
-	Products []Products `json:"product"`
-}
-type Message struct {
-	Typemes     string `json:"typemes"`
-	Description string `json:"description"`
-	Date        string `json:"data"`
+	Products      []Products `json:"product"`
+	ReservationID string     `json:"reservation_id"` //Резерв, созданный Product при оформлении корзины
+	CustomerID    string     `json:"customer_id"`    //Владелец корзины
 }
 
 type Congrpc struct {
@@ -76,18 +89,53 @@ func main() {
 		fmt.Println("Подключение к MongoDB успешно!")
 		defer client.Disconnect(context.Background())
 	}
+	if err = events.Verify(); err != nil {
+		log.Fatal(err)
+	}
+	if priceRules, err = pricing.Load(os.Getenv("PRICING_CONFIG")); err != nil {
+		log.Fatal(err)
+	}
+	if invoiceConfig, err = invoice.Load(os.Getenv("INVOICE_CONFIG")); err != nil {
+		log.Fatal(err)
+	}
+	if paymentProvider, err = NewPaymentProvider(os.Getenv("PAYMENT_PROVIDER")); err != nil {
+		log.Fatal(err)
+	}
+	if err = MigrateUP(); err != nil {
+		log.Fatal(err)
+	}
 	if err = CreateProducer(); err != nil {
 		log.Fatal(err)
 	}
 	ConnectGrpc()
 	defer CloseProducer()
+	go ResumeSagas(SagaInterval)
 	router := mux.NewRouter()
-	router.HandleFunc("/orders", GetOrders).Methods("GET")           //Получить информацию о всех заказах
-	router.HandleFunc("/orders/{id}", GetOrder).Methods("GET")       //Получить информацию об заказе с номером ID
-	router.HandleFunc("/orders", CreateOrder).Methods("POST")        //Создать заказ
-	router.HandleFunc("/orders/{id}", KafkaMethod).Methods("POST")   //Создать заказ
-	router.HandleFunc("/orders/{id}", UpdateOrder).Methods("PUT")    //Изменить в заказе ID
-	router.HandleFunc("/orders/{id}", DeleteOrder).Methods("DELETE") //Удалить заказ ID
+	router.HandleFunc("/orders", GetOrders).Methods("GET")                                                                      //Получить страницу заказов по фильтрам
+	router.HandleFunc("/orders/{id}", GetOrder).Methods("GET")                                                                  //Получить информацию об заказе с номером ID
+	router.HandleFunc("/orders", Idempotent(callerScope("POST /orders"), CreateOrder)).Methods("POST")                          //Создать заказ
+	router.HandleFunc("/orders/{id}", KafkaMethod).Methods("POST")                                                              //Создать заказ
+	router.HandleFunc("/orders/{id}", UpdateOrder).Methods("PUT")                                                               //Изменить в заказе ID
+	router.HandleFunc("/orders/{id}", DeleteOrder).Methods("DELETE")                                                            //Удалить заказ ID
+	router.HandleFunc("/orders/{id}/transitions", PostTransition).Methods("POST")                                               //Перевести заказ в другое состояние
+	router.HandleFunc("/orders/{id}/history", GetOrderHistory).Methods("GET")                                                   //История изменений заказа
+	router.HandleFunc("/orders/{id}/invoice", GetInvoice).Methods("GET")                                                        //Счёт по заказу в HTML или PDF
+	router.HandleFunc("/orders/{id}/returns", Idempotent(callerScope("POST /orders/{id}/returns"), PostReturn)).Methods("POST") //Запрос на возврат
+	router.HandleFunc("/orders/{id}/shipments", PostShipment).Methods("POST")                                                   //Создать отправление
+	router.HandleFunc("/orders/{id}/shipments", GetShipments).Methods("GET")                                                    //Отправления заказа
+	router.HandleFunc("/orders/{id}/shipments/{shipment}", PatchShipment).Methods("PATCH")                                      //Изменить отправление
+	router.HandleFunc("/orders/{id}/returns", GetOrderReturns).Methods("GET")                                                   //Возвраты заказа
+	router.HandleFunc("/returns/{id}", GetReturn).Methods("GET")                                                                //Получить возврат
+	router.HandleFunc("/returns/{id}/{action:approve|reject|receive|refund}", PostReturnAction).Methods("POST")                 //Обработать возврат
+	router.HandleFunc("/customers/{id}/orders", GetCustomerOrders).Methods("GET")                                               //Заказы покупателя
+	router.HandleFunc("/reports/sales", GetSalesReport).Methods("GET")                                                          //Отчёт о продажах
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")                                                               //Метрики
+
+	// Оплата
+	router.HandleFunc("/orders/{id}/payments", GetPayments).Methods("GET")                                                                                      //Попытки оплаты заказа
+	router.HandleFunc("/orders/{id}/payments/authorize", Idempotent(callerScope("POST /orders/{id}/payments/authorize"), PostAuthorizePayment)).Methods("POST") //Оплатить заказ
+	router.HandleFunc("/orders/{id}/payments/{action:capture|void|refund}", PostPaymentAction).Methods("POST")                                                  //Списать, отменить или вернуть оплату
+	router.HandleFunc("/payments/webhook", PostPaymentWebhook).Methods("POST")                                                                                  //Результат оплаты от провайдера
 
 	fmt.Println("Сервер слушате порт " + os.Getenv("PORT_router"))
 	http.ListenAndServe(os.Getenv("PORT_router"), router)
@@ -108,19 +156,25 @@ func ConnectGrpc() {
 	connect.ctx, connect.cancel = context.WithTimeout(context.Background(), time.Second)
 }
 func CloseProducer() {
-	if err := producer.prod.Close(); err != nil {
-		log.Fatal(err)
-	}
+	producer.Close()
 }
 func CreateProducer() error {
+	spool, err := OpenSpool(SpoolDir())
+	if err != nil {
+		return err
+	}
 	proder := connectProd()
 	producer.prod = proder
+	producer.spool = spool
+	producer.done = make(chan struct{})
 	producer.signals = make(chan os.Signal, 1)
 	signal.Notify(producer.signals, os.Interrupt)
+	go producer.track()
+	go producer.ResendSpooled(SpoolInterval)
 	return nil
 }
 func connectProd() sarama.AsyncProducer {
-	config := sarama.NewConfig()
+	config := ProducerConfig()
 	for {
 		proder, err := sarama.NewAsyncProducer([]string{os.Getenv("KAFKA_PORT")}, config)
 		if err != nil {
@@ -130,72 +184,45 @@ func connectProd() sarama.AsyncProducer {
 		}
 	}
 }
-func ReplaceID(id string, prods []Products) error {
+
+// Замена строк заказа с пересчётом итогов, caller - покупатель, которому принадлежит заказ.
+// Возвращает заказ до и после изменения.
+func ReplaceID(id, caller string, prods []Products) (Order, Order, error) {
+	lines, err := mergeLines(prods)
+	if err != nil {
+		return Order{}, Order{}, err
+	}
 	collection := client.Database(DataBaseName).Collection(CollectionName)
-	filter := bson.M{"_id": id}
+	filter := ownedFilter(id, caller)
 	var order Order
-	err := collection.FindOne(context.TODO(), filter).Decode(&order)
+	err = collection.FindOne(context.TODO(), filter).Decode(&order)
 	if err != nil {
-		return err //Нет такого элемента в БД
+		return Order{}, Order{}, err //Нет такого элемента в БД
 	}
-	order.Product = append(prods)
-	_, err = collection.ReplaceOne(context.TODO(), filter, order)
-	if err != nil {
-		return err
+	if paymentStarted(order) {
+		return Order{}, Order{}, ErrPaymentStarted
 	}
-	return nil
-}
-
-// Вставка данных в БД
-func InsertData(prods []Products) (Order, error) {
-	collection := client.Database(DataBaseName).Collection(CollectionName)
-	Json, _ := primitive.NewObjectID().MarshalJSON()
-	var data Order
-	data.ID = string(Json[1 : len(Json)-1])
-	data.Data = time.Now().Format("02-01-2006 15:04:05")
-	for i := 0; i < len(prods); i++ {
-		r, err := connect.client.GetProduct(context.Background(), &pb.IdRequest{Id: prods[i].ItemID})
-		if err != nil {
-			log.Fatal(err)
-		}
-		var bprod InvProd = InvProd{
-			Quantity: int(r.GetProd().GetQuantity()),
-			Price:    r.GetProd().GetPrice(),
-		}
-
-		str := strings.Replace(bprod.Price, " руб.", "", -1)
-		f, _ := strconv.Atoi(str)
-		prods[i].Price = f
-		prods[i].Quantity = bprod.Quantity
+	before := order
+	before.Product = append([]Products(nil), order.Product...)
+	if err := PriceLines(context.TODO(), order.Product, lines); err != nil {
+		return Order{}, Order{}, err
 	}
-	data.Product = append(data.Product, prods...)
-	_, err := collection.InsertOne(context.TODO(), data)
-	if err != nil {
-		return Order{}, err
+	order.Product = lines
+	if err := ApplyTotals(&order); err != nil {
+		return Order{}, Order{}, err
 	}
-	return data, nil
-}
-
-// Нахождение всех элементов в БД
-func FindAll() ([]Order, error) {
-	collection := client.Database(DataBaseName).Collection(CollectionName)
-	cur, err := collection.Find(context.TODO(), bson.M{})
+	// Меняются только строки и итоги, чтобы не откатить изменения, сделанные после чтения
+	// заказа (состояние, отправления). Оплата могла начаться после чтения заказа.
+	filter["payments."+strconv.Itoa(len(order.Payments))] = bson.M{"$exists": false}
+	res, err := collection.UpdateOne(context.TODO(), filter,
+		bson.M{"$set": bson.M{"product": order.Product, "totals": order.Totals}})
 	if err != nil {
-		return nil, err
-	}
-	defer cur.Close(context.TODO())
-	var orders []Order
-	for cur.Next(context.TODO()) {
-		var order Order
-		if err := cur.Decode(&order); err != nil {
-			return nil, err
-		}
-		orders = append(orders, order)
+		return Order{}, Order{}, err
 	}
-	if err := cur.Err(); err != nil {
-		return nil, err
+	if res.MatchedCount == 0 {
+		return Order{}, Order{}, ErrPaymentStarted
 	}
-	return orders, nil
+	return before, order, nil
 }
 
 // Нахождение по одному элементу
@@ -210,15 +237,29 @@ func FindId(id string) (Order, error) {
 	return order, nil
 }
 
-// Нахождение по одному элементу
-func DeleteId(id string) (int64, error) {
+// Удаление заказа, caller - покупатель, которому принадлежит заказ. Неотправленные предметы
+// сначала возвращаются на склад, поэтому при недоступности Inventory заказ остаётся
+// и удаление можно повторить.
+func DeleteId(id, caller string) (Order, error) {
 	colletion := client.Database(DataBaseName).Collection(CollectionName)
-	filter := bson.M{"_id": id}
+	filter := ownedFilter(id, caller)
+	var order Order
+	err := colletion.FindOne(context.TODO(), filter).Decode(&order)
+	if err != nil {
+		return Order{}, err //Нет такого элемента в БД
+	}
+	if err := RestockOrder(context.TODO(), order); err != nil {
+		return order, err
+	}
+	filter["status"] = order.Status
 	res, err := colletion.DeleteOne(context.TODO(), filter)
 	if err != nil {
-		return 0, err
+		return order, err
+	}
+	if res.DeletedCount == 0 {
+		return order, ErrStatusChanged
 	}
-	return res.DeletedCount, nil
+	return order, nil
 }
 func ConnectMongoDB() error { //Соединение с MongoDB
 	clientOptions := options.Client().ApplyURI(os.Getenv("MONGODB_URI"))
@@ -236,130 +277,195 @@ func ConnectMongoDB() error { //Соединение с MongoDB
 	return nil
 }
 
-// Получить информацию о всех заказах
+// Получить страницу заказов по фильтрам
 func GetOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := FindAll()
+	query, err := ParseOrderQuery(r)
 	if err != nil {
-		log.Fatal(err)
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	// Покупатель видит только свои заказы
+	query.CustomerID = Caller(r)
+	page, err := FindOrders(query)
+	if err != nil {
+		InternalError(w, err)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
 }
 
 // Получить информацию об заказе с номером ID
 func GetOrder(w http.ResponseWriter, r *http.Request) {
 	order, err := FindId(mux.Vars(r)["id"])
+	// Чужой заказ для покупателя не существует
+	if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+		err = mongo.ErrNoDocuments
+	}
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Resource not found",
-				"message": "The resource with the specified ID does not exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
-			return
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
 		} else {
-			log.Fatal(err)
+			InternalError(w, err)
 		}
+		return
 	}
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(order)
 }
 
 // Создать заказ
 func CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var cart Cart
-	_ = json.NewDecoder(r.Body).Decode(&cart)
-	order, err := InsertData(cart.Products)
+	if err := json.NewDecoder(r.Body).Decode(&cart); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must be a JSON cart.")
+		return
+	}
+	customer, err := OrderCustomer(r, cart)
 	if err != nil {
-		log.Fatal(err)
+		if err == ErrCustomerMismatch {
+			ErrorResponse(w, http.StatusForbidden, "Access denied", err.Error())
+		} else {
+			ErrorResponse(w, http.StatusBadRequest, "Customer is not specified", "The "+CustomerHeader+" header or customer_id of the cart is required.")
+		}
+		return
+	}
+	cart.CustomerID = customer
+	// Сага не зависит от контекста запроса: разрыв соединения не должен прерывать компенсацию
+	order, err := placement.Place(context.Background(), cart, Actor(r), CorrelationID(w, r))
+	if err != nil {
+		var stockErr *StockError
+		var invErr *InventoryError
+		var pendErr *PendingError
+		switch {
+		case errors.As(err, &pendErr):
+			log.Println(err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(order)
+		case err == ErrInvalidLines || err == pricing.ErrMixedCurrency:
+			ErrorResponse(w, http.StatusBadRequest, "Invalid order lines", err.Error())
+		case err == ErrReservationUsed:
+			ErrorResponse(w, http.StatusConflict, "Reservation already used", err.Error())
+		case errors.As(err, &stockErr):
+			StockErrorResponse(w, stockErr)
+		case errors.As(err, &invErr):
+			log.Println(err)
+			ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The stock could not be checked, the order is not created.")
+		default:
+			InternalError(w, err)
+		}
+		return
 	}
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
 func KafkaMethod(w http.ResponseWriter, r *http.Request) {
-	order, err := FindId(mux.Vars(r)["id"])
-	time := time.Now().Format("02-01-2006 15:04:05")
-	var message *Message = &Message{Date: time}
+	id := mux.Vars(r)["id"]
+	correlationID := CorrelationID(w, r)
+	order, err := FindId(id)
+	// Чужой заказ для покупателя не существует, уведомление его владельцу не отправляется
+	if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		return
+	}
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Resource not found",
-				"message": "The resource with the specified ID does not exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
-			message.Description = "Order " + string(mux.Vars(r)["id"]) + " does not exist"
-			message.Typemes = "Order not found"
-			SendMessage(message)
-			return
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+			SendNotification(id, "Order not found", "Order "+id+" does not exist", correlationID)
 		} else {
-			log.Fatal(err)
+			InternalError(w, err)
 		}
+		return
 	}
-	message.Description = "Order " + string(mux.Vars(r)["id"]) + " exist"
-	message.Typemes = "Order found"
-	SendMessage(message)
-	w.WriteHeader(http.StatusOK)
+	SendNotification(id, "Order found", "Order "+id+" exist", correlationID)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(order)
 }
-func SendMessage(message *Message) error {
-	jsonMessage, err := json.Marshal(message)
+
+// Уведомление о заказе
+func SendNotification(orderID, subject, description, correlationID string) {
+	err := SendEvent(events.TypeNotification, orderID, correlationID, &events.Notification{
+		OrderId:     orderID,
+		Subject:     subject,
+		Description: description,
+	})
 	if err != nil {
-		return err
+		log.Printf("notification of order %s: %v\n", orderID, err)
 	}
-	prodmessage := &sarama.ProducerMessage{
-		Topic: topicName,
-		Value: sarama.ByteEncoder(jsonMessage),
-	}
-	producer.prod.Input() <- prodmessage
-	return nil
 }
 
 // Изменить в заказе ID
 func UpdateOrder(w http.ResponseWriter, r *http.Request) {
 	var prods []Products
-	_ = json.NewDecoder(r.Body).Decode(&prods)
-	err := ReplaceID(mux.Vars(r)["id"], prods)
+	if err := json.NewDecoder(r.Body).Decode(&prods); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must be a JSON array of order lines.")
+		return
+	}
+	before, order, err := ReplaceID(mux.Vars(r)["id"], Caller(r), prods)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Resource not found",
-				"message": "The resource with the specified ID does not exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
-			return
-		} else {
-			log.Fatal(err)
+		var invErr *InventoryError
+		switch {
+		case err == mongo.ErrNoDocuments:
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		case err == ErrInvalidLines || err == pricing.ErrMixedCurrency:
+			ErrorResponse(w, http.StatusBadRequest, "Invalid order lines", err.Error())
+		case err == ErrPaymentStarted:
+			ErrorResponse(w, http.StatusConflict, "Order is being paid", "The lines of an order cannot be changed after the payment is authorized.")
+		case errors.As(err, &invErr):
+			log.Println(err)
+			ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The prices could not be loaded, the order is not changed.")
+		default:
+			InternalError(w, err)
 		}
+		return
 	}
+	correlationID := CorrelationID(w, r)
+	RecordAudit(AuditUpdate, &before, &order, Actor(r), r.Header.Get(ReasonHeader), correlationID)
+	PublishOrderEvent(EventOrderUpdated, order, "", correlationID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // Удалить заказ ID
 func DeleteOrder(w http.ResponseWriter, r *http.Request) {
-	count, err := DeleteId(mux.Vars(r)["id"])
+	order, err := DeleteId(mux.Vars(r)["id"], Caller(r))
 	if err != nil {
-		log.Fatal(err)
-	}
-	if count == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		errorResponse := map[string]string{
-			"error":   "Resource not found",
-			"message": "The resource with the specified ID does not exist.",
+		var invErr *InventoryError
+		switch {
+		case err == mongo.ErrNoDocuments:
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		case err == ErrStatusChanged:
+			ErrorResponse(w, http.StatusConflict, "Order was changed", "The order status was changed by another request, try again.")
+		case errors.As(err, &invErr):
+			log.Println(err)
+			ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The products could not be restocked, the order is not deleted.")
+		default:
+			InternalError(w, err)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(errorResponse)
-		//Добавить return???
-	} else {
-		w.WriteHeader(http.StatusNoContent)
+		return
 	}
+	correlationID := CorrelationID(w, r)
+	RecordAudit(AuditDelete, &order, nil, Actor(r), r.Header.Get(ReasonHeader), correlationID)
+	PublishOrderEvent(EventOrderDeleted, order, "", correlationID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Ответ с ошибкой в формате JSON
+func ErrorResponse(w http.ResponseWriter, status int, errorText, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   errorText,
+		"message": message,
+	})
+}
+
+// Внутренняя ошибка: пишется в лог, клиенту возвращается 500
+func InternalError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	ErrorResponse(w, http.StatusInternalServerError, "Internal server error", "The request could not be processed.")
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"github.com/ALbikov-R/4ServicesGRPC/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Коллекция с номерами применённых миграций
+const MigrationsCollection = "migrations"
+
+// Миграция документов MongoDB
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// Миграции применяются по возрастанию версии, каждая один раз
+var migrations = []Migration{
+	{Version: 1, Name: "money", Up: migrateMoney},
+	{Version: 2, Name: "status", Up: migrateStatus},
+	{Version: 3, Name: "totals", Up: migrateTotals},
+	{Version: 4, Name: "sagas", Up: migrateSagas},
+	{Version: 5, Name: "idempotency", Up: migrateIdempotency},
+	{Version: 6, Name: "data datetime", Up: migrateDataDatetime},
+	{Version: 7, Name: "order indexes", Up: migrateOrderIndexes},
+	{Version: 8, Name: "customer index", Up: migrateCustomerIndex},
+	{Version: 9, Name: "invoice numbers", Up: migrateInvoiceNumbers},
+	{Version: 10, Name: "returns", Up: migrateReturns},
+	{Version: 11, Name: "order history", Up: migrateOrderHistory},
+	{Version: 12, Name: "payments", Up: migratePayments},
+	{Version: 13, Name: "reservation index", Up: migrateReservationIndex},
+}
+
+func MigrateUP() error {
+	ctx := context.Background()
+	db := client.Database(DataBaseName)
+	applied := db.Collection(MigrationsCollection)
+	for _, m := range migrations {
+		err := applied.FindOne(ctx, bson.M{"_id": m.Version}).Err()
+		if err == nil {
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err := m.Up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		_, err = applied.InsertOne(ctx, bson.M{"_id": m.Version, "name": m.Name, "applied_at": time.Now()})
+		if err != nil {
+			return err
+		}
+		log.Printf("migration %d %s applied\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+// Цена продукта в заказе: число рублей -> сумма в копейках и код валюты
+func migrateMoney(ctx context.Context, db *mongo.Database) error {
+	toMoney := bson.M{"$cond": bson.M{
+		"if": bson.M{"$isNumber": "$$p.price"},
+		"then": bson.M{"$mergeObjects": []interface{}{"$$p", bson.M{"price": bson.M{
+			"amount":   bson.M{"$multiply": []interface{}{bson.M{"$toLong": "$$p.price"}, 100}},
+			"currency": money.DefaultCurrency,
+		}}}},
+		"else": "$$p",
+	}}
+	_, err := db.Collection(CollectionName).UpdateMany(ctx,
+		bson.M{"product.price": bson.M{"$type": "number"}},
+		[]bson.M{{"$set": bson.M{"product": bson.M{"$map": bson.M{"input": "$product", "as": "p", "in": toMoney}}}}})
+	return err
+}
+
+// Заказы без состояния считаются созданными, время создания берётся из даты заказа
+func migrateStatus(ctx context.Context, db *mongo.Database) error {
+	created := bson.M{"$dateFromString": bson.M{
+		"dateString": "$data",
+		"format":     "%d-%m-%Y %H:%M:%S",
+		"onError":    "$$NOW",
+		"onNull":     "$$NOW",
+	}}
+	_, err := db.Collection(CollectionName).UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		[]bson.M{{"$set": bson.M{
+			"status":  lifecycle.Created,
+			"history": []bson.M{{"to": lifecycle.Created, "at": created}},
+		}}})
+	return err
+}
+
+// Итоги для заказов, созданных до их появления
+func migrateTotals(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(CollectionName)
+	cur, err := collection.Find(ctx, bson.M{"totals": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		// Только нужные поля: остальные поля старых заказов могут не совпадать по типу с Order
+		var doc struct {
+			ID      string `bson:"_id"`
+			Product []Products
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		order := Order{ID: doc.ID, Product: doc.Product}
+		if err := ApplyTotals(&order); err != nil {
+			return fmt.Errorf("order %s: %w", order.ID, err)
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": order.ID},
+			bson.M{"$set": bson.M{"product": order.Product, "totals": order.Totals}})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Индекс для поиска незавершённых саг
+func migrateSagas(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(SagaCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "state", Value: 1}, {Key: "updated_at", Value: 1}},
+	})
+	return err
+}
+
+// TTL индекс: MongoDB сама удаляет ключи идемпотентности после expires_at
+func migrateIdempotency(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(IdempotencyCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    primitive.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Дата заказа: строка "02-01-2006 15:04:05" -> дата BSON. Строки записывались по времени
+// контейнера (UTC); нераспознанная дата берётся из первого перехода в history.
+func migrateDataDatetime(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(CollectionName).UpdateMany(ctx,
+		bson.M{"data": bson.M{"$type": "string"}},
+		[]bson.M{{"$set": bson.M{"data": bson.M{"$dateFromString": bson.M{
+			"dateString": "$data",
+			"format":     "%d-%m-%Y %H:%M:%S",
+			"onError":    bson.M{"$ifNull": []interface{}{bson.M{"$first": "$history.at"}, "$$NOW"}},
+		}}}}})
+	return err
+}
+
+// Индексы для GET /orders: сортировка по дате и коду, фильтры по состоянию и продукту
+func migrateOrderIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(CollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: primitive.D{{Key: "data", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: primitive.D{{Key: "status", Value: 1}, {Key: "data", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: primitive.D{{Key: "product.itemid", Value: 1}, {Key: "data", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	return err
+}
+
+// Индекс для заказов покупателя. Заказы, созданные до появления покупателя, остаются без него
+// и доступны только внутренним вызовам.
+func migrateCustomerIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(CollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "customer_id", Value: 1}, {Key: "data", Value: -1}, {Key: "_id", Value: -1}},
+	})
+	return err
+}
+
+// Номер счёта не может достаться двум заказам
+func migrateInvoiceNumbers(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(InvoiceCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "invoice.seq", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(primitive.D{{Key: "invoice.seq", Value: primitive.D{{Key: "$exists", Value: true}}}}),
+	})
+	return err
+}
+
+// Возвраты выбираются по заказу
+func migrateReturns(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(ReturnsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "order_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+// История выбирается по заказу в порядке записи
+func migrateOrderHistory(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(HistoryCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "order_id", Value: 1}, {Key: "at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+// Webhook провайдера находит заказ по коду операции
+func migratePayments(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(CollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "payments.reference", Value: 1}},
+	})
+	return err
+}
+
+// Один резерв списывается только для одного заказа. Заказы без резерва в индекс не попадают.
+func migrateReservationIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(CollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: primitive.D{{Key: "reservation_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"reservation_id": bson.M{"$type": "string"}}),
+	})
+	return err
+}
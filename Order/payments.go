@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"testOrder/internal/lifecycle"
+	"testOrder/internal/payment"
+
+	"github.com/ALbikov-R/4ServicesGRPC/money"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Платёжный провайдер. Каждый вызов передаёт ключ идемпотентности - код попытки,
+// поэтому повтор прерванной попытки не списывает деньги дважды.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, req payment.AuthorizeRequest) (payment.Result, error)
+	Capture(ctx context.Context, req payment.Request) (payment.Result, error)
+	Refund(ctx context.Context, req payment.Request) (payment.Result, error)
+	Void(ctx context.Context, req payment.Request) (payment.Result, error)
+	// Проверка подписи webhook и разбор события
+	VerifyWebhook(body []byte, header http.Header) (payment.WebhookEvent, error)
+}
+
+var paymentProvider PaymentProvider
+
+// Провайдер по имени из PAYMENT_PROVIDER. Провайдера по умолчанию нет: fake выбирается только
+// явно, иначе сервис без настройки отмечал бы заказы оплаченными без списания денег.
+func NewPaymentProvider(name string) (PaymentProvider, error) {
+	switch name {
+	case "fake":
+		return payment.NewFake(os.Getenv("PAYMENT_WEBHOOK_SECRET")), nil
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", name)
+}
+
+// Операции оплаты
+const (
+	PaymentAuthorize = "authorize"
+	PaymentCapture   = "capture"
+	PaymentRefund    = "refund"
+	PaymentVoid      = "void"
+)
+
+// Состояния попытки
+const (
+	PaymentProcessing = "processing" //Запрос к провайдеру выполняется
+	PaymentPending    = "pending"    //Провайдер пришлёт результат webhook'ом
+	PaymentSucceeded  = "succeeded"
+	PaymentDeclined   = "declined"
+	PaymentFailed     = "failed" //Провайдер недоступен
+)
+
+// Попытка в состоянии processing не дольше этого времени, потом её можно повторить
+const PaymentLock = time.Minute
+
+var (
+	ErrNotPayable         = errors.New("only a created order can be paid")
+	ErrPaymentStarted     = errors.New("order already has an authorized or captured payment")
+	ErrNoAuthorization    = errors.New("order has no active authorization")
+	ErrNothingToRefund    = errors.New("refund amount must be greater than zero and not exceed the captured amount")
+	ErrPaymentInProgress  = errors.New("payment operation for this order is in progress")
+	ErrPaymentChanged     = errors.New("payments of the order were changed concurrently")
+	ErrUnknownPaymentHook = errors.New("payment of the webhook event is not found")
+)
+
+// Попытка операции оплаты
+type PaymentAttempt struct {
+	ID        string      `json:"id" bson:"id"` //Код попытки, ключ идемпотентности у провайдера
+	Operation string      `json:"operation" bson:"operation"`
+	Status    string      `json:"status" bson:"status"`
+	Provider  string      `json:"provider" bson:"provider"`
+	Amount    money.Money `json:"amount" bson:"amount"`
+	Parent    string      `json:"parent,omitempty" bson:"parent,omitempty"`       //Попытка авторизации или списания, к которой относится операция
+	Reference string      `json:"reference,omitempty" bson:"reference,omitempty"` //Код операции у провайдера
+	Code      string      `json:"code,omitempty" bson:"code,omitempty"`           //Причина отказа
+	Message   string      `json:"message,omitempty" bson:"message,omitempty"`
+	CreatedAt time.Time   `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at" bson:"updated_at"`
+}
+
+// Отказ провайдера
+type PaymentDeclinedError struct {
+	Code    string
+	Message string
+}
+
+func (e *PaymentDeclinedError) Error() string {
+	return fmt.Sprintf("payment declined: %s %s", e.Code, e.Message)
+}
+
+// Ошибка вызова провайдера
+type PaymentProviderError struct {
+	Err error
+}
+
+func (e *PaymentProviderError) Error() string {
+	return fmt.Sprintf("payment provider: %v", e.Err)
+}
+func (e *PaymentProviderError) Unwrap() error {
+	return e.Err
+}
+
+// Состояние оплаты заказа по успешным попыткам
+type PaymentSummary struct {
+	Authorization *PaymentAttempt //Действующая авторизация
+	Capture       *PaymentAttempt //Последнее успешное или ожидающее webhook списание
+	Captured      int64
+	Refunded      int64
+}
+
+func summarizePayments(attempts []PaymentAttempt) PaymentSummary {
+	var s PaymentSummary
+	for i := range attempts {
+		a := &attempts[i]
+		switch {
+		case a.Operation == PaymentAuthorize && a.Status == PaymentSucceeded:
+			s.Authorization = a
+		case a.Operation == PaymentVoid && a.Status == PaymentSucceeded:
+			s.Authorization = nil
+		case a.Operation == PaymentCapture && (a.Status == PaymentSucceeded || a.Status == PaymentPending):
+			// Авторизация списывается целиком
+			s.Authorization = nil
+			s.Capture = a
+			if a.Status == PaymentSucceeded {
+				s.Captured += a.Amount.Amount
+			}
+		case a.Operation == PaymentRefund && a.Status == PaymentSucceeded:
+			s.Refunded += a.Amount.Amount
+		}
+	}
+	return s
+}
+
+// Строки заказа нельзя менять после авторизации: сумма оплаты уже зафиксирована
+func paymentStarted(order Order) bool {
+	s := summarizePayments(order.Payments)
+	if n := len(order.Payments); n > 0 && order.Payments[n-1].Status == PaymentProcessing {
+		return true
+	}
+	return s.Authorization != nil || s.Capture != nil
+}
+
+// Фильтр заказа, попытки оплаты которого не менялись с чтения
+func paymentsFilter(order Order) bson.M {
+	n := len(order.Payments)
+	filter := bson.M{"_id": order.ID, "payments." + strconv.Itoa(n): bson.M{"$exists": false}}
+	if n > 0 {
+		last := order.Payments[n-1]
+		filter["payments."+strconv.Itoa(n-1)+".id"] = last.ID
+		filter["payments."+strconv.Itoa(n-1)+".status"] = last.Status
+	}
+	return filter
+}
+
+// Заказ с добавленной или изменённой попыткой оплаты
+func withPayment(order Order, a PaymentAttempt) Order {
+	payments := make([]PaymentAttempt, 0, len(order.Payments)+1)
+	found := false
+	for _, p := range order.Payments {
+		if p.ID == a.ID {
+			p, found = a, true
+		}
+		payments = append(payments, p)
+	}
+	if !found {
+		payments = append(payments, a)
+	}
+	order.Payments = payments
+	return order
+}
+
+// Начало попытки: попытка сохраняется в заказе в состоянии processing до вызова провайдера.
+// Одновременно у заказа выполняется одна операция. Если предыдущая попытка прервана
+// (processing дольше PaymentLock), та же операция продолжается с её ключом идемпотентности,
+// другая операция помечает её failed. Возвращает заказ с попыткой.
+func beginPayment(ctx context.Context, order Order, a PaymentAttempt, actor, correlationID string) (Order, PaymentAttempt, error) {
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	before := order
+	if n := len(order.Payments); n > 0 && order.Payments[n-1].Status == PaymentProcessing {
+		last := order.Payments[n-1]
+		if now.Sub(last.UpdatedAt) < PaymentLock {
+			return order, a, ErrPaymentInProgress
+		}
+		set := bson.M{"payments.$.updated_at": now}
+		same := last.Operation == a.Operation && last.Parent == a.Parent && last.Amount == a.Amount
+		if !same {
+			set["payments.$.status"] = PaymentFailed
+			set["payments.$.message"] = "attempt was interrupted"
+		}
+		res, err := collection.UpdateOne(ctx,
+			bson.M{"_id": order.ID, "payments": bson.M{"$elemMatch": bson.M{"id": last.ID, "status": PaymentProcessing, "updated_at": last.UpdatedAt}}},
+			bson.M{"$set": set})
+		if err != nil {
+			return order, a, err
+		}
+		if res.MatchedCount == 0 {
+			return order, a, ErrPaymentChanged
+		}
+		last.UpdatedAt = now
+		if same {
+			order = withPayment(order, last)
+			RecordAudit(AuditUpdate, &before, &order, actor, "payment "+last.Operation+" resumed", correlationID)
+			return order, last, nil
+		}
+		last.Status, last.Message = PaymentFailed, "attempt was interrupted"
+		order = withPayment(order, last)
+	}
+	a.ID = NewOrderID()
+	a.Status = PaymentProcessing
+	a.Provider = paymentProvider.Name()
+	a.CreatedAt, a.UpdatedAt = now, now
+	res, err := collection.UpdateOne(ctx, paymentsFilter(order), bson.M{"$push": bson.M{"payments": a}})
+	if err != nil {
+		return order, a, err
+	}
+	if res.MatchedCount == 0 {
+		return order, a, ErrPaymentChanged
+	}
+	order = withPayment(order, a)
+	RecordAudit(AuditUpdate, &before, &order, actor, "payment "+a.Operation+" started", correlationID)
+	return order, a, nil
+}
+
+// Сохранение результата провайдера в попытке с состоянием from. Если попытку за это время
+// изменил другой запрос, результат не сохраняется и возвращается ErrPaymentChanged.
+func finishPayment(ctx context.Context, order Order, a PaymentAttempt, from string, res payment.Result, callErr error, actor, correlationID string) (Order, PaymentAttempt, error) {
+	a.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	switch {
+	case callErr != nil:
+		a.Status, a.Message = PaymentFailed, callErr.Error()
+	case res.Status == payment.Succeeded:
+		a.Status = PaymentSucceeded
+	case res.Status == payment.Pending:
+		a.Status = PaymentPending
+	default:
+		a.Status, a.Code, a.Message = PaymentDeclined, res.Code, res.Message
+	}
+	if res.Reference != "" {
+		a.Reference = res.Reference
+	}
+	upd, err := client.Database(DataBaseName).Collection(CollectionName).UpdateOne(ctx,
+		bson.M{"_id": order.ID, "payments": bson.M{"$elemMatch": bson.M{"id": a.ID, "status": from}}},
+		bson.M{"$set": bson.M{"payments.$": a}})
+	if err != nil {
+		return order, a, err
+	}
+	if upd.MatchedCount == 0 {
+		return order, a, ErrPaymentChanged
+	}
+	before := order
+	order = withPayment(order, a)
+	RecordAudit(AuditUpdate, &before, &order, actor, "payment "+a.Operation+" "+a.Status, correlationID)
+	switch a.Status {
+	case PaymentFailed:
+		return order, a, &PaymentProviderError{callErr}
+	case PaymentDeclined:
+		return order, a, &PaymentDeclinedError{Code: a.Code, Message: a.Message}
+	}
+	return order, a, nil
+}
+
+// Авторизация итога заказа картой token. Покупателю доступны только его заказы.
+func AuthorizePayment(ctx context.Context, id, caller, token, actor, correlationID string) (Order, PaymentAttempt, error) {
+	order, err := FindId(id)
+	if err == nil && caller != "" && order.CustomerID != caller {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return Order{}, PaymentAttempt{}, err
+	}
+	if order.Status != lifecycle.Created {
+		return order, PaymentAttempt{}, ErrNotPayable
+	}
+	// Прерванная попытка в состоянии processing не мешает: beginPayment продолжит её
+	// с тем же ключом идемпотентности или ответит ErrPaymentInProgress, пока она выполняется
+	if s := summarizePayments(order.Payments); s.Authorization != nil || s.Capture != nil {
+		return order, PaymentAttempt{}, ErrPaymentStarted
+	}
+	order, a, err := beginPayment(ctx, order, PaymentAttempt{
+		Operation: PaymentAuthorize,
+		Amount:    money.Money{Amount: order.Totals.GrandTotal, Currency: order.Totals.Currency},
+	}, actor, correlationID)
+	if err != nil {
+		return order, a, err
+	}
+	res, callErr := paymentProvider.Authorize(ctx, payment.AuthorizeRequest{
+		IdempotencyKey: a.ID,
+		OrderID:        order.ID,
+		Amount:         a.Amount.Amount,
+		Currency:       a.Amount.Currency,
+		Token:          token,
+	})
+	return finishPayment(ctx, order, a, PaymentProcessing, res, callErr, actor, correlationID)
+}
+
+// Списание действующей авторизации целиком
+func CapturePayment(ctx context.Context, id, actor, correlationID string) (Order, PaymentAttempt, error) {
+	order, err := FindId(id)
+	if err != nil {
+		return Order{}, PaymentAttempt{}, err
+	}
+	if order.Status != lifecycle.Created {
+		return order, PaymentAttempt{}, ErrNotPayable
+	}
+	auth := summarizePayments(order.Payments).Authorization
+	if auth == nil {
+		return order, PaymentAttempt{}, ErrNoAuthorization
+	}
+	authRef := auth.Reference
+	order, a, err := beginPayment(ctx, order, PaymentAttempt{Operation: PaymentCapture, Amount: auth.Amount, Parent: auth.ID}, actor, correlationID)
+	if err != nil {
+		return order, a, err
+	}
+	res, callErr := paymentProvider.Capture(ctx, payment.Request{
+		IdempotencyKey: a.ID,
+		Reference:      authRef,
+		Amount:         a.Amount.Amount,
+		Currency:       a.Amount.Currency,
+	})
+	return finishPayment(ctx, order, a, PaymentProcessing, res, callErr, actor, correlationID)
+}
+
+// Отмена действующей авторизации, например у отменённого заказа
+func VoidPayment(ctx context.Context, id, actor, correlationID string) (Order, PaymentAttempt, error) {
+	order, err := FindId(id)
+	if err != nil {
+		return Order{}, PaymentAttempt{}, err
+	}
+	auth := summarizePayments(order.Payments).Authorization
+	if auth == nil {
+		return order, PaymentAttempt{}, ErrNoAuthorization
+	}
+	authRef := auth.Reference
+	order, a, err := beginPayment(ctx, order, PaymentAttempt{Operation: PaymentVoid, Amount: auth.Amount, Parent: auth.ID}, actor, correlationID)
+	if err != nil {
+		return order, a, err
+	}
+	res, callErr := paymentProvider.Void(ctx, payment.Request{
+		IdempotencyKey: a.ID,
+		Reference:      authRef,
+		Amount:         a.Amount.Amount,
+		Currency:       a.Amount.Currency,
+	})
+	return finishPayment(ctx, order, a, PaymentProcessing, res, callErr, actor, correlationID)
+}
+
+// Возврат amount списанных денег, 0 - всего остатка
+func RefundPayment(ctx context.Context, id string, amount int64, actor, correlationID string) (Order, PaymentAttempt, error) {
+	order, err := FindId(id)
+	if err != nil {
+		return Order{}, PaymentAttempt{}, err
+	}
+	s := summarizePayments(order.Payments)
+	left := s.Captured - s.Refunded
+	if amount == 0 {
+		amount = left
+	}
+	if s.Capture == nil || s.Capture.Status != PaymentSucceeded || amount <= 0 || amount > left {
+		return order, PaymentAttempt{}, ErrNothingToRefund
+	}
+	capture := *s.Capture
+	order, a, err := beginPayment(ctx, order, PaymentAttempt{
+		Operation: PaymentRefund,
+		Amount:    money.Money{Amount: amount, Currency: capture.Amount.Currency},
+		Parent:    capture.ID,
+	}, actor, correlationID)
+	if err != nil {
+		return order, a, err
+	}
+	res, callErr := paymentProvider.Refund(ctx, payment.Request{
+		IdempotencyKey: a.ID,
+		Reference:      capture.Reference,
+		Amount:         a.Amount.Amount,
+		Currency:       a.Amount.Currency,
+	})
+	return finishPayment(ctx, order, a, PaymentProcessing, res, callErr, actor, correlationID)
+}
+
+// Результат списания из webhook. Повторное событие по завершённой попытке ничего не меняет,
+// changed - попытка изменилась.
+func ApplyPaymentWebhook(ctx context.Context, event payment.WebhookEvent, actor, correlationID string) (order Order, a PaymentAttempt, changed bool, err error) {
+	err = client.Database(DataBaseName).Collection(CollectionName).FindOne(ctx,
+		bson.M{"payments.reference": event.Reference}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return order, a, false, ErrUnknownPaymentHook
+	}
+	if err != nil {
+		return order, a, false, err
+	}
+	for _, p := range order.Payments {
+		if p.Reference == event.Reference && p.Operation == PaymentCapture {
+			a = p
+		}
+	}
+	if a.ID == "" {
+		return order, a, false, ErrUnknownPaymentHook
+	}
+	if a.Status != PaymentPending {
+		return order, a, false, nil
+	}
+	res := payment.Result{Status: payment.Succeeded}
+	if event.Type != payment.EventCaptureSucceeded {
+		res = payment.Result{Status: payment.Declined, Code: event.Code}
+	}
+	order, a, err = finishPayment(ctx, order, a, PaymentPending, res, nil, actor, correlationID)
+	var declined *PaymentDeclinedError
+	switch {
+	case errors.As(err, &declined):
+		err = nil
+	case err == ErrPaymentChanged:
+		// Повторное событие обработано параллельно
+		return order, a, false, nil
+	}
+	return order, a, err == nil, err
+}
+
+// Перевод заказа в paid после успешного списания
+func markPaid(order Order, a PaymentAttempt, actor, correlationID string) {
+	if a.Operation != PaymentCapture || a.Status != PaymentSucceeded {
+		return
+	}
+	paid, change, err := TransitionOrder(order.ID, lifecycle.Paid, "payment "+a.ID+" captured")
+	if err != nil {
+		log.Printf("order %s is not paid: %v\n", order.ID, err)
+		return
+	}
+	RecordStatusChange(paid, change, actor, correlationID)
+	PublishOrderEvent(EventOrderStatusChanged, paid, "Order "+paid.ID+" paid", correlationID)
+}
+
+// Ответ на ошибку операции оплаты
+func paymentErrorResponse(w http.ResponseWriter, err error) {
+	var declined *PaymentDeclinedError
+	var provErr *PaymentProviderError
+	switch {
+	case err == mongo.ErrNoDocuments:
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+	case err == ErrNotPayable || err == ErrPaymentStarted || err == ErrNoAuthorization || err == ErrNothingToRefund:
+		ErrorResponse(w, http.StatusConflict, "Payment is not possible", err.Error())
+	case err == ErrPaymentInProgress || err == ErrPaymentChanged:
+		w.Header().Set("Retry-After", "1")
+		ErrorResponse(w, http.StatusConflict, "Payment in progress", "Another payment operation of the order is in progress, retry later.")
+	case errors.As(err, &declined):
+		ErrorResponse(w, http.StatusPaymentRequired, "Payment declined", declined.Code+": "+declined.Message)
+	case errors.As(err, &provErr):
+		log.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, "Payment provider unavailable", "The payment could not be processed, retry later.")
+	default:
+		InternalError(w, err)
+	}
+}
+
+func writePayment(w http.ResponseWriter, a PaymentAttempt) {
+	status := http.StatusOK
+	if a.Status == PaymentPending {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(a)
+}
+
+// Оплатить заказ: авторизация, а при "capture": true - сразу и списание
+func PostAuthorizePayment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token   string `json:"token"`
+		Capture bool   `json:"capture"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must contain a card token.")
+		return
+	}
+	correlationID := CorrelationID(w, r)
+	order, a, err := AuthorizePayment(r.Context(), mux.Vars(r)["id"], Caller(r), req.Token, Actor(r), correlationID)
+	if err == nil && req.Capture {
+		order, a, err = CapturePayment(r.Context(), order.ID, Actor(r), correlationID)
+		if err == nil {
+			markPaid(order, a, Actor(r), correlationID)
+		}
+	}
+	if err != nil {
+		paymentErrorResponse(w, err)
+		return
+	}
+	writePayment(w, a)
+}
+
+// Списать, отменить или вернуть оплату. Доступно только сотрудникам.
+func PostPaymentAction(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Payments are captured, voided and refunded by staff only.")
+		return
+	}
+	var req struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); (err != nil && err != io.EOF) || req.Amount < 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body may contain a refund amount in minor currency units.")
+		return
+	}
+	ctx, id := r.Context(), mux.Vars(r)["id"]
+	actor, correlationID := Actor(r), CorrelationID(w, r)
+	var order Order
+	var a PaymentAttempt
+	var err error
+	switch mux.Vars(r)["action"] {
+	case PaymentCapture:
+		order, a, err = CapturePayment(ctx, id, actor, correlationID)
+	case PaymentVoid:
+		order, a, err = VoidPayment(ctx, id, actor, correlationID)
+	case PaymentRefund:
+		order, a, err = RefundPayment(ctx, id, req.Amount, actor, correlationID)
+	}
+	if err != nil {
+		paymentErrorResponse(w, err)
+		return
+	}
+	markPaid(order, a, actor, correlationID)
+	writePayment(w, a)
+}
+
+// Получить попытки оплаты заказа
+func GetPayments(w http.ResponseWriter, r *http.Request) {
+	order, err := FindId(mux.Vars(r)["id"])
+	if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		paymentErrorResponse(w, err)
+		return
+	}
+	payments := order.Payments
+	if payments == nil {
+		payments = []PaymentAttempt{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(payments)
+}
+
+// Webhook провайдера с результатом отложенного списания
+func PostPaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The request body could not be read.")
+		return
+	}
+	event, err := paymentProvider.VerifyWebhook(body, r.Header)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Invalid webhook", err.Error())
+		return
+	}
+	actor, correlationID := "payment:"+paymentProvider.Name(), CorrelationID(w, r)
+	order, a, changed, err := ApplyPaymentWebhook(r.Context(), event, actor, correlationID)
+	if err == ErrUnknownPaymentHook {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", err.Error())
+		return
+	}
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if changed {
+		markPaid(order, a, actor, correlationID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// Параметры выборки GET /orders
+type OrderQuery struct {
+	From       *time.Time // Включительно
+	To         *time.Time // Не включительно
+	Statuses   []lifecycle.Status
+	ProductID  string
+	CustomerID string
+	Asc        bool // По умолчанию сначала новые заказы
+	Limit      int
+	After      *Cursor
+}
+
+// Позиция последнего отданного заказа: дата заказа и его код
+type Cursor struct {
+	Asc  bool      `json:"a,omitempty"`
+	Data time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+// Страница заказов
+type OrderPage struct {
+	Items      []Order `json:"items"`
+	Total      int64   `json:"total"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+func EncodeCursor(c Cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("cursor is malformed")
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("cursor is malformed")
+	}
+	return &c, nil
+}
+
+// Дата в формате RFC 3339 или YYYY-MM-DD (начало дня UTC)
+func parseTime(values url.Values, key string) (*time.Time, error) {
+	return parseTimeIn(values, key, time.UTC)
+}
+
+// Дата в формате RFC 3339 или YYYY-MM-DD (начало дня в поясе loc)
+func parseTimeIn(values url.Values, key string, loc *time.Location) (*time.Time, error) {
+	raw := values.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, raw, loc); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be a date (2006-01-02) or RFC 3339 time", key)
+}
+
+// Состояния передаются через запятую или повтором параметра status
+func parseStatuses(values url.Values) ([]lifecycle.Status, error) {
+	var statuses []lifecycle.Status
+	for _, v := range values["status"] {
+		for _, s := range strings.Split(v, ",") {
+			status := lifecycle.Status(strings.TrimSpace(s))
+			if !lifecycle.Valid(status) {
+				return nil, fmt.Errorf("unknown status %q", s)
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// Разбор параметров from, to, status, product_id, order, limit, cursor
+func ParseOrderQuery(r *http.Request) (OrderQuery, error) {
+	values := r.URL.Query()
+	q := OrderQuery{ProductID: values.Get("product_id"), Limit: DefaultPageSize}
+	var err error
+	if q.From, err = parseTime(values, "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTime(values, "to"); err != nil {
+		return q, err
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return q, errors.New("from must be earlier than to")
+	}
+	if q.Statuses, err = parseStatuses(values); err != nil {
+		return q, err
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Asc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	if l := values.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit <= 0 {
+			return q, errors.New("limit must be a positive number")
+		}
+		if q.Limit > MaxPageSize {
+			q.Limit = MaxPageSize
+		}
+	}
+	if c := values.Get("cursor"); c != "" {
+		if q.After, err = DecodeCursor(c); err != nil {
+			return q, err
+		}
+		if q.After.Asc != q.Asc {
+			return q, errors.New("cursor does not match order")
+		}
+	}
+	return q, nil
+}
+
+// Выборка страницы заказов по фильтрам с курсорной пагинацией.
+// Сортировка по дате заказа и коду, код различает заказы с одинаковой датой.
+func FindOrders(q OrderQuery) (OrderPage, error) {
+	filter := bson.M{}
+	data := bson.M{}
+	if q.From != nil {
+		data["$gte"] = *q.From
+	}
+	if q.To != nil {
+		data["$lt"] = *q.To
+	}
+	if len(data) > 0 {
+		filter["data"] = data
+	}
+	if len(q.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": q.Statuses}
+	}
+	if q.CustomerID != "" {
+		filter["customer_id"] = q.CustomerID
+	}
+	if q.ProductID != "" {
+		filter["product.itemid"] = q.ProductID
+	}
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	page := OrderPage{Items: []Order{}}
+	total, err := collection.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	page.Total = total
+
+	dir, cmp := -1, "$lt"
+	if q.Asc {
+		dir, cmp = 1, "$gt"
+	}
+	if q.After != nil {
+		after := []bson.M{
+			{"data": bson.M{cmp: q.After.Data}},
+			{"data": q.After.Data, "_id": bson.M{cmp: q.After.ID}},
+		}
+		filter = bson.M{"$and": []bson.M{filter, {"$or": after}}}
+	}
+	opts := options.Find().
+		SetSort(primitive.D{{Key: "data", Value: dir}, {Key: "_id", Value: dir}}).
+		SetLimit(int64(q.Limit + 1))
+	cur, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	defer cur.Close(context.TODO())
+	if err := cur.All(context.TODO(), &page.Items); err != nil {
+		return OrderPage{}, err
+	}
+	// Лишняя запись означает, что есть следующая страница
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[q.Limit-1]
+		page.NextCursor = EncodeCursor(Cursor{Asc: q.Asc, Data: last.Data, ID: last.ID})
+	}
+	return page, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Часовые пояса для отчётов, в образе alpine их нет
+
+	"testOrder/internal/lifecycle"
+	"testOrder/internal/pricing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	DefaultTopProducts = 10
+	MaxTopProducts     = 100
+)
+
+// Состояния заказов, которые считаются продажами: оформленные и не отменённые
+var SalesStatuses = []lifecycle.Status{lifecycle.Created, lifecycle.Paid, lifecycle.Packed, lifecycle.Shipped, lifecycle.Delivered}
+
+// Параметры отчёта о продажах
+type SalesQuery struct {
+	From     *time.Time // Включительно
+	To       *time.Time // Не включительно
+	Group    string     // day, week или month
+	Location *time.Location
+	Top      int
+	Statuses []lifecycle.Status
+}
+
+// Продажи за период в одной валюте. Выручка - сумма итогов заказов (grand_total).
+type SalesPeriod struct {
+	Period   string `json:"period" bson:"-"` //Начало периода, YYYY-MM-DD
+	Currency string `json:"currency" bson:"currency"`
+	Revenue  int64  `json:"revenue" bson:"revenue"`
+	Orders   int64  `json:"orders" bson:"orders"`
+	Units    int64  `json:"units" bson:"units"`
+
+	Start time.Time `json:"-" bson:"start"`
+}
+
+// Продукт по выручке. Выручка - сумма строк заказов без скидок на заказ.
+type ProductSales struct {
+	ItemID   string `json:"item_id" bson:"item_id"`
+	Name     string `json:"name" bson:"name"`
+	Currency string `json:"currency" bson:"currency"`
+	Revenue  int64  `json:"revenue" bson:"revenue"`
+	Units    int64  `json:"units" bson:"units"`
+}
+
+// Итоги за весь диапазон в одной валюте
+type SalesSummary struct {
+	Currency          string `json:"currency" bson:"currency"`
+	Revenue           int64  `json:"revenue" bson:"revenue"`
+	Orders            int64  `json:"orders" bson:"orders"`
+	Units             int64  `json:"units" bson:"units"`
+	AverageOrderValue int64  `json:"average_order_value" bson:"-"`
+}
+
+// Отчёт о продажах, суммы в минимальных единицах валюты
+type SalesReport struct {
+	From        *time.Time     `json:"from,omitempty"`
+	To          *time.Time     `json:"to,omitempty"`
+	Group       string         `json:"group"`
+	Timezone    string         `json:"timezone"`
+	Periods     []SalesPeriod  `json:"periods"`
+	TopProducts []ProductSales `json:"top_products"`
+	Summary     []SalesSummary `json:"summary"`
+}
+
+// Разбор параметров from, to, group, tz, top, status
+func ParseSalesQuery(r *http.Request) (SalesQuery, error) {
+	values := r.URL.Query()
+	q := SalesQuery{Group: "day", Location: time.UTC, Top: DefaultTopProducts, Statuses: SalesStatuses}
+	var err error
+	if tz := values.Get("tz"); tz != "" {
+		if q.Location, err = time.LoadLocation(tz); err != nil || tz == "Local" {
+			return q, errors.New("tz must be an IANA time zone, for example Europe/Moscow")
+		}
+	}
+	if q.From, err = parseTimeIn(values, "from", q.Location); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTimeIn(values, "to", q.Location); err != nil {
+		return q, err
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return q, errors.New("from must be earlier than to")
+	}
+	switch g := values.Get("group"); g {
+	case "":
+	case "day", "week", "month":
+		q.Group = g
+	default:
+		return q, errors.New("group must be day, week or month")
+	}
+	if t := values.Get("top"); t != "" {
+		q.Top, err = strconv.Atoi(t)
+		if err != nil || q.Top <= 0 {
+			return q, errors.New("top must be a positive number")
+		}
+		if q.Top > MaxTopProducts {
+			q.Top = MaxTopProducts
+		}
+	}
+	if _, ok := values["status"]; ok {
+		if q.Statuses, err = parseStatuses(values); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// Отчёт одним запросом агрегации: $facet считает периоды, топ продуктов и итоги по одной выборке
+func SalesReportFor(ctx context.Context, q SalesQuery) (SalesReport, error) {
+	match := bson.M{"status": bson.M{"$in": q.Statuses}}
+	data := bson.M{}
+	if q.From != nil {
+		data["$gte"] = *q.From
+	}
+	if q.To != nil {
+		data["$lt"] = *q.To
+	}
+	if len(data) > 0 {
+		match["data"] = data
+	}
+	units := bson.M{"$sum": "$product.quantity"}
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$facet": bson.M{
+			"periods": []bson.M{
+				{"$group": bson.M{
+					"_id": bson.M{
+						"start": bson.M{"$dateTrunc": bson.M{
+							"date": "$data", "unit": q.Group, "timezone": q.Location.String(), "startOfWeek": "monday",
+						}},
+						"currency": "$totals.currency",
+					},
+					"revenue": bson.M{"$sum": "$totals.grandtotal"},
+					"orders":  bson.M{"$sum": 1},
+					"units":   bson.M{"$sum": units},
+				}},
+				{"$project": bson.M{"_id": 0, "start": "$_id.start", "currency": "$_id.currency", "revenue": 1, "orders": 1, "units": 1}},
+				{"$sort": primitive.D{{Key: "start", Value: 1}, {Key: "currency", Value: 1}}},
+			},
+			"products": []bson.M{
+				{"$unwind": "$product"},
+				{"$group": bson.M{
+					"_id":     bson.M{"item_id": "$product.itemid", "currency": "$product.total.currency"},
+					"name":    bson.M{"$last": "$product.name"},
+					"revenue": bson.M{"$sum": "$product.total.amount"},
+					"units":   bson.M{"$sum": "$product.quantity"},
+				}},
+				{"$sort": primitive.D{{Key: "revenue", Value: -1}, {Key: "_id.item_id", Value: 1}}},
+				// Топ считается в каждой валюте отдельно
+				{"$group": bson.M{"_id": "$_id.currency", "items": bson.M{"$push": bson.M{
+					"item_id": "$_id.item_id", "name": "$name", "currency": "$_id.currency", "revenue": "$revenue", "units": "$units",
+				}}}},
+				{"$sort": bson.M{"_id": 1}},
+				{"$project": bson.M{"items": bson.M{"$slice": []interface{}{"$items", q.Top}}}},
+			},
+			"summary": []bson.M{
+				{"$group": bson.M{
+					"_id":     "$totals.currency",
+					"revenue": bson.M{"$sum": "$totals.grandtotal"},
+					"orders":  bson.M{"$sum": 1},
+					"units":   bson.M{"$sum": units},
+				}},
+				{"$project": bson.M{"_id": 0, "currency": "$_id", "revenue": 1, "orders": 1, "units": 1}},
+				{"$sort": bson.M{"currency": 1}},
+			},
+		}},
+	}
+	cur, err := client.Database(DataBaseName).Collection(CollectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return SalesReport{}, err
+	}
+	defer cur.Close(ctx)
+	var facets []struct {
+		Periods  []SalesPeriod `bson:"periods"`
+		Products []struct {
+			Items []ProductSales `bson:"items"`
+		} `bson:"products"`
+		Summary []SalesSummary `bson:"summary"`
+	}
+	if err := cur.All(ctx, &facets); err != nil {
+		return SalesReport{}, err
+	}
+	report := SalesReport{
+		From: q.From, To: q.To, Group: q.Group, Timezone: q.Location.String(),
+		Periods: []SalesPeriod{}, TopProducts: []ProductSales{}, Summary: []SalesSummary{},
+	}
+	if len(facets) == 0 {
+		return report, nil
+	}
+	report.Periods = append(report.Periods, facets[0].Periods...)
+	for i := range report.Periods {
+		report.Periods[i].Period = report.Periods[i].Start.In(q.Location).Format("2006-01-02")
+	}
+	for _, p := range facets[0].Products {
+		report.TopProducts = append(report.TopProducts, p.Items...)
+	}
+	report.Summary = append(report.Summary, facets[0].Summary...)
+	for i, s := range report.Summary {
+		if s.Orders > 0 {
+			report.Summary[i].AverageOrderValue = pricing.DivRound(s.Revenue, s.Orders)
+		}
+	}
+	return report, nil
+}
+
+// Отчёт в CSV: одна таблица, раздел строки указан в первой колонке
+func WriteSalesCSV(w *csv.Writer, report SalesReport) error {
+	i := strconv.FormatInt
+	rows := [][]string{{"section", "period", "item_id", "name", "currency", "revenue", "orders", "units", "average_order_value"}}
+	for _, p := range report.Periods {
+		rows = append(rows, []string{"period", p.Period, "", "", p.Currency, i(p.Revenue, 10), i(p.Orders, 10), i(p.Units, 10), ""})
+	}
+	for _, p := range report.TopProducts {
+		rows = append(rows, []string{"product", "", p.ItemID, p.Name, p.Currency, i(p.Revenue, 10), "", i(p.Units, 10), ""})
+	}
+	for _, s := range report.Summary {
+		rows = append(rows, []string{"summary", "", "", "", s.Currency, i(s.Revenue, 10), i(s.Orders, 10), i(s.Units, 10), i(s.AverageOrderValue, 10)})
+	}
+	return w.WriteAll(rows)
+}
+
+// Отчёт о продажах: JSON по умолчанию, CSV при ?format=csv или Accept: text/csv
+func GetSalesReport(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Sales reports are not available to customers.")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format != "" && format != "csv" && format != "json" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", "format must be json or csv")
+		return
+	}
+	query, err := ParseSalesQuery(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	report, err := SalesReportFor(r.Context(), query)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="sales.csv"`)
+		w.WriteHeader(http.StatusOK)
+		WriteSalesCSV(csv.NewWriter(w), report)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"testOrder/internal/lifecycle"
+	"testOrder/internal/pricing"
+
+	"github.com/ALbikov-R/4ServicesGRPC/events"
+	"github.com/ALbikov-R/4ServicesGRPC/money"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Запросы на возврат, код документа - код возврата
+const ReturnsCollection = "returns"
+
+// Типы событий возврата
+const (
+	EventReturnRequested = events.TypeReturnRequested
+	EventReturnApproved  = events.TypeReturnApproved
+	EventReturnRejected  = events.TypeReturnRejected
+	EventReturnReceived  = events.TypeReturnReceived
+	EventReturnRefunded  = events.TypeReturnRefunded
+)
+
+type ReturnStatus string
+
+// Состояния возврата
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	ReturnReceived  ReturnStatus = "received"
+	ReturnRefunded  ReturnStatus = "refunded"
+)
+
+// Допустимые переходы: запрос одобряют или отклоняют, одобренный возврат принимают на склад,
+// принятый - возмещают. Из rejected и refunded переходов нет.
+var returnTransitions = map[ReturnStatus][]ReturnStatus{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived},
+	ReturnReceived:  {ReturnRefunded},
+	ReturnRejected:  {},
+	ReturnRefunded:  {},
+}
+
+// Причины возврата
+var ReturnReasons = []string{"damaged", "defective", "wrong_item", "not_as_described", "no_longer_needed", "other"}
+
+var (
+	ErrNotReturnable      = errors.New("only shipped or delivered orders can be returned")
+	ErrInvalidReturnLines = errors.New("return must contain order products with quantity greater than zero and a reason")
+	ErrReturnChanged      = errors.New("return was changed concurrently")
+	ErrReturnBusy         = errors.New("returns of this order are being changed")
+)
+
+// Строка возврата. Accepted - сколько предметов принято на склад при получении,
+// только они возвращаются в остаток и возмещаются.
+type ReturnLine struct {
+	ItemID   string `json:"item_id" bson:"item_id"`
+	Quantity int    `json:"quantity" bson:"quantity"`
+	Accepted int    `json:"accepted" bson:"accepted"`
+	Reason   string `json:"reason" bson:"reason"`
+	Comment  string `json:"comment,omitempty" bson:"comment,omitempty"`
+}
+
+// Переход возврата между состояниями
+type ReturnChange struct {
+	From   ReturnStatus `json:"from,omitempty" bson:"from,omitempty"`
+	To     ReturnStatus `json:"to" bson:"to"`
+	At     time.Time    `json:"at" bson:"at"`
+	Reason string       `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// Запрос на возврат по строкам заказа
+type ReturnRequest struct {
+	ID         string         `json:"id" bson:"_id"`                  //Код возврата
+	OrderID    string         `json:"order_id" bson:"order_id"`       //Код заказа
+	CustomerID string         `json:"customer_id" bson:"customer_id"` //Покупатель заказа
+	Status     ReturnStatus   `json:"status" bson:"status"`
+	Lines      []ReturnLine   `json:"lines" bson:"lines"`
+	Refund     *money.Money   `json:"refund,omitempty" bson:"refund,omitempty"` //Возмещение, известно после refund
+	Inspected  bool           `json:"-" bson:"inspected,omitempty"`             //Принятое количество сохранено, склад пополняется по нему
+	CreatedAt  time.Time      `json:"created_at" bson:"created_at"`
+	History    []ReturnChange `json:"history" bson:"history"`
+}
+
+// Ошибка в строке возврата
+type ReturnLineError struct {
+	ItemID  string
+	Message string
+}
+
+func (e *ReturnLineError) Error() string {
+	return fmt.Sprintf("item %s: %s", e.ItemID, e.Message)
+}
+
+// Недопустимый переход возврата
+type ReturnTransitionError struct {
+	From ReturnStatus
+	To   ReturnStatus
+}
+
+func (e *ReturnTransitionError) Error() string {
+	return fmt.Sprintf("return cannot move from %s to %s", e.From, e.To)
+}
+
+func checkReturnTransition(from, to ReturnStatus) error {
+	for _, s := range returnTransitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return &ReturnTransitionError{From: from, To: to}
+}
+
+// Возврат возможен только после отгрузки
+func Returnable(s lifecycle.Status) bool {
+	return s == lifecycle.Shipped || s == lifecycle.Delivered
+}
+
+func validReason(reason string) bool {
+	for _, r := range ReturnReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Запрос на возврат строк заказа. Вернуть можно не больше заказанного за вычетом
+// строк других возвратов, кроме отклонённых.
+func RequestReturn(ctx context.Context, orderID, caller string, lines []ReturnLine) (ReturnRequest, error) {
+	if len(lines) == 0 {
+		return ReturnRequest{}, ErrInvalidReturnLines
+	}
+	seen := make(map[string]bool)
+	for i, line := range lines {
+		if line.ItemID == "" || line.Quantity <= 0 || !validReason(line.Reason) || seen[line.ItemID] {
+			return ReturnRequest{}, ErrInvalidReturnLines
+		}
+		seen[line.ItemID] = true
+		lines[i].Accepted = 0
+	}
+	for attempt := 0; attempt < 20; attempt++ {
+		order, err := FindId(orderID)
+		if err == nil && caller != "" && order.CustomerID != caller {
+			err = mongo.ErrNoDocuments
+		}
+		if err != nil {
+			return ReturnRequest{}, err
+		}
+		if !Returnable(order.Status) {
+			return ReturnRequest{}, ErrNotReturnable
+		}
+		seq, err := returnsSeq(ctx, orderID)
+		if err != nil {
+			return ReturnRequest{}, err
+		}
+		others, err := OrderReturns(ctx, orderID)
+		if err != nil {
+			return ReturnRequest{}, err
+		}
+		returned := make(map[string]int)
+		for _, ret := range others {
+			if ret.Status == ReturnRejected {
+				continue
+			}
+			for _, line := range ret.Lines {
+				returned[line.ItemID] += line.Quantity
+			}
+		}
+		ordered := make(map[string]int)
+		for _, p := range order.Product {
+			ordered[p.ItemID] += p.Quantity
+		}
+		for _, line := range lines {
+			left := ordered[line.ItemID] - returned[line.ItemID]
+			switch {
+			case ordered[line.ItemID] == 0:
+				return ReturnRequest{}, &ReturnLineError{line.ItemID, "product is not in the order"}
+			case line.Quantity > left:
+				return ReturnRequest{}, &ReturnLineError{line.ItemID, fmt.Sprintf("only %d can be returned", left)}
+			}
+		}
+		// Пока проверялись строки, другой запрос мог создать возврат по этому заказу
+		if ok, err := claimReturns(ctx, orderID, seq); err != nil || !ok {
+			if err != nil {
+				return ReturnRequest{}, err
+			}
+			continue
+		}
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		ret := ReturnRequest{
+			ID:         NewOrderID(),
+			OrderID:    order.ID,
+			CustomerID: order.CustomerID,
+			Status:     ReturnRequested,
+			Lines:      lines,
+			CreatedAt:  now,
+			History:    []ReturnChange{{To: ReturnRequested, At: now}},
+		}
+		_, err = client.Database(DataBaseName).Collection(ReturnsCollection).InsertOne(ctx, ret)
+		return ret, err
+	}
+	return ReturnRequest{}, ErrReturnBusy
+}
+
+// Номер последнего изменения возвратов заказа
+func returnsSeq(ctx context.Context, orderID string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := client.Database(DataBaseName).Collection(CountersCollection).FindOne(ctx, bson.M{"_id": "returns:" + orderID}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return counter.Seq, err
+}
+
+// Захват изменения возвратов заказа: удаётся, только если с чтения seq их никто не менял
+func claimReturns(ctx context.Context, orderID string, seq int64) (bool, error) {
+	_, err := client.Database(DataBaseName).Collection(CountersCollection).UpdateOne(ctx,
+		bson.M{"_id": "returns:" + orderID, "seq": seq}, bson.M{"$inc": bson.M{"seq": 1}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Возвраты заказа, сначала ранние
+func OrderReturns(ctx context.Context, orderID string) ([]ReturnRequest, error) {
+	cur, err := client.Database(DataBaseName).Collection(ReturnsCollection).Find(ctx, bson.M{"order_id": orderID},
+		options.Find().SetSort(primitive.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	returns := []ReturnRequest{}
+	if err := cur.All(ctx, &returns); err != nil {
+		return nil, err
+	}
+	return returns, nil
+}
+
+// Возврат с кодом id, покупателю доступны только его возвраты
+func FindReturn(ctx context.Context, id, caller string) (ReturnRequest, error) {
+	filter := ownedFilter(id, caller)
+	var ret ReturnRequest
+	err := client.Database(DataBaseName).Collection(ReturnsCollection).FindOne(ctx, filter).Decode(&ret)
+	return ret, err
+}
+
+// Перевод возврата в состояние to с изменением полей set. Запись выполняется только если
+// возврат всё ещё в прочитанном состоянии.
+func advanceReturn(ctx context.Context, ret ReturnRequest, to ReturnStatus, reason string, set bson.M) (ReturnRequest, error) {
+	if err := checkReturnTransition(ret.Status, to); err != nil {
+		return ret, err
+	}
+	change := ReturnChange{From: ret.Status, To: to, At: time.Now().UTC().Truncate(time.Millisecond), Reason: reason}
+	if set == nil {
+		set = bson.M{}
+	}
+	set["status"] = to
+	res, err := client.Database(DataBaseName).Collection(ReturnsCollection).UpdateOne(ctx,
+		bson.M{"_id": ret.ID, "status": ret.Status},
+		bson.M{"$set": set, "$push": bson.M{"history": change}})
+	if err != nil {
+		return ret, err
+	}
+	if res.MatchedCount == 0 {
+		return ret, ErrReturnChanged
+	}
+	ret.Status = to
+	ret.History = append(ret.History, change)
+	return ret, nil
+}
+
+// Одобрение или отклонение запроса на возврат
+func DecideReturn(ctx context.Context, id string, to ReturnStatus, reason string) (ReturnRequest, error) {
+	ret, err := FindReturn(ctx, id, "")
+	if err != nil {
+		return ret, err
+	}
+	return advanceReturn(ctx, ret, to, reason, nil)
+}
+
+// Получение возврата на складе. accepted - сколько предметов каждой строки принято,
+// строки без указания принимаются полностью. Принятые предметы возвращаются в остатки
+// Inventory; код возврата служит кодом пополнения, поэтому повтор после сбоя не
+// пополнит склад дважды. Принятое количество сохраняется до пополнения, и повтор
+// с другим количеством отклоняется: возмещается ровно то, что вернулось на склад.
+func ReceiveReturn(ctx context.Context, id string, accepted map[string]int, reason string) (ReturnRequest, error) {
+	ret, err := FindReturn(ctx, id, "")
+	if err != nil {
+		return ret, err
+	}
+	if err := checkReturnTransition(ret.Status, ReturnReceived); err != nil {
+		return ret, err
+	}
+	lines := make([]ReturnLine, len(ret.Lines))
+	known := make(map[string]bool)
+	for i, line := range ret.Lines {
+		known[line.ItemID] = true
+		n, ok := accepted[line.ItemID]
+		switch {
+		case ret.Inspected:
+			if ok && n != line.Accepted {
+				return ret, &ReturnLineError{line.ItemID, fmt.Sprintf("accepted %d is already recorded", line.Accepted)}
+			}
+		case !ok:
+			line.Accepted = line.Quantity
+		case n < 0 || n > line.Quantity:
+			return ret, &ReturnLineError{line.ItemID, fmt.Sprintf("accepted must be between 0 and %d", line.Quantity)}
+		default:
+			line.Accepted = n
+		}
+		lines[i] = line
+	}
+	for itemID := range accepted {
+		if !known[itemID] {
+			return ret, &ReturnLineError{itemID, "product is not in the return"}
+		}
+	}
+	if !ret.Inspected {
+		res, err := client.Database(DataBaseName).Collection(ReturnsCollection).UpdateOne(ctx,
+			bson.M{"_id": ret.ID, "status": ret.Status, "inspected": bson.M{"$ne": true}},
+			bson.M{"$set": bson.M{"lines": lines, "inspected": true}})
+		if err != nil {
+			return ret, err
+		}
+		if res.MatchedCount == 0 {
+			return ret, ErrReturnChanged
+		}
+		ret.Lines, ret.Inspected = lines, true
+	}
+	if err := RestockLines(ctx, ret.ID, lines); err != nil {
+		return ret, err
+	}
+	return advanceReturn(ctx, ret, ReturnReceived, reason, nil)
+}
+
+// Возмещение принятых предметов. Сумма - доля итога заказа без доставки, приходящаяся на
+// принятые строки, поэтому скидки и налог возмещаются пропорционально. Доля считается
+// по всем возмещённым возвратам заказа вместе, чтобы округления не накапливались и
+// полный возврат дал ровно итог заказа без доставки. Если возмещены все строки,
+// заказ переходит в returned.
+func RefundReturn(ctx context.Context, id, reason string) (ReturnRequest, *Order, error) {
+	for attempt := 0; attempt < 20; attempt++ {
+		ret, err := FindReturn(ctx, id, "")
+		if err != nil {
+			return ret, nil, err
+		}
+		if err := checkReturnTransition(ret.Status, ReturnRefunded); err != nil {
+			return ret, nil, err
+		}
+		order, err := FindId(ret.OrderID)
+		if err != nil {
+			return ret, nil, err
+		}
+		seq, err := returnsSeq(ctx, ret.OrderID)
+		if err != nil {
+			return ret, nil, err
+		}
+		others, err := OrderReturns(ctx, ret.OrderID)
+		if err != nil {
+			return ret, nil, err
+		}
+		refunded := make(map[string]int)
+		var paid int64
+		for _, other := range others {
+			if other.ID == ret.ID {
+				other = ret
+			} else if other.Status != ReturnRefunded {
+				continue
+			} else if other.Refund != nil {
+				paid += other.Refund.Amount
+			}
+			for _, line := range other.Lines {
+				refunded[line.ItemID] += line.Accepted
+			}
+		}
+		if ok, err := claimReturns(ctx, ret.OrderID, seq); err != nil || !ok {
+			if err != nil {
+				return ret, nil, err
+			}
+			continue
+		}
+		amount := money.Money{Amount: refundShare(order, refunded) - paid, Currency: order.Totals.Currency}
+		ret, err = advanceReturn(ctx, ret, ReturnRefunded, reason, bson.M{"refund": amount})
+		if err != nil {
+			return ret, nil, err
+		}
+		ret.Refund = &amount
+		complete := true
+		for _, p := range order.Product {
+			complete = complete && refunded[p.ItemID] >= p.Quantity
+		}
+		if !complete {
+			return ret, nil, nil
+		}
+		returned, _, err := TransitionOrder(order.ID, lifecycle.Returned, "all products returned")
+		if err != nil {
+			// Возврат уже возмещён, заказ остаётся в прежнем состоянии
+			log.Printf("order %s is not returned: %v\n", order.ID, err)
+			return ret, nil, nil
+		}
+		return ret, &returned, nil
+	}
+	return ReturnRequest{}, nil, ErrReturnBusy
+}
+
+// Доля итога заказа без доставки, приходящаяся на quantities предметов
+func refundShare(order Order, quantities map[string]int) int64 {
+	if order.Totals.Subtotal <= 0 {
+		return 0
+	}
+	var subtotal int64
+	for _, p := range order.Product {
+		n := quantities[p.ItemID]
+		if n > p.Quantity {
+			n = p.Quantity
+		}
+		if n > 0 {
+			subtotal += pricing.DivRound(p.Total.Amount*int64(n), int64(p.Quantity))
+		}
+	}
+	return pricing.DivRound((order.Totals.GrandTotal-order.Totals.Shipping)*subtotal, order.Totals.Subtotal)
+}
+
+// Событие возврата, ключ сообщения - код заказа, как у событий заказа
+func PublishReturnEvent(event string, ret ReturnRequest, description, correlationID string) {
+	if description == "" {
+		description = "Return " + ret.ID + " of order " + ret.OrderID + " " + string(ret.Status)
+	}
+	err := SendEvent(event, ret.OrderID, correlationID, &events.ReturnEvent{Return: ReturnToProto(ret), Description: description})
+	if err != nil {
+		log.Printf("event %s of return %s: %v\n", event, ret.ID, err)
+	}
+}
+
+// Возврат в формате нагрузки события
+func ReturnToProto(ret ReturnRequest) *events.Return {
+	r := &events.Return{
+		Id:         ret.ID,
+		OrderId:    ret.OrderID,
+		CustomerId: ret.CustomerID,
+		Status:     string(ret.Status),
+		CreatedAt:  ret.CreatedAt.UnixMilli(),
+	}
+	if ret.Refund != nil {
+		r.Refund = &events.Money{Amount: ret.Refund.Amount, Currency: ret.Refund.Currency}
+	}
+	for _, line := range ret.Lines {
+		r.Lines = append(r.Lines, &events.ReturnLine{ItemId: line.ItemID, Quantity: int32(line.Quantity), Accepted: int32(line.Accepted), Reason: line.Reason})
+	}
+	for _, h := range ret.History {
+		r.History = append(r.History, &events.ReturnChange{From: string(h.From), To: string(h.To), At: h.At.UnixMilli(), Reason: h.Reason})
+	}
+	return r
+}
+
+// Ответ на ошибку операции с возвратом
+func returnErrorResponse(w http.ResponseWriter, err error) {
+	var lineErr *ReturnLineError
+	var terr *ReturnTransitionError
+	var invErr *InventoryError
+	switch {
+	case err == mongo.ErrNoDocuments:
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+	case err == ErrInvalidReturnLines:
+		ErrorResponse(w, http.StatusBadRequest, "Invalid return lines", err.Error())
+	case err == ErrNotReturnable:
+		ErrorResponse(w, http.StatusConflict, "Order cannot be returned", err.Error())
+	case errors.As(err, &lineErr):
+		ErrorResponse(w, http.StatusConflict, "Invalid return lines", err.Error())
+	case errors.As(err, &terr):
+		ErrorResponse(w, http.StatusConflict, "Illegal transition", err.Error())
+	case err == ErrReturnChanged || err == ErrReturnBusy:
+		ErrorResponse(w, http.StatusConflict, "Return was changed", "The return was changed by another request, try again.")
+	case errors.As(err, &invErr):
+		log.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The products could not be restocked, the return is not received.")
+	default:
+		InternalError(w, err)
+	}
+}
+
+func writeReturn(w http.ResponseWriter, status int, ret ReturnRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// Создать запрос на возврат по заказу
+func PostReturn(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Lines []ReturnLine `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must contain lines with item_id, quantity and reason.")
+		return
+	}
+	ret, err := RequestReturn(r.Context(), mux.Vars(r)["id"], Caller(r), req.Lines)
+	if err != nil {
+		returnErrorResponse(w, err)
+		return
+	}
+	PublishReturnEvent(EventReturnRequested, ret, "", CorrelationID(w, r))
+	writeReturn(w, http.StatusCreated, ret)
+}
+
+// Получить возвраты заказа
+func GetOrderReturns(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	order, err := FindId(id)
+	if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		returnErrorResponse(w, err)
+		return
+	}
+	returns, err := OrderReturns(r.Context(), id)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(returns)
+}
+
+// Получить возврат
+func GetReturn(w http.ResponseWriter, r *http.Request) {
+	ret, err := FindReturn(r.Context(), mux.Vars(r)["id"], Caller(r))
+	if err != nil {
+		returnErrorResponse(w, err)
+		return
+	}
+	writeReturn(w, http.StatusOK, ret)
+}
+
+// Обработать возврат: approve, reject, receive или refund. Доступно только сотрудникам.
+func PostReturnAction(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Returns are processed by staff only.")
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		Lines  []struct {
+			ItemID   string `json:"item_id"`
+			Accepted int    `json:"accepted"`
+		} `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body may contain a reason and, for receive, accepted quantities of lines.")
+		return
+	}
+	ctx, id := r.Context(), mux.Vars(r)["id"]
+	var ret ReturnRequest
+	var order *Order
+	var event string
+	var err error
+	switch mux.Vars(r)["action"] {
+	case "approve":
+		event = EventReturnApproved
+		ret, err = DecideReturn(ctx, id, ReturnApproved, req.Reason)
+	case "reject":
+		event = EventReturnRejected
+		ret, err = DecideReturn(ctx, id, ReturnRejected, req.Reason)
+	case "receive":
+		accepted := make(map[string]int)
+		for _, line := range req.Lines {
+			accepted[line.ItemID] = line.Accepted
+		}
+		event = EventReturnReceived
+		ret, err = ReceiveReturn(ctx, id, accepted, req.Reason)
+	case "refund":
+		event = EventReturnRefunded
+		ret, order, err = RefundReturn(ctx, id, req.Reason)
+	}
+	if err != nil {
+		returnErrorResponse(w, err)
+		return
+	}
+	correlationID := CorrelationID(w, r)
+	PublishReturnEvent(event, ret, "", correlationID)
+	if order != nil {
+		RecordStatusChange(*order, order.History[len(order.History)-1], Actor(r), correlationID)
+		PublishOrderEvent(EventOrderStatusChanged, *order, "Order "+order.ID+" returned", correlationID)
+	}
+	writeReturn(w, http.StatusOK, ret)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Коллекция с состояниями саг оформления заказа
+const SagaCollection = "sagas"
+
+const (
+	SagaInterval = 30 * time.Second // Период поиска незавершённых саг
+	SagaLease    = time.Minute      // Сага без изменений дольше этого времени считается брошенной
+)
+
+// Состояние саги
+type SagaState string
+
+const (
+	SagaRunning      SagaState = "running"
+	SagaCompensating SagaState = "compensating"
+	SagaCompleted    SagaState = "completed"
+	SagaFailed       SagaState = "failed"
+)
+
+// Последний выполненный шаг саги
+type SagaStep string
+
+const (
+	StepStarted   SagaStep = "started"   // сага сохранена, в Inventory ещё ничего не сделано
+	StepReserved  SagaStep = "reserved"  // резерв создан или проверен
+	StepInserted  SagaStep = "inserted"  // заказ сохранён в состоянии pending
+	StepCommitted SagaStep = "committed" // резерв списан со склада
+)
+
+// Сага оформления заказа. Состояние сохраняется после каждого шага, поэтому после
+// перезапуска сервиса сага продолжается с последнего выполненного шага.
+type PlacementSaga struct {
+	ID              string     `json:"id" bson:"_id"` //Код заказа
+	ReservationID   string     `json:"reservation_id" bson:"reservation_id"`
+	CustomerID      string     `json:"customer_id" bson:"customer_id"`
+	CorrelationID   string     `json:"correlation_id,omitempty" bson:"correlation_id,omitempty"`       //Передаётся в события заказа
+	Actor           string     `json:"actor,omitempty" bson:"actor,omitempty"`                         //Исполнитель запроса, записывается в историю заказа
+	ReservedByOther bool       `json:"reserved_by_other,omitempty" bson:"reserved_by_other,omitempty"` //Резерв принадлежит другому заказу, компенсация его не снимает
+	Lines           []Products `json:"lines"`
+	Step            SagaStep   `json:"step"`
+	State           SagaState  `json:"state"`
+	Error           string     `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" bson:"updated_at"`
+}
+
+// Вызовы Inventory, которые выполняет сага. Все вызовы повторяемы: повторный резерв с тем же
+// кодом возвращает существующий резерв, повторное списание или снятие ничего не меняет.
+type StockService interface {
+	Reserve(ctx context.Context, reservationID string, lines []Products) error
+	Price(ctx context.Context, lines []Products) error
+	Commit(ctx context.Context, reservationID string) error
+	Release(ctx context.Context, reservationID string) error
+}
+
+// Хранилище саг и заказов
+type PlacementStore interface {
+	SaveSaga(ctx context.Context, saga *PlacementSaga) error
+	// Незавершённые саги, которые не изменялись с момента before
+	StaleSagas(ctx context.Context, before time.Time) ([]PlacementSaga, error)
+	// Захват брошенной саги: updated_at меняется на now, только если он всё ещё равен
+	// прочитанному seen. false - сагу уже захватил другой экземпляр сервиса.
+	ClaimSaga(ctx context.Context, id string, seen, now time.Time) (bool, error)
+	// Повторное сохранение заказа с тем же кодом не считается ошибкой,
+	// заказ с резервом другого заказа - ErrReservationUsed
+	InsertOrder(ctx context.Context, order Order) error
+	// Смена состояния заказа, только если он в состоянии change.From, иначе ErrStatusChanged
+	ChangeStatus(ctx context.Context, id string, change StatusChange) error
+	FindOrder(ctx context.Context, id string) (Order, error)
+}
+
+// Резерв уже использован другим заказом
+var ErrReservationUsed = errors.New("reservation is already used by another order")
+
+// Оформление заказа не завершено: заказ сохранён, но резерв не удалось списать или
+// подтвердить заказ. Сага будет продолжена в фоне.
+type PendingError struct {
+	OrderID string
+	Err     error
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("order %s is pending: %v", e.OrderID, e.Err)
+}
+func (e *PendingError) Unwrap() error {
+	return e.Err
+}
+
+// Оркестратор саги оформления заказа
+type Placement struct {
+	Stock  StockService
+	Store  PlacementStore
+	Events EventPublisher
+	Audit  AuditLog
+	Now    func() time.Time
+}
+
+var placement = &Placement{Stock: grpcStock{}, Store: mongoPlacementStore{}, Events: kafkaEvents{}, Audit: mongoAuditLog{}, Now: time.Now}
+
+func NewOrderID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// Оформление заказа по строкам корзины, actor - исполнитель запроса
+func (p *Placement) Place(ctx context.Context, cart Cart, actor, correlationID string) (Order, error) {
+	lines, err := mergeLines(cart.Products)
+	if err != nil {
+		return Order{}, err
+	}
+	now := p.Now().UTC()
+	saga := &PlacementSaga{
+		ID:            NewOrderID(),
+		ReservationID: cart.ReservationID,
+		CustomerID:    cart.CustomerID,
+		CorrelationID: correlationID,
+		Actor:         actor,
+		Lines:         lines,
+		Step:          StepStarted,
+		State:         SagaRunning,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if saga.ReservationID == "" {
+		saga.ReservationID = NewReservationID()
+	}
+	if err := p.Store.SaveSaga(ctx, saga); err != nil {
+		return Order{}, err
+	}
+	return p.Run(ctx, saga)
+}
+
+// Выполнение саги с последнего сохранённого шага.
+// До списания резерва любая ошибка приводит к компенсации. Списание - точка невозврата:
+// после него (и при ошибке связи во время списания, когда неизвестно, прошло ли оно) сага
+// только повторяет шаги вперёд. Если резерв за это время истёк, Inventory отклонит списание
+// и заказ будет компенсирован.
+func (p *Placement) Run(ctx context.Context, saga *PlacementSaga) (Order, error) {
+	var order Order
+	for saga.State == SagaRunning {
+		var err error
+		next := saga.Step
+		switch saga.Step {
+		case StepStarted:
+			err = p.Stock.Reserve(ctx, saga.ReservationID, saga.Lines)
+			next = StepReserved
+		case StepReserved:
+			order, err = p.newOrder(ctx, saga)
+			if err == nil {
+				err = p.Store.InsertOrder(ctx, order)
+			}
+			next = StepInserted
+		case StepInserted:
+			err = p.Stock.Commit(ctx, saga.ReservationID)
+			next = StepCommitted
+		case StepCommitted:
+			change := StatusChange{From: lifecycle.Pending, To: lifecycle.Created, At: p.Now().UTC()}
+			err = p.Store.ChangeStatus(ctx, saga.ID, change)
+			if err == ErrStatusChanged {
+				err = nil // Заказ подтверждён до перезапуска
+			}
+			if err == nil {
+				order, err = p.createdOrder(ctx, saga, order, change)
+			}
+			if err == nil {
+				saga.State = SagaCompleted
+			}
+		default:
+			err = fmt.Errorf("unknown saga step %q", saga.Step)
+		}
+		if err != nil {
+			var stockErr *StockError
+			if saga.Step == StepCommitted || (saga.Step == StepInserted && !errors.As(err, &stockErr)) {
+				saga.Error = err.Error()
+				if saveErr := p.save(ctx, saga); saveErr != nil {
+					log.Printf("saga %s: %v\n", saga.ID, saveErr)
+				}
+				return order, &PendingError{OrderID: saga.ID, Err: err}
+			}
+			saga.State = SagaCompensating
+			saga.Error = err.Error()
+			saga.ReservedByOther = errors.Is(err, ErrReservationUsed)
+			if compErr := p.Compensate(ctx, saga); compErr != nil {
+				log.Printf("saga %s is not compensated: %v\n", saga.ID, compErr)
+			}
+			return Order{}, err
+		}
+		saga.Step = next
+		saga.Error = ""
+		if err := p.save(ctx, saga); err != nil {
+			if saga.Step == StepCommitted {
+				// После списания сага идёт только вперёд, незаписанные шаги повторятся при возобновлении
+				log.Printf("saga %s: %v\n", saga.ID, err)
+				continue
+			}
+			saga.State = SagaCompensating
+			saga.Error = err.Error()
+			if compErr := p.Compensate(ctx, saga); compErr != nil {
+				log.Printf("saga %s is not compensated: %v\n", saga.ID, compErr)
+			}
+			return Order{}, err
+		}
+	}
+	return order, nil
+}
+
+// Компенсация: резерв снимается, сохранённый заказ переводится в failed. Если шаг не удался,
+// сага остаётся в состоянии compensating и компенсируется повторно при возобновлении.
+func (p *Placement) Compensate(ctx context.Context, saga *PlacementSaga) error {
+	if err := p.save(ctx, saga); err != nil {
+		return err
+	}
+	if !saga.ReservedByOther {
+		if err := p.Stock.Release(ctx, saga.ReservationID); err != nil {
+			return err
+		}
+	}
+	// Заказ мог быть сохранён, даже если запись завершилась ошибкой
+	if saga.Step == StepReserved || saga.Step == StepInserted {
+		change := StatusChange{From: lifecycle.Pending, To: lifecycle.Failed, At: p.Now().UTC(), Reason: saga.Error}
+		err := p.Store.ChangeStatus(ctx, saga.ID, change)
+		if err != nil && err != ErrStatusChanged {
+			return err
+		}
+		if order, err := p.Store.FindOrder(ctx, saga.ID); err == nil && order.Status == lifecycle.Failed {
+			entry := StatusAuditEntry(order, order.History[len(order.History)-1], ActorSystem, saga.CorrelationID)
+			entry.ID = saga.ID + ":" + string(lifecycle.Failed)
+			if err := p.Audit.Record(ctx, entry); err != nil {
+				log.Printf("history of order %s: %v\n", saga.ID, err)
+			}
+		}
+	}
+	saga.State = SagaFailed
+	return p.save(ctx, saga)
+}
+
+// Продолжение брошенных саг, например после падения сервиса. Сагу продолжает только тот
+// экземпляр сервиса, который первым её захватил; для остальных она снова брошенная
+// не раньше, чем через SagaLease.
+func (p *Placement) Resume(ctx context.Context, before time.Time) error {
+	sagas, err := p.Store.StaleSagas(ctx, before)
+	if err != nil {
+		return err
+	}
+	for i := range sagas {
+		saga := &sagas[i]
+		now := p.Now().UTC()
+		claimed, err := p.Store.ClaimSaga(ctx, saga.ID, saga.UpdatedAt, now)
+		if err != nil {
+			log.Printf("saga %s: %v\n", saga.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		saga.UpdatedAt = now
+		log.Printf("saga %s resumed: %s at step %s\n", saga.ID, saga.State, saga.Step)
+		if saga.State == SagaCompensating {
+			if err := p.Compensate(ctx, saga); err != nil {
+				log.Printf("saga %s is not compensated: %v\n", saga.ID, err)
+			}
+			continue
+		}
+		if _, err := p.Run(ctx, saga); err != nil {
+			log.Printf("saga %s: %v\n", saga.ID, err)
+		}
+	}
+	return nil
+}
+
+func (p *Placement) save(ctx context.Context, saga *PlacementSaga) error {
+	saga.UpdatedAt = p.Now().UTC()
+	return p.Store.SaveSaga(ctx, saga)
+}
+
+// Подтверждённый заказ: о нём публикуется OrderCreated. Если сага продолжена после
+// перезапуска, заказ читается из хранилища.
+func (p *Placement) createdOrder(ctx context.Context, saga *PlacementSaga, order Order, change StatusChange) (Order, error) {
+	if order.ID == "" {
+		var err error
+		if order, err = p.Store.FindOrder(ctx, saga.ID); err != nil {
+			return Order{}, err
+		}
+	} else {
+		order.Status = lifecycle.Created
+		order.History = append(order.History, change)
+	}
+	// Код записи постоянный, поэтому повтор после перезапуска не дублирует её
+	entry, err := NewAuditEntry(AuditCreate, nil, &order, saga.Actor, "", saga.CorrelationID)
+	if err == nil {
+		entry.ID = saga.ID + ":" + AuditCreate
+		err = p.Audit.Record(ctx, entry)
+	}
+	if err != nil {
+		log.Printf("history of order %s: %v\n", saga.ID, err)
+	}
+	p.Events.Publish(EventOrderCreated, order, "", saga.CorrelationID)
+	return order, nil
+}
+
+// Заказ в состоянии pending с текущими ценами и итогами
+func (p *Placement) newOrder(ctx context.Context, saga *PlacementSaga) (Order, error) {
+	lines := append([]Products(nil), saga.Lines...)
+	if err := p.Stock.Price(ctx, lines); err != nil {
+		return Order{}, err
+	}
+	now := p.Now().UTC().Truncate(time.Millisecond) // Точность даты в MongoDB
+	order := Order{
+		ID:            saga.ID,
+		Data:          now,
+		CustomerID:    saga.CustomerID,
+		Status:        lifecycle.Pending,
+		History:       []StatusChange{{To: lifecycle.Pending, At: now}},
+		Product:       lines,
+		ReservationID: saga.ReservationID,
+	}
+	if err := ApplyTotals(&order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// Периодическое продолжение брошенных саг
+func ResumeSagas(interval time.Duration) {
+	for {
+		if err := placement.Resume(context.Background(), time.Now().UTC().Add(-SagaLease)); err != nil {
+			log.Println(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// StockService через gRPC клиент Inventory
+type grpcStock struct{}
+
+func (grpcStock) Reserve(ctx context.Context, reservationID string, lines []Products) error {
+	reply, err := ReserveLines(ctx, reservationID, lines)
+	if err != nil {
+		return err
+	}
+	if stockErr := CheckReservation(reply, lines); stockErr != nil {
+		return stockErr
+	}
+	return nil
+}
+func (grpcStock) Price(ctx context.Context, lines []Products) error {
+	return PriceLines(ctx, nil, lines)
+}
+func (grpcStock) Commit(ctx context.Context, reservationID string) error {
+	return CommitLines(ctx, reservationID)
+}
+func (grpcStock) Release(ctx context.Context, reservationID string) error {
+	return ReleaseLines(ctx, reservationID)
+}
+
+// PlacementStore в MongoDB
+type mongoPlacementStore struct{}
+
+func (mongoPlacementStore) SaveSaga(ctx context.Context, saga *PlacementSaga) error {
+	collection := client.Database(DataBaseName).Collection(SagaCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": saga.ID}, saga, options.Replace().SetUpsert(true))
+	return err
+}
+func (mongoPlacementStore) StaleSagas(ctx context.Context, before time.Time) ([]PlacementSaga, error) {
+	collection := client.Database(DataBaseName).Collection(SagaCollection)
+	cur, err := collection.Find(ctx, bson.M{
+		"state":      bson.M{"$in": []SagaState{SagaRunning, SagaCompensating}},
+		"updated_at": bson.M{"$lt": before},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var sagas []PlacementSaga
+	if err := cur.All(ctx, &sagas); err != nil {
+		return nil, err
+	}
+	return sagas, nil
+}
+func (mongoPlacementStore) ClaimSaga(ctx context.Context, id string, seen, now time.Time) (bool, error) {
+	collection := client.Database(DataBaseName).Collection(SagaCollection)
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "updated_at": seen, "state": bson.M{"$in": []SagaState{SagaRunning, SagaCompensating}}},
+		bson.M{"$set": bson.M{"updated_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+func (mongoPlacementStore) InsertOrder(ctx context.Context, order Order) error {
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	_, err := collection.InsertOne(ctx, order)
+	if mongo.IsDuplicateKeyError(err) {
+		// Повтор сохранения того же заказа или чужой заказ с тем же резервом
+		err = collection.FindOne(ctx, bson.M{"_id": order.ID}).Err()
+		if err == mongo.ErrNoDocuments {
+			return ErrReservationUsed
+		}
+	}
+	return err
+}
+func (mongoPlacementStore) ChangeStatus(ctx context.Context, id string, change StatusChange) error {
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": change.From},
+		bson.M{"$set": bson.M{"status": change.To}, "$push": bson.M{"history": change}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrStatusChanged
+	}
+	return nil
+}
+func (mongoPlacementStore) FindOrder(ctx context.Context, id string) (Order, error) {
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	var order Order
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&order)
+	return order, err
+}
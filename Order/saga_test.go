@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"github.com/ALbikov-R/4ServicesGRPC/money"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Резервы Inventory в памяти. fail - ошибки, которые возвращают вызовы по имени.
+type fakeStock struct {
+	reservations map[string]string //Код резерва -> active, committed или released
+	fail         map[string]error
+	calls        []string
+}
+
+func newFakeStock() *fakeStock {
+	return &fakeStock{reservations: map[string]string{}, fail: map[string]error{}}
+}
+
+func (s *fakeStock) Reserve(ctx context.Context, reservationID string, lines []Products) error {
+	s.calls = append(s.calls, "reserve")
+	if err := s.fail["reserve"]; err != nil {
+		return err
+	}
+	if status, ok := s.reservations[reservationID]; ok && status != reservationActive {
+		return &StockError{Lines: []StockLine{{Message: "reservation is " + status}}}
+	}
+	s.reservations[reservationID] = reservationActive
+	return nil
+}
+func (s *fakeStock) Price(ctx context.Context, lines []Products) error {
+	s.calls = append(s.calls, "price")
+	if err := s.fail["price"]; err != nil {
+		return err
+	}
+	for i := range lines {
+		lines[i].Price = money.Money{Amount: 10000, Currency: "RUB"}
+	}
+	return nil
+}
+func (s *fakeStock) Commit(ctx context.Context, reservationID string) error {
+	s.calls = append(s.calls, "commit")
+	if err := s.fail["commit"]; err != nil {
+		return err
+	}
+	switch s.reservations[reservationID] {
+	case reservationActive, reservationCommitted:
+		s.reservations[reservationID] = reservationCommitted
+		return nil
+	}
+	return &StockError{Lines: []StockLine{{Message: "reservation " + reservationID + " is closed"}}}
+}
+func (s *fakeStock) Release(ctx context.Context, reservationID string) error {
+	s.calls = append(s.calls, "release")
+	if err := s.fail["release"]; err != nil {
+		return err
+	}
+	if s.reservations[reservationID] == reservationActive {
+		s.reservations[reservationID] = reservationReleased
+	}
+	return nil
+}
+
+// Статусы резерва в fakeStock, как в Inventory
+const (
+	reservationActive    = "active"
+	reservationCommitted = "committed"
+	reservationReleased  = "released"
+)
+
+// Саги и заказы в памяти
+type fakeStore struct {
+	sagas        map[string]PlacementSaga
+	orders       map[string]Order
+	fail         map[string]error
+	storeOnError bool            //Заказ сохраняется, хотя InsertOrder возвращает ошибку
+	stale        []PlacementSaga //Если задано, StaleSagas возвращает этот список, прочитанный раньше
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{sagas: map[string]PlacementSaga{}, orders: map[string]Order{}, fail: map[string]error{}}
+}
+
+func (s *fakeStore) SaveSaga(ctx context.Context, saga *PlacementSaga) error {
+	if err := s.fail["save"]; err != nil {
+		return err
+	}
+	saved := *saga
+	saved.Lines = append([]Products(nil), saga.Lines...)
+	s.sagas[saga.ID] = saved
+	return nil
+}
+func (s *fakeStore) StaleSagas(ctx context.Context, before time.Time) ([]PlacementSaga, error) {
+	if s.stale != nil {
+		return s.stale, nil
+	}
+	var sagas []PlacementSaga
+	for _, saga := range s.sagas {
+		if (saga.State == SagaRunning || saga.State == SagaCompensating) && saga.UpdatedAt.Before(before) {
+			sagas = append(sagas, saga)
+		}
+	}
+	return sagas, nil
+}
+func (s *fakeStore) ClaimSaga(ctx context.Context, id string, seen, now time.Time) (bool, error) {
+	saga, ok := s.sagas[id]
+	if !ok || !saga.UpdatedAt.Equal(seen) || (saga.State != SagaRunning && saga.State != SagaCompensating) {
+		return false, nil
+	}
+	saga.UpdatedAt = now
+	s.sagas[id] = saga
+	return true, nil
+}
+func (s *fakeStore) InsertOrder(ctx context.Context, order Order) error {
+	if err := s.fail["insert"]; err != nil {
+		if s.storeOnError {
+			s.orders[order.ID] = order
+		}
+		return err
+	}
+	if _, ok := s.orders[order.ID]; ok {
+		return nil
+	}
+	for _, other := range s.orders {
+		if other.ReservationID == order.ReservationID {
+			return ErrReservationUsed
+		}
+	}
+	s.orders[order.ID] = order
+	return nil
+}
+func (s *fakeStore) ChangeStatus(ctx context.Context, id string, change StatusChange) error {
+	order, ok := s.orders[id]
+	if !ok || order.Status != change.From {
+		return ErrStatusChanged
+	}
+	order.Status = change.To
+	order.History = append(order.History, change)
+	s.orders[id] = order
+	return nil
+}
+func (s *fakeStore) FindOrder(ctx context.Context, id string) (Order, error) {
+	order, ok := s.orders[id]
+	if !ok {
+		return Order{}, mongo.ErrNoDocuments
+	}
+	return order, nil
+}
+
+type fakeEvents struct {
+	published []string
+}
+
+func (e *fakeEvents) Publish(event string, order Order, description, correlationID string) {
+	e.published = append(e.published, event+" "+order.ID)
+}
+
+type fakeAudit struct {
+	entries map[string]AuditEntry
+}
+
+func (a *fakeAudit) Record(ctx context.Context, entry AuditEntry) error {
+	a.entries[entry.ID] = entry
+	return nil
+}
+
+type sagaFixture struct {
+	stock  *fakeStock
+	store  *fakeStore
+	events *fakeEvents
+	audit  *fakeAudit
+	now    time.Time
+	p      *Placement
+}
+
+func newSagaFixture() *sagaFixture {
+	f := &sagaFixture{
+		stock:  newFakeStock(),
+		store:  newFakeStore(),
+		events: &fakeEvents{},
+		audit:  &fakeAudit{entries: map[string]AuditEntry{}},
+		now:    time.Date(2024, 3, 16, 21, 50, 29, 0, time.UTC),
+	}
+	f.p = &Placement{Stock: f.stock, Store: f.store, Events: f.events, Audit: f.audit, Now: func() time.Time { return f.now }}
+	return f
+}
+
+func testCart() Cart {
+	return Cart{
+		Products:      []Products{{ItemID: "1", Quantity: 2}, {ItemID: "2", Quantity: 1}, {ItemID: "1", Quantity: 1}},
+		ReservationID: "res-1",
+		CustomerID:    "c1",
+	}
+}
+
+// Сохранённая сага единственного заказа
+func (f *sagaFixture) saga(t *testing.T) PlacementSaga {
+	t.Helper()
+	if len(f.store.sagas) != 1 {
+		t.Fatalf("sagas = %d, want 1", len(f.store.sagas))
+	}
+	for _, saga := range f.store.sagas {
+		return saga
+	}
+	return PlacementSaga{}
+}
+
+func TestPlaceCompletes(t *testing.T) {
+	f := newSagaFixture()
+	order, err := f.p.Place(context.Background(), testCart(), "customer:c1", "corr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != lifecycle.Created {
+		t.Errorf("status = %s, want created", order.Status)
+	}
+	if len(order.Product) != 2 || order.Product[0].Quantity != 3 {
+		t.Errorf("lines = %+v, want merged item 1 x3 and item 2 x1", order.Product)
+	}
+	if order.Totals.Subtotal != 40000 {
+		t.Errorf("subtotal = %d, want 40000", order.Totals.Subtotal)
+	}
+	if got := f.stock.reservations["res-1"]; got != reservationCommitted {
+		t.Errorf("reservation = %s, want committed", got)
+	}
+	if got := f.store.orders[order.ID].Status; got != lifecycle.Created {
+		t.Errorf("stored status = %s, want created", got)
+	}
+	if saga := f.saga(t); saga.State != SagaCompleted || saga.Step != StepCommitted {
+		t.Errorf("saga = %s at %s, want completed at committed", saga.State, saga.Step)
+	}
+	if len(f.events.published) != 1 || f.events.published[0] != EventOrderCreated+" "+order.ID {
+		t.Errorf("events = %v", f.events.published)
+	}
+	if entry, ok := f.audit.entries[order.ID+":"+AuditCreate]; !ok || entry.Actor != "customer:c1" {
+		t.Errorf("create entry = %+v", entry)
+	}
+}
+
+func TestPlaceCompensates(t *testing.T) {
+	tests := []struct {
+		name         string
+		step         string //Вызов, который не удался
+		err          error
+		storeOnError bool
+		failedOrder  bool //Сохранённый заказ переводится в failed
+	}{
+		{name: "reserve", step: "reserve", err: &StockError{}},
+		{name: "reserve unavailable", step: "reserve", err: &InventoryError{errors.New("unavailable")}},
+		{name: "price", step: "price", err: &InventoryError{errors.New("unavailable")}},
+		{name: "insert", step: "insert", err: errors.New("write failed")},
+		{name: "insert stored", step: "insert", err: errors.New("write timeout"), storeOnError: true, failedOrder: true},
+		{name: "commit rejected", step: "commit", err: &StockError{}, failedOrder: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSagaFixture()
+			f.stock.fail[tt.step] = tt.err
+			f.store.fail[tt.step] = tt.err
+			f.store.storeOnError = tt.storeOnError
+			_, err := f.p.Place(context.Background(), testCart(), ActorSystem, "")
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			saga := f.saga(t)
+			if saga.State != SagaFailed || saga.Error != tt.err.Error() {
+				t.Errorf("saga = %s (%s), want failed", saga.State, saga.Error)
+			}
+			if got := f.stock.calls[len(f.stock.calls)-1]; got != "release" {
+				t.Errorf("last stock call = %s, want release", got)
+			}
+			if got := f.stock.reservations["res-1"]; got == reservationActive || got == reservationCommitted {
+				t.Errorf("reservation = %s, want released", got)
+			}
+			order, found := f.store.orders[saga.ID]
+			if found != tt.failedOrder {
+				t.Fatalf("order stored = %v, want %v", found, tt.failedOrder)
+			}
+			if !found {
+				return
+			}
+			last := order.History[len(order.History)-1]
+			if order.Status != lifecycle.Failed || last.Reason != tt.err.Error() {
+				t.Errorf("order = %s (%s), want failed", order.Status, last.Reason)
+			}
+			if _, ok := f.audit.entries[saga.ID+":"+string(lifecycle.Failed)]; !ok {
+				t.Error("failed status is not recorded in history")
+			}
+			if len(f.events.published) != 0 {
+				t.Errorf("events = %v, want none", f.events.published)
+			}
+		})
+	}
+}
+
+// Ошибка связи при списании: неизвестно, списан ли резерв, поэтому сага не компенсируется
+func TestPlaceCommitUnavailableIsPending(t *testing.T) {
+	f := newSagaFixture()
+	f.stock.fail["commit"] = &InventoryError{errors.New("unavailable")}
+	order, err := f.p.Place(context.Background(), testCart(), ActorSystem, "")
+	var pendErr *PendingError
+	if !errors.As(err, &pendErr) {
+		t.Fatalf("err = %v, want PendingError", err)
+	}
+	if order.Status != lifecycle.Pending || f.store.orders[order.ID].Status != lifecycle.Pending {
+		t.Errorf("status = %s, want pending", order.Status)
+	}
+	if saga := f.saga(t); saga.State != SagaRunning || saga.Step != StepInserted {
+		t.Errorf("saga = %s at %s, want running at inserted", saga.State, saga.Step)
+	}
+	if got := f.stock.reservations["res-1"]; got != reservationActive {
+		t.Errorf("reservation = %s, want active", got)
+	}
+
+	// Inventory снова доступен: сага продолжается в фоне
+	delete(f.stock.fail, "commit")
+	f.now = f.now.Add(2 * SagaLease)
+	if err := f.p.Resume(context.Background(), f.now.Add(-SagaLease)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.store.orders[order.ID].Status; got != lifecycle.Created {
+		t.Errorf("status after resume = %s, want created", got)
+	}
+}
+
+// Резерв уже списан для другого заказа: сага компенсируется, чужой резерв не снимается
+func TestPlaceReservationUsed(t *testing.T) {
+	f := newSagaFixture()
+	f.store.orders["other"] = Order{ID: "other", ReservationID: "res-1", Status: lifecycle.Pending}
+	f.stock.reservations["res-1"] = reservationActive
+	_, err := f.p.Place(context.Background(), testCart(), ActorSystem, "")
+	if err != ErrReservationUsed {
+		t.Fatalf("err = %v, want ErrReservationUsed", err)
+	}
+	if saga := f.saga(t); saga.State != SagaFailed || !saga.ReservedByOther {
+		t.Errorf("saga = %+v, want failed with reservation of another order", saga)
+	}
+	for _, call := range f.stock.calls {
+		if call == "release" {
+			t.Error("reservation of another order is released")
+		}
+	}
+	if got := f.stock.reservations["res-1"]; got != reservationActive {
+		t.Errorf("reservation = %s, want active", got)
+	}
+}
+
+// Повтор оформления с уже списанным резервом отклоняется
+func TestPlaceCommittedReservation(t *testing.T) {
+	f := newSagaFixture()
+	f.stock.reservations["res-1"] = reservationCommitted
+	_, err := f.p.Place(context.Background(), testCart(), ActorSystem, "")
+	var stockErr *StockError
+	if !errors.As(err, &stockErr) {
+		t.Fatalf("err = %v, want StockError", err)
+	}
+	if len(f.store.orders) != 0 {
+		t.Errorf("orders = %d, want none", len(f.store.orders))
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		step  SagaStep
+		state SagaState
+		setup func(f *sagaFixture, saga PlacementSaga)
+		want  lifecycle.Status //Состояние заказа после продолжения, "" - заказа нет
+	}{
+		{step: StepStarted, state: SagaRunning, want: lifecycle.Created},
+		{step: StepReserved, state: SagaRunning, want: lifecycle.Created, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationActive
+		}},
+		{step: StepInserted, state: SagaRunning, want: lifecycle.Created, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationActive
+			f.store.orders[saga.ID] = pendingOrder(f, saga)
+		}},
+		{step: StepCommitted, state: SagaRunning, want: lifecycle.Created, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationCommitted
+			f.store.orders[saga.ID] = pendingOrder(f, saga)
+		}},
+		// Заказ подтверждён, но сага не успела сохранить завершение
+		{step: StepCommitted, state: SagaRunning, want: lifecycle.Created, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationCommitted
+			order := pendingOrder(f, saga)
+			order.Status = lifecycle.Created
+			order.History = append(order.History, StatusChange{From: lifecycle.Pending, To: lifecycle.Created, At: f.now})
+			f.store.orders[saga.ID] = order
+		}},
+		// Резерв истёк, пока сага стояла: списание отклонено, заказ компенсируется
+		{step: StepInserted, state: SagaRunning, want: lifecycle.Failed, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationReleased
+			f.store.orders[saga.ID] = pendingOrder(f, saga)
+		}},
+		{step: StepStarted, state: SagaCompensating, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationActive
+		}},
+		{step: StepReserved, state: SagaCompensating, want: lifecycle.Failed, setup: func(f *sagaFixture, saga PlacementSaga) {
+			f.stock.reservations[saga.ReservationID] = reservationActive
+			f.store.orders[saga.ID] = pendingOrder(f, saga)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.state)+" "+string(tt.step), func(t *testing.T) {
+			f := newSagaFixture()
+			saga := PlacementSaga{
+				ID:            "order-1",
+				ReservationID: "res-1",
+				CustomerID:    "c1",
+				Lines:         []Products{{ItemID: "1", Quantity: 2}},
+				Step:          tt.step,
+				State:         tt.state,
+				CreatedAt:     f.now,
+				UpdatedAt:     f.now,
+			}
+			f.store.sagas[saga.ID] = saga
+			if tt.setup != nil {
+				tt.setup(f, saga)
+			}
+			f.stock.calls = nil
+
+			// Сага изменялась недавно и ещё не считается брошенной
+			if err := f.p.Resume(context.Background(), f.now); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.stock.calls) != 0 {
+				t.Fatalf("fresh saga is resumed: %v", f.stock.calls)
+			}
+
+			f.now = f.now.Add(2 * SagaLease)
+			if err := f.p.Resume(context.Background(), f.now.Add(-SagaLease)); err != nil {
+				t.Fatal(err)
+			}
+			resumed := f.saga(t)
+			order, found := f.store.orders[saga.ID]
+			switch {
+			case tt.want == "" && found:
+				t.Errorf("order = %s, want none", order.Status)
+			case tt.want != "" && order.Status != tt.want:
+				t.Errorf("order = %s, want %s", order.Status, tt.want)
+			}
+			switch tt.want {
+			case lifecycle.Created:
+				if resumed.State != SagaCompleted {
+					t.Errorf("saga = %s, want completed", resumed.State)
+				}
+				if got := f.stock.reservations[saga.ReservationID]; got != reservationCommitted {
+					t.Errorf("reservation = %s, want committed", got)
+				}
+				if len(f.events.published) != 1 {
+					t.Errorf("events = %v, want OrderCreated", f.events.published)
+				}
+				if len(order.History) != 2 {
+					t.Errorf("history = %+v, want pending and created", order.History)
+				}
+			default:
+				if resumed.State != SagaFailed {
+					t.Errorf("saga = %s, want failed", resumed.State)
+				}
+				if got := f.stock.reservations[saga.ReservationID]; got == reservationActive || got == reservationCommitted {
+					t.Errorf("reservation = %s, want released", got)
+				}
+			}
+		})
+	}
+}
+
+// Два экземпляра сервиса нашли одну брошенную сагу: продолжает только захвативший её первым
+func TestResumeClaimed(t *testing.T) {
+	f := newSagaFixture()
+	saga := PlacementSaga{
+		ID:            "order-1",
+		ReservationID: "res-1",
+		CustomerID:    "c1",
+		Lines:         []Products{{ItemID: "1", Quantity: 2}},
+		Step:          StepInserted,
+		State:         SagaRunning,
+		CreatedAt:     f.now,
+		UpdatedAt:     f.now,
+	}
+	f.store.sagas[saga.ID] = saga
+	f.stock.reservations[saga.ReservationID] = reservationActive
+	f.store.orders[saga.ID] = pendingOrder(f, saga)
+	f.store.stale = []PlacementSaga{saga}
+	f.stock.calls = nil
+
+	f.now = f.now.Add(2 * SagaLease)
+	for i := 0; i < 2; i++ {
+		if err := f.p.Resume(context.Background(), f.now.Add(-SagaLease)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.stock.calls) != 1 || f.stock.calls[0] != "commit" {
+		t.Errorf("stock calls = %v, want one commit", f.stock.calls)
+	}
+	if len(f.events.published) != 1 {
+		t.Errorf("events = %v, want one OrderCreated", f.events.published)
+	}
+	if got := f.saga(t).State; got != SagaCompleted {
+		t.Errorf("saga = %s, want completed", got)
+	}
+}
+
+// Заказ, сохранённый сагой на шаге reserved
+func pendingOrder(f *sagaFixture, saga PlacementSaga) Order {
+	order, err := f.p.newOrder(context.Background(), &saga)
+	if err != nil {
+		panic(err)
+	}
+	return order
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ShipmentStatus string
+
+// Состояния отправления
+const (
+	ShipmentPending   ShipmentStatus = "pending" //Собрано, ещё не передано перевозчику
+	ShipmentShipped   ShipmentStatus = "shipped"
+	ShipmentDelivered ShipmentStatus = "delivered"
+	ShipmentCancelled ShipmentStatus = "cancelled"
+	ShipmentLost      ShipmentStatus = "lost"
+)
+
+// Допустимые переходы отправления. Строки отменённого или потерянного отправления
+// снова считаются неотправленными, их можно отправить другой посылкой.
+var shipmentTransitions = map[ShipmentStatus][]ShipmentStatus{
+	ShipmentPending:   {ShipmentShipped, ShipmentCancelled},
+	ShipmentShipped:   {ShipmentDelivered, ShipmentLost},
+	ShipmentDelivered: {},
+	ShipmentCancelled: {},
+	ShipmentLost:      {},
+}
+
+var (
+	ErrNotShippable         = errors.New("shipments can only be created for a paid, packed or shipped order")
+	ErrInvalidShipmentLines = errors.New("shipment must contain order products with quantity greater than zero")
+	ErrShipmentChanged      = errors.New("shipments of the order were changed concurrently")
+)
+
+// Строка отправления
+type ShipmentLine struct {
+	ItemID   string `json:"item_id" bson:"item_id"`
+	Quantity int    `json:"quantity" bson:"quantity"`
+}
+
+// Отправление (посылка) с частью строк заказа
+type Shipment struct {
+	ID             string         `json:"id" bson:"id"`
+	Carrier        string         `json:"carrier" bson:"carrier"`                                     //Перевозчик
+	TrackingNumber string         `json:"tracking_number,omitempty" bson:"tracking_number,omitempty"` //Номер для отслеживания
+	Status         ShipmentStatus `json:"status" bson:"status"`
+	Lines          []ShipmentLine `json:"lines" bson:"lines"`
+	CreatedAt      time.Time      `json:"created_at" bson:"created_at"`
+	ShippedAt      *time.Time     `json:"shipped_at,omitempty" bson:"shipped_at,omitempty"`
+	DeliveredAt    *time.Time     `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	Reason         string         `json:"reason,omitempty" bson:"reason,omitempty"` //Причина отмены или потери
+}
+
+// Изменение отправления, пустые поля не меняются
+type ShipmentUpdate struct {
+	Status         ShipmentStatus `json:"status"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	Reason         string         `json:"reason"`
+}
+
+// Ошибка в строке отправления
+type ShipmentLineError struct {
+	ItemID  string
+	Message string
+}
+
+func (e *ShipmentLineError) Error() string {
+	return fmt.Sprintf("item %s: %s", e.ItemID, e.Message)
+}
+
+// Недопустимый переход отправления
+type ShipmentTransitionError struct {
+	From ShipmentStatus
+	To   ShipmentStatus
+}
+
+func (e *ShipmentTransitionError) Error() string {
+	return fmt.Sprintf("shipment cannot move from %s to %s", e.From, e.To)
+}
+
+// Отправления создаются для оплаченного заказа; после отгрузки заказа - взамен потерянных
+func Shippable(s lifecycle.Status) bool {
+	return s == lifecycle.Paid || s == lifecycle.Packed || s == lifecycle.Shipped
+}
+
+// Количество предметов в отправлениях в состояниях statuses
+func shippedQuantities(shipments []Shipment, statuses ...ShipmentStatus) map[string]int {
+	res := make(map[string]int)
+	for _, s := range shipments {
+		for _, st := range statuses {
+			if s.Status == st {
+				for _, line := range s.Lines {
+					res[line.ItemID] += line.Quantity
+				}
+			}
+		}
+	}
+	return res
+}
+
+// Все строки заказа покрыты количествами covered
+func covers(order Order, covered map[string]int) bool {
+	for _, p := range order.Product {
+		if covered[p.ItemID] < p.Quantity {
+			return false
+		}
+	}
+	return len(order.Product) > 0
+}
+
+// Состояние заказа по отправлениям: shipped, когда отправлены все строки, delivered,
+// когда все доставлены, пустая строка - не все строки отправлены
+func ShipmentsStatus(order Order) lifecycle.Status {
+	if covers(order, shippedQuantities(order.Shipments, ShipmentDelivered)) {
+		return lifecycle.Delivered
+	}
+	if covers(order, shippedQuantities(order.Shipments, ShipmentShipped, ShipmentDelivered)) {
+		return lifecycle.Shipped
+	}
+	return ""
+}
+
+// Фильтр заказа, отправления которого не менялись с чтения: новые отправления
+// добавляются только в конец массива
+func shipmentsFilter(order Order) bson.M {
+	n := len(order.Shipments)
+	filter := bson.M{"_id": order.ID, "shipments." + strconv.Itoa(n): bson.M{"$exists": false}}
+	if n > 0 {
+		filter["shipments."+strconv.Itoa(n-1)+".id"] = order.Shipments[n-1].ID
+	}
+	return filter
+}
+
+// Новое отправление по строкам заказа. В отправления не может попасть больше заказанного:
+// учитываются все отправления, кроме отменённых и потерянных. Возвращает заказ до и после изменения.
+func CreateShipment(ctx context.Context, orderID string, s Shipment) (Order, Order, Shipment, error) {
+	if len(s.Lines) == 0 {
+		return Order{}, Order{}, Shipment{}, ErrInvalidShipmentLines
+	}
+	lines := make(map[string]int)
+	for _, line := range s.Lines {
+		if line.ItemID == "" || line.Quantity <= 0 || lines[line.ItemID] > 0 {
+			return Order{}, Order{}, Shipment{}, ErrInvalidShipmentLines
+		}
+		lines[line.ItemID] = line.Quantity
+	}
+	order, err := FindId(orderID)
+	if err != nil {
+		return Order{}, Order{}, Shipment{}, err
+	}
+	if !Shippable(order.Status) {
+		return order, order, Shipment{}, ErrNotShippable
+	}
+	ordered := make(map[string]int)
+	for _, p := range order.Product {
+		ordered[p.ItemID] += p.Quantity
+	}
+	used := shippedQuantities(order.Shipments, ShipmentPending, ShipmentShipped, ShipmentDelivered)
+	for _, line := range s.Lines {
+		left := ordered[line.ItemID] - used[line.ItemID]
+		switch {
+		case ordered[line.ItemID] == 0:
+			return order, order, Shipment{}, &ShipmentLineError{line.ItemID, "product is not in the order"}
+		case line.Quantity > left:
+			return order, order, Shipment{}, &ShipmentLineError{line.ItemID, fmt.Sprintf("only %d left to ship", left)}
+		}
+	}
+	s.ID = NewOrderID()
+	s.Status = ShipmentPending
+	s.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	s.ShippedAt, s.DeliveredAt, s.Reason = nil, nil, ""
+	res, err := client.Database(DataBaseName).Collection(CollectionName).UpdateOne(ctx,
+		shipmentsFilter(order), bson.M{"$push": bson.M{"shipments": s}})
+	if err != nil {
+		return order, order, Shipment{}, err
+	}
+	if res.MatchedCount == 0 {
+		return order, order, Shipment{}, ErrShipmentChanged
+	}
+	after := order
+	after.Shipments = append(append([]Shipment(nil), order.Shipments...), s)
+	return order, after, s, nil
+}
+
+// Изменение перевозчика, номера отслеживания или состояния отправления, moved - состояние
+// изменилось. Запись выполняется только если отправление всё ещё в прочитанном состоянии.
+// Возвращает заказ до и после изменения.
+func UpdateShipment(ctx context.Context, orderID, shipmentID string, upd ShipmentUpdate) (before, order Order, s Shipment, moved bool, err error) {
+	order, err = FindId(orderID)
+	if err != nil {
+		return Order{}, Order{}, Shipment{}, false, err
+	}
+	before = order
+	i := -1
+	for j, s := range order.Shipments {
+		if s.ID == shipmentID {
+			i = j
+		}
+	}
+	if i < 0 {
+		return order, order, Shipment{}, false, mongo.ErrNoDocuments
+	}
+	s = order.Shipments[i]
+	set := bson.M{}
+	if upd.Carrier != "" {
+		s.Carrier = upd.Carrier
+		set["shipments.$.carrier"] = s.Carrier
+	}
+	if upd.TrackingNumber != "" {
+		s.TrackingNumber = upd.TrackingNumber
+		set["shipments.$.tracking_number"] = s.TrackingNumber
+	}
+	if upd.Status != "" && upd.Status != s.Status {
+		if err := checkShipmentTransition(s.Status, upd.Status); err != nil {
+			return order, order, s, false, err
+		}
+		moved = true
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		switch upd.Status {
+		case ShipmentShipped:
+			s.ShippedAt = &now
+			set["shipments.$.shipped_at"] = now
+		case ShipmentDelivered:
+			s.DeliveredAt = &now
+			set["shipments.$.delivered_at"] = now
+		}
+		s.Status = upd.Status
+		set["shipments.$.status"] = s.Status
+		if upd.Reason != "" {
+			s.Reason = upd.Reason
+			set["shipments.$.reason"] = s.Reason
+		}
+	}
+	if len(set) == 0 {
+		return order, order, s, false, nil
+	}
+	res, err := client.Database(DataBaseName).Collection(CollectionName).UpdateOne(ctx,
+		bson.M{"_id": orderID, "shipments": bson.M{"$elemMatch": bson.M{"id": shipmentID, "status": order.Shipments[i].Status}}},
+		bson.M{"$set": set})
+	if err != nil {
+		return order, order, s, false, err
+	}
+	if res.MatchedCount == 0 {
+		return order, order, s, false, ErrShipmentChanged
+	}
+	order.Shipments = append([]Shipment(nil), order.Shipments...)
+	order.Shipments[i] = s
+	return before, order, s, moved, nil
+}
+
+func checkShipmentTransition(from, to ShipmentStatus) error {
+	for _, s := range shipmentTransitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return &ShipmentTransitionError{From: from, To: to}
+}
+
+// Перевод заказа в состояние по отправлениям. Заказ проходит все промежуточные состояния
+// (paid -> packed -> shipped -> delivered), каждый переход записывается в историю и публикуется событием.
+func SyncShipmentsStatus(order Order, reason, actor, correlationID string) Order {
+	target := ShipmentsStatus(order)
+	if target == "" {
+		return order
+	}
+	for _, next := range []lifecycle.Status{lifecycle.Packed, lifecycle.Shipped, lifecycle.Delivered} {
+		if order.Status == target {
+			break
+		}
+		if lifecycle.Check(order.Status, next) != nil {
+			continue
+		}
+		moved, change, err := TransitionOrder(order.ID, next, reason)
+		if err != nil {
+			log.Printf("order %s is not moved to %s: %v\n", order.ID, next, err)
+			break
+		}
+		order = moved
+		RecordStatusChange(order, change, actor, correlationID)
+		PublishOrderEvent(EventOrderStatusChanged, order, "Order "+order.ID+" "+string(change.From)+" -> "+string(change.To), correlationID)
+	}
+	return order
+}
+
+// Ответ на ошибку операции с отправлением
+func shipmentErrorResponse(w http.ResponseWriter, err error) {
+	var lineErr *ShipmentLineError
+	var terr *ShipmentTransitionError
+	switch {
+	case err == mongo.ErrNoDocuments:
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+	case err == ErrInvalidShipmentLines:
+		ErrorResponse(w, http.StatusBadRequest, "Invalid shipment lines", err.Error())
+	case err == ErrNotShippable:
+		ErrorResponse(w, http.StatusConflict, "Order cannot be shipped", err.Error())
+	case errors.As(err, &lineErr):
+		ErrorResponse(w, http.StatusConflict, "Invalid shipment lines", err.Error())
+	case errors.As(err, &terr):
+		ErrorResponse(w, http.StatusConflict, "Illegal transition", err.Error())
+	case err == ErrShipmentChanged:
+		ErrorResponse(w, http.StatusConflict, "Order was changed", "The shipments were changed by another request, try again.")
+	default:
+		InternalError(w, err)
+	}
+}
+
+// Создать отправление. Доступно только сотрудникам.
+func PostShipment(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Shipments are managed by staff only.")
+		return
+	}
+	var s Shipment
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Carrier == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must contain a carrier and lines with item_id and quantity.")
+		return
+	}
+	before, order, s, err := CreateShipment(r.Context(), mux.Vars(r)["id"], s)
+	if err != nil {
+		shipmentErrorResponse(w, err)
+		return
+	}
+	RecordAudit(AuditUpdate, &before, &order, Actor(r), r.Header.Get(ReasonHeader), CorrelationID(w, r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// Изменить отправление. Доступно только сотрудникам.
+func PatchShipment(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Shipments are managed by staff only.")
+		return
+	}
+	var upd ShipmentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body may contain status, carrier, tracking_number and reason.")
+		return
+	}
+	if _, ok := shipmentTransitions[upd.Status]; upd.Status != "" && !ok {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "status must be shipped, delivered, cancelled or lost.")
+		return
+	}
+	vars := mux.Vars(r)
+	before, order, s, moved, err := UpdateShipment(r.Context(), vars["id"], vars["shipment"], upd)
+	if err != nil {
+		shipmentErrorResponse(w, err)
+		return
+	}
+	correlationID := CorrelationID(w, r)
+	if !reflect.DeepEqual(before.Shipments, order.Shipments) {
+		reason := r.Header.Get(ReasonHeader)
+		if reason == "" {
+			reason = upd.Reason
+		}
+		RecordAudit(AuditUpdate, &before, &order, Actor(r), reason, correlationID)
+	}
+	if moved && (s.Status == ShipmentShipped || s.Status == ShipmentDelivered) {
+		description := "Shipment " + s.ID + " of order " + order.ID + " " + string(s.Status) + " by " + s.Carrier
+		if s.TrackingNumber != "" {
+			description += ", tracking number " + s.TrackingNumber
+		}
+		SendNotification(order.ID, "Shipment "+string(s.Status), description, correlationID)
+		SyncShipmentsStatus(order, "shipment "+s.ID+" "+string(s.Status), Actor(r), correlationID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s)
+}
+
+// Получить отправления заказа
+func GetShipments(w http.ResponseWriter, r *http.Request) {
+	order, err := FindId(mux.Vars(r)["id"])
+	if err == nil && Caller(r) != "" && order.CustomerID != Caller(r) {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		shipmentErrorResponse(w, err)
+		return
+	}
+	shipments := order.Shipments
+	if shipments == nil {
+		shipments = []Shipment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(shipments)
+}
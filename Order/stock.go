@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+// Время ожидания ответа Inventory на один вызов
+const GrpcTimeout = 5 * time.Second
+
+// Результат проверки остатка по строке заказа
+type StockLine struct {
+	ItemID    string `json:"item_id"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+	OK        bool   `json:"ok"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Заказ отклонён: по строкам указано, чего не хватает
+type StockError struct {
+	Lines []StockLine
+}
+
+func (e *StockError) Error() string {
+	return "not enough stock"
+}
+
+// Ошибка вызова Inventory
+type InventoryError struct {
+	Err error
+}
+
+func (e *InventoryError) Error() string {
+	return fmt.Sprintf("inventory: %v", e.Err)
+}
+func (e *InventoryError) Unwrap() error {
+	return e.Err
+}
+
+var ErrInvalidLines = errors.New("order must contain products with quantity greater than zero")
+
+func NewReservationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Строки заказа с объединёнными повторами одного продукта
+func mergeLines(prods []Products) ([]Products, error) {
+	var lines []Products
+	index := make(map[string]int)
+	for _, p := range prods {
+		if p.ItemID == "" || p.Quantity <= 0 {
+			return nil, ErrInvalidLines
+		}
+		if i, ok := index[p.ItemID]; ok {
+			lines[i].Quantity += p.Quantity
+			continue
+		}
+		index[p.ItemID] = len(lines)
+		lines = append(lines, p)
+	}
+	if len(lines) == 0 {
+		return nil, ErrInvalidLines
+	}
+	return lines, nil
+}
+
+// Резервирование строк заказа в Inventory. Если резерв с таким кодом уже создан
+// (например, Product зарезервировал корзину), Inventory возвращает его строки,
+// и они должны совпадать с заказанными.
+func ReserveLines(ctx context.Context, id string, lines []Products) (*pb.ReserveReply, error) {
+	req := &pb.ReserveRequest{ReservationId: id}
+	for _, line := range lines {
+		req.Items = append(req.Items, &pb.ReserveItem{Id: line.ItemID, Quantity: int32(line.Quantity)})
+	}
+	ctx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+	defer cancel()
+	reply, err := connect.client.ReserveStock(ctx, req)
+	if err != nil {
+		return nil, &InventoryError{err}
+	}
+	return reply, nil
+}
+
+// Проверка резерва по строкам заказа, nil - всех строк хватает
+func CheckReservation(reply *pb.ReserveReply, lines []Products) *StockError {
+	reserved := make(map[string]*pb.ReserveLine)
+	for _, line := range reply.GetLines() {
+		reserved[line.GetId()] = line
+	}
+	res := &StockError{}
+	ok := reply.GetFlag()
+	for _, line := range lines {
+		check := StockLine{ItemID: line.ItemID, Requested: line.Quantity}
+		r, found := reserved[line.ItemID]
+		switch {
+		case !found:
+			check.Message = "item is not reserved"
+		case int(r.GetRequested()) != line.Quantity && reply.GetFlag():
+			check.Available = int(r.GetRequested())
+			check.Message = "reserved quantity differs from ordered"
+		default:
+			check.Available = int(r.GetAvailable())
+			check.OK = r.GetOk()
+			check.Message = r.GetMessage()
+		}
+		ok = ok && check.OK
+		res.Lines = append(res.Lines, check)
+		delete(reserved, line.ItemID)
+	}
+	// В переданном резерве есть продукты, которых нет в заказе
+	for id, r := range reserved {
+		ok = false
+		res.Lines = append(res.Lines, StockLine{ItemID: id, Available: int(r.GetRequested()), Message: "reserved item is not in the order"})
+	}
+	if ok {
+		return nil
+	}
+	return res
+}
+
+// Списание зарезервированных предметов со склада
+func CommitLines(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+	defer cancel()
+	status, err := connect.client.CommitReservation(ctx, &pb.ReservationRequest{ReservationId: id})
+	if err != nil {
+		return &InventoryError{err}
+	}
+	if !status.GetFlag() {
+		return &StockError{Lines: []StockLine{{Message: "reservation " + id + ": " + status.GetMessage()}}}
+	}
+	return nil
+}
+
+// Снятие резерва, если заказ не создан. Отсутствующий или уже закрытый резерв снимать
+// нечего, поэтому ошибка возвращается только при недоступности Inventory.
+func ReleaseLines(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+	defer cancel()
+	status, err := connect.client.ReleaseReservation(ctx, &pb.ReservationRequest{ReservationId: id})
+	if err != nil {
+		return &InventoryError{err}
+	}
+	if !status.GetFlag() {
+		log.Printf("reservation %s is not released: %s\n", id, status.GetMessage())
+	}
+	return nil
+}
+
+// Возврат принятых предметов на склад. id - код пополнения, повторный вызов с ним
+// в Inventory ничего не меняет.
+func RestockLines(ctx context.Context, id string, lines []ReturnLine) error {
+	req := &pb.RestockRequest{RestockId: id}
+	for _, line := range lines {
+		if line.Accepted > 0 {
+			req.Items = append(req.Items, &pb.ReserveItem{Id: line.ItemID, Quantity: int32(line.Accepted)})
+		}
+	}
+	if len(req.Items) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+	defer cancel()
+	status, err := connect.client.RestockItems(ctx, req)
+	if err != nil {
+		return &InventoryError{err}
+	}
+	if !status.GetFlag() {
+		return &InventoryError{errors.New("restock " + id + ": " + status.GetMessage())}
+	}
+	return nil
+}
+
+// Возврат на склад предметов отменённого или удалённого заказа. Списаны со склада предметы
+// заказа в created, paid, packed и cancelled; возвращаются те из них, что не отправлены и не
+// потеряны перевозчиком. Код пополнения - код заказа, поэтому отмена и последующее удаление
+// того же заказа пополняют склад один раз.
+func RestockOrder(ctx context.Context, order Order) error {
+	switch order.Status {
+	case lifecycle.Created, lifecycle.Paid, lifecycle.Packed, lifecycle.Cancelled:
+	default:
+		return nil
+	}
+	sent := shippedQuantities(order.Shipments, ShipmentShipped, ShipmentDelivered, ShipmentLost)
+	var lines []ReturnLine
+	for _, p := range order.Product {
+		if left := p.Quantity - sent[p.ItemID]; left > 0 {
+			lines = append(lines, ReturnLine{ItemID: p.ItemID, Accepted: left})
+		}
+	}
+	return RestockLines(ctx, order.ID, lines)
+}
+
+// Ответ 409 с отчётом по строкам заказа
+func StockErrorResponse(w http.ResponseWriter, err *StockError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "Not enough stock",
+		"message": "Some products of the order are not available in the requested quantity.",
+		"lines":   err.Lines,
+	})
+}
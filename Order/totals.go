@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"testOrder/internal/pricing"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+	"github.com/ALbikov-R/4ServicesGRPC/money"
+)
+
+// Правила расчёта итогов заказа, загружаются из файла PRICING_CONFIG
+var priceRules = pricing.DefaultRules
+
+// Пересчёт сумм строк и итогов заказа
+func ApplyTotals(order *Order) error {
+	lines := make([]pricing.Line, len(order.Product))
+	for i, p := range order.Product {
+		lines[i] = pricing.Line{UnitPrice: p.Price.Amount, Currency: p.Price.Currency, Quantity: p.Quantity}
+	}
+	lineTotals, totals, err := pricing.Calculate(lines, priceRules)
+	if err != nil {
+		return err
+	}
+	for i := range order.Product {
+		order.Product[i].Total = money.Money{Amount: lineTotals[i], Currency: totals.Currency}
+	}
+	order.Totals = totals
+	return nil
+}
+
+// Цены единиц для строк заказа: у продуктов, которые уже есть в заказе (old), цена сохраняется,
+// для новых берётся текущая цена из Inventory
+func PriceLines(ctx context.Context, old []Products, lines []Products) error {
+	known := make(map[string]Products)
+	for _, p := range old {
+		known[p.ItemID] = p
+	}
+	for i := range lines {
+		if p, ok := known[lines[i].ItemID]; ok {
+			lines[i].Price = p.Price
+			if lines[i].Name == "" {
+				lines[i].Name = p.Name
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+		r, err := connect.client.GetProduct(ctx, &pb.IdRequest{Id: lines[i].ItemID})
+		cancel()
+		if err != nil {
+			return &InventoryError{err}
+		}
+		lines[i].Price = money.FromProto(r.GetProd().GetPrice())
+		if lines[i].Name == "" {
+			lines[i].Name = r.GetProd().GetName()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"testOrder/internal/lifecycle"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Переход заказа между состояниями
+type StatusChange struct {
+	From   lifecycle.Status `json:"from,omitempty" bson:"from,omitempty"`
+	To     lifecycle.Status `json:"to"`
+	At     time.Time        `json:"at"`
+	Reason string           `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// Тело POST /orders/{id}/transitions
+type TransitionRequest struct {
+	Status lifecycle.Status `json:"status"`
+	Reason string           `json:"reason"`
+}
+
+// Ответ 409 на недопустимый переход
+type TransitionErrorResponse struct {
+	Error   string             `json:"error"`
+	Message string             `json:"message"`
+	Status  lifecycle.Status   `json:"status"`
+	Allowed []lifecycle.Status `json:"allowed"`
+}
+
+// Состояние заказа изменилось между чтением и записью
+var ErrStatusChanged = errors.New("order status was changed concurrently")
+
+// Перевод заказа в состояние to. Запись выполняется только если заказ всё ещё в прочитанном
+// состоянии, поэтому два одновременных перехода не могут оба пройти проверку.
+// При отмене предметы заказа сначала возвращаются на склад: если Inventory недоступен,
+// заказ не отменяется, а повтор не пополнит склад дважды.
+func TransitionOrder(id string, to lifecycle.Status, reason string) (Order, StatusChange, error) {
+	order, err := FindId(id)
+	if err != nil {
+		return Order{}, StatusChange{}, err
+	}
+	if err := lifecycle.Check(order.Status, to); err != nil {
+		return order, StatusChange{}, err
+	}
+	if to == lifecycle.Cancelled {
+		if err := RestockOrder(context.TODO(), order); err != nil {
+			return order, StatusChange{}, err
+		}
+	}
+	change := StatusChange{From: order.Status, To: to, At: time.Now().UTC(), Reason: reason}
+	collection := client.Database(DataBaseName).Collection(CollectionName)
+	res, err := collection.UpdateOne(context.TODO(),
+		bson.M{"_id": id, "status": order.Status},
+		bson.M{"$set": bson.M{"status": to}, "$push": bson.M{"history": change}})
+	if err != nil {
+		return order, StatusChange{}, err
+	}
+	if res.MatchedCount == 0 {
+		return order, StatusChange{}, ErrStatusChanged
+	}
+	order.Status = to
+	order.History = append(order.History, change)
+	return order, change, nil
+}
+
+// Перевести заказ в другое состояние. Доступно только сотрудникам.
+func PostTransition(w http.ResponseWriter, r *http.Request) {
+	if Caller(r) != "" {
+		ErrorResponse(w, http.StatusForbidden, "Access denied", "Order status is changed by staff only.")
+		return
+	}
+	var req TransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !lifecycle.Valid(req.Status) || lifecycle.System(req.Status) {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body",
+			"The body must contain a status: paid, packed, shipped, delivered, cancelled or returned.")
+		return
+	}
+	order, change, err := TransitionOrder(mux.Vars(r)["id"], req.Status, req.Reason)
+	if err != nil {
+		var terr *lifecycle.TransitionError
+		var invErr *InventoryError
+		switch {
+		case err == mongo.ErrNoDocuments:
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		case errors.As(err, &terr):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(TransitionErrorResponse{
+				Error:   "Illegal transition",
+				Message: err.Error(),
+				Status:  order.Status,
+				Allowed: lifecycle.Allowed(order.Status),
+			})
+		case err == ErrStatusChanged:
+			ErrorResponse(w, http.StatusConflict, "Order was changed", "The order status was changed by another request, try again.")
+		case errors.As(err, &invErr):
+			log.Println(err)
+			ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The products could not be restocked, the order is not cancelled.")
+		default:
+			InternalError(w, err)
+		}
+		return
+	}
+	correlationID := CorrelationID(w, r)
+	RecordStatusChange(order, change, Actor(r), correlationID)
+	PublishOrderEvent(EventOrderStatusChanged, order, "Order "+order.ID+" "+string(change.From)+" -> "+string(change.To), correlationID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
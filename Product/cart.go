@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Заголовки, по которым определяется владелец корзины
+const (
+	CustomerHeader = "X-Customer-ID"
+	SessionHeader  = "X-Session-ID"
+)
+
+// Владелец корзины: покупатель, а для гостей - сессия
+func CartOwner(r *http.Request) string {
+	if owner := r.Header.Get(CustomerHeader); owner != "" {
+		return owner
+	}
+	return r.Header.Get(SessionHeader)
+}
+
+// Получить номер корзины владельца, при отсутствии корзина создаётся
+func GetCartID(owner string) (int, error) {
+	var id int
+	err := db.QueryRow(`INSERT INTO carts (owner) VALUES ($1)
+		ON CONFLICT (owner) DO UPDATE SET updated_at = now() RETURNING id`, owner).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// Содержимое корзины владельца
+func GetCartData(owner string) (Cart, error) {
+	rows, err := db.Query(`SELECT i.id, i.naming, i.weight, i.description, c.quantity
+		FROM cart_items c
+		JOIN carts ON carts.id = c.cart_id
+		JOIN items i ON i.id = c.item_id
+		WHERE carts.owner = $1
+		ORDER BY c.id`, owner)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer rows.Close()
+	cart := Cart{Prods: []CartLine{}}
+	for rows.Next() {
+		var line CartLine
+		if err := rows.Scan(&line.ID, &line.Naming, &line.Weight, &line.Description, &line.Quantity); err != nil {
+			return Cart{}, err
+		}
+		cart.Prods = append(cart.Prods, line)
+	}
+	if err := rows.Err(); err != nil {
+		return Cart{}, err
+	}
+	return cart, nil
+}
+
+// Добавить продукт в корзину владельца, количество суммируется с уже добавленным
+func InsertCartItem(owner string, itemID string, quantity int) error {
+	cartID, err := GetCartID(owner)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO cart_items (cart_id, item_id, quantity) VALUES ($1,$2,$3)
+		ON CONFLICT (cart_id, item_id) DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity`,
+		cartID, itemID, quantity)
+	return err
+}
+
+// Изменить количество продукта в корзине
+func UpdateCartItem(owner string, itemID string, quantity int) (int64, error) {
+	res, err := db.Exec(`UPDATE cart_items SET quantity = $3 FROM carts
+		WHERE carts.id = cart_items.cart_id AND carts.owner = $1 AND cart_items.item_id = $2`,
+		owner, itemID, quantity)
+	if err != nil {
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+// Удалить продукт из корзины
+func DeleteCartItem(owner string, itemID string) (int64, error) {
+	res, err := db.Exec(`DELETE FROM cart_items USING carts
+		WHERE carts.id = cart_items.cart_id AND carts.owner = $1 AND cart_items.item_id = $2`, owner, itemID)
+	if err != nil {
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+// Очистить корзину владельца
+func ClearCartData(owner string) (int64, error) {
+	res, err := db.Exec("DELETE FROM cart_items USING carts WHERE carts.id = cart_items.cart_id AND carts.owner = $1", owner)
+	if err != nil {
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+// Ключи идемпотентности оформления корзины отдельны для каждого владельца
+func cartScope(r *http.Request) string {
+	return "POST /cart " + CartOwner(r)
+}
+
+// Проверка владельца корзины в запросе, при отсутствии отвечает 400
+func RequireCartOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := CartOwner(r)
+	if owner == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Cart owner is not specified",
+			"The "+CustomerHeader+" or "+SessionHeader+" header is required.")
+		return "", false
+	}
+	return owner, true
+}
+
+// Продукт для корзины, 404 если продукта нет
+func cartProduct(w http.ResponseWriter, id string) (Product, bool) {
+	prod, err := GetDataID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
+		} else {
+			InternalError(w, err)
+		}
+		return Product{}, false
+	}
+	return prod, true
+}
+
+// Количество из тела запроса {"quantity": n}, пустое тело - значение по умолчанию
+func decodeQuantity(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	req := CartQuantity{Quantity: def}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must be a JSON object with a quantity field.")
+		return 0, false
+	}
+	if req.Quantity <= 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid quantity", "The quantity must be greater than zero.")
+		return 0, false
+	}
+	return req.Quantity, true
+}
+
+// Ответ с содержимым корзины
+func writeCart(w http.ResponseWriter, owner string) {
+	cart, err := GetCartData(owner)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cart.Prods)
+}
+
+// Изменить количество продукта в корзине
+func PATCHCart(w http.ResponseWriter, r *http.Request) {
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
+	}
+	quantity, ok := decodeQuantity(w, r, 0)
+	if !ok {
+		return
+	}
+	count, err := UpdateCartItem(owner, mux.Vars(r)["id"], quantity)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if count == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The product with the specified ID is not in the cart.")
+		return
+	}
+	writeCart(w, owner)
+}
+
+// Удалить продукт из корзины
+func DELETECartItem(w http.ResponseWriter, r *http.Request) {
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
+	}
+	count, err := DeleteCartItem(owner, mux.Vars(r)["id"])
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if count == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The product with the specified ID is not in the cart.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Очистить корзину
+func DELETECart(w http.ResponseWriter, r *http.Request) {
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
+	}
+	if _, err := ClearCartData(owner); err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+type Category struct {
+	ID          int         `json:"id"`
+	ParentID    *int        `json:"parent_id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Children    []*Category `json:"children,omitempty"`
+}
+
+// Категория $1 и все её подкатегории. UNION отбрасывает уже найденные категории,
+// поэтому запрос завершается, даже если в дереве оказался цикл.
+const categorySubtree = `WITH RECURSIVE subtree AS (
+	SELECT id FROM categories WHERE id = $1
+	UNION
+	SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+)`
+
+var (
+	ErrCategoryCycle     = errors.New("category cannot be moved into its own subtree")
+	ErrParentNotFound    = errors.New("parent category does not exist")
+	ErrCategoryHasChilds = errors.New("category has subcategories")
+)
+
+// Ошибка нарушения внешнего ключа PostgreSQL
+func isForeignKeyViolation(err error) bool {
+	pgErr, ok := err.(*pq.Error)
+	return ok && pgErr.Code == "23503"
+}
+
+func SelectCategories() ([]*Category, error) {
+	rows, err := db.Query("SELECT id, parent_id, name, description FROM categories ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cats []*Category
+	for rows.Next() {
+		var cat Category
+		if err := rows.Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Description); err != nil {
+			return nil, err
+		}
+		cats = append(cats, &cat)
+	}
+	return cats, rows.Err()
+}
+
+// Сборка дерева категорий, root - код корня поддерева или nil для всего дерева
+func CategoryTree(cats []*Category, root *int) []*Category {
+	children := make(map[int][]*Category)
+	var roots []*Category
+	for _, cat := range cats {
+		if cat.ParentID == nil {
+			if root == nil {
+				roots = append(roots, cat)
+			}
+		} else {
+			children[*cat.ParentID] = append(children[*cat.ParentID], cat)
+		}
+		if root != nil && cat.ID == *root {
+			roots = append(roots, cat)
+		}
+	}
+	for _, cat := range cats {
+		cat.Children = children[cat.ID]
+	}
+	if roots == nil {
+		roots = []*Category{}
+	}
+	return roots
+}
+
+func SelectCategoryID(id int) (Category, error) {
+	var cat Category
+	err := db.QueryRow("SELECT id, parent_id, name, description FROM categories WHERE id = $1", id).
+		Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Description)
+	if err != nil {
+		return Category{}, err
+	}
+	return cat, nil
+}
+
+func InsertCategory(cat Category) (Category, error) {
+	err := db.QueryRow("INSERT INTO categories (parent_id, name, description) VALUES ($1,$2,$3) RETURNING id",
+		cat.ParentID, cat.Name, cat.Description).Scan(&cat.ID)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return Category{}, ErrParentNotFound
+		}
+		return Category{}, err
+	}
+	return cat, nil
+}
+
+// Изменение категории. Проверка цикла и запись выполняются в одной транзакции, которая сначала
+// блокирует строки всех категорий, поэтому два одновременных переноса (A под B и B под A)
+// не могут оба пройти проверку.
+func UpdateCategoryID(cat Category) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	if cat.ParentID != nil {
+		if _, err := tx.Exec("SELECT id FROM categories ORDER BY id FOR UPDATE"); err != nil {
+			return -1, err
+		}
+		var cycle bool
+		err := tx.QueryRow(categorySubtree+" SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)", cat.ID, *cat.ParentID).Scan(&cycle)
+		if err != nil {
+			return -1, err
+		}
+		if cycle {
+			return -1, ErrCategoryCycle
+		}
+	}
+	res, err := tx.Exec("UPDATE categories SET parent_id = $2, name = $3, description = $4 WHERE id = $1",
+		cat.ID, cat.ParentID, cat.Name, cat.Description)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return -1, ErrParentNotFound
+		}
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, tx.Commit()
+}
+
+func DeleteCategoryID(id int) (int64, error) {
+	res, err := db.Exec("DELETE FROM categories WHERE id = $1", id)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return -1, ErrCategoryHasChilds
+		}
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+// Привязка продукта к категории, повторная привязка ничего не меняет
+func LinkProductCategory(productID string, categoryID int) error {
+	_, err := db.Exec("INSERT INTO product_categories (product_id, category_id) VALUES ($1,$2) ON CONFLICT DO NOTHING",
+		productID, categoryID)
+	return err
+}
+
+func UnlinkProductCategory(productID string, categoryID int) (int64, error) {
+	res, err := db.Exec("DELETE FROM product_categories WHERE product_id = $1 AND category_id = $2", productID, categoryID)
+	if err != nil {
+		return -1, err
+	}
+	rowcount, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	return rowcount, nil
+}
+
+func SelectProductCategories(productID string) ([]Category, error) {
+	rows, err := db.Query(`SELECT c.id, c.parent_id, c.name, c.description FROM categories c
+		JOIN product_categories pc ON pc.category_id = c.id
+		WHERE pc.product_id = $1 ORDER BY c.name, c.id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cats := []Category{}
+	for rows.Next() {
+		var cat Category
+		if err := rows.Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Description); err != nil {
+			return nil, err
+		}
+		cats = append(cats, cat)
+	}
+	return cats, rows.Err()
+}
+
+// Код категории из пути запроса, 404 для нечислового кода
+func categoryID(w http.ResponseWriter, r *http.Request, key string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[key])
+	if err != nil {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+		return 0, false
+	}
+	return id, true
+}
+
+func decodeCategory(w http.ResponseWriter, r *http.Request) (Category, bool) {
+	var cat Category
+	if err := json.NewDecoder(r.Body).Decode(&cat); err != nil || cat.Name == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The category must have a name.")
+		return Category{}, false
+	}
+	return cat, true
+}
+
+// Ошибки изменения категорий, которые возвращаются клиенту
+func categoryError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrParentNotFound, ErrCategoryCycle:
+		ErrorResponse(w, http.StatusBadRequest, "Invalid parent category", err.Error())
+	case ErrCategoryHasChilds:
+		ErrorResponse(w, http.StatusConflict, "Category is not empty", err.Error())
+	default:
+		InternalError(w, err)
+	}
+}
+
+// Дерево всех категорий
+func GetCategories(w http.ResponseWriter, r *http.Request) {
+	cats, err := SelectCategories()
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CategoryTree(cats, nil))
+}
+
+// Категория с поддеревом подкатегорий
+func GetCategory(w http.ResponseWriter, r *http.Request) {
+	id, ok := categoryID(w, r, "id")
+	if !ok {
+		return
+	}
+	cats, err := SelectCategories()
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	tree := CategoryTree(cats, &id)
+	if len(tree) == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tree[0])
+}
+func CreateCategory(w http.ResponseWriter, r *http.Request) {
+	cat, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+	cat, err := InsertCategory(cat)
+	if err != nil {
+		categoryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cat)
+}
+func UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, ok := categoryID(w, r, "id")
+	if !ok {
+		return
+	}
+	cat, ok := decodeCategory(w, r)
+	if !ok {
+		return
+	}
+	cat.ID = id
+	count, err := UpdateCategoryID(cat)
+	if err != nil {
+		categoryError(w, err)
+		return
+	}
+	if count == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, ok := categoryID(w, r, "id")
+	if !ok {
+		return
+	}
+	count, err := DeleteCategoryID(id)
+	if err != nil {
+		categoryError(w, err)
+		return
+	}
+	if count == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Продукты категории и всех её подкатегорий, параметры как у GET /products
+func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
+	id, ok := categoryID(w, r, "id")
+	if !ok {
+		return
+	}
+	if _, err := SelectCategoryID(id); err != nil {
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+		} else {
+			InternalError(w, err)
+		}
+		return
+	}
+	query, err := ParseProductQuery(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	query.Category = &id
+	page, err := FindProducts(query)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// Категории продукта
+func GetProductCategories(w http.ResponseWriter, r *http.Request) {
+	prod, ok := cartProduct(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	cats, err := SelectProductCategories(prod.ID)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cats)
+}
+
+// Привязать продукт к категории
+func AddProductCategory(w http.ResponseWriter, r *http.Request) {
+	cid, ok := categoryID(w, r, "cid")
+	if !ok {
+		return
+	}
+	prod, ok := cartProduct(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := LinkProductCategory(prod.ID, cid); err != nil {
+		if isForeignKeyViolation(err) {
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The category with the specified ID does not exist.")
+			return
+		}
+		InternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Отвязать продукт от категории
+func RemoveProductCategory(w http.ResponseWriter, r *http.Request) {
+	cid, ok := categoryID(w, r, "cid")
+	if !ok {
+		return
+	}
+	count, err := UnlinkProductCategory(mux.Vars(r)["id"], cid)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	if count == 0 {
+		ErrorResponse(w, http.StatusNotFound, "Resource not found", "The product is not linked to the specified category.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+// Время ожидания ответа Inventory на один вызов
+const GrpcTimeout = 5 * time.Second
+
+const (
+	OrderURL      = "http://order:8081/orders"
+	OrderAttempts = 3 // Попытки передать заказ в Order при ошибке связи
+)
+
+// Корзина, передаваемая в Order вместе с кодом резерва
+type Checkout struct {
+	Cart
+	ReservationID string `json:"reservation_id"`
+	CustomerID    string `json:"customer_id"`
+}
+
+// Покупатель заказа: код покупателя или, для гостя, сессия с префиксом guest:
+func CheckoutCustomer(r *http.Request) string {
+	if customer := r.Header.Get(CustomerHeader); customer != "" {
+		return customer
+	}
+	return "guest:" + r.Header.Get(SessionHeader)
+}
+
+// Результат проверки остатка по строке корзины
+type StockLine struct {
+	ItemID    string `json:"item_id"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+	OK        bool   `json:"ok"`
+	Message   string `json:"message,omitempty"`
+}
+type StockError struct {
+	Error   string      `json:"error"`
+	Message string      `json:"message"`
+	Lines   []StockLine `json:"lines"`
+}
+
+// Время жизни резерва на оформление заказа, задаётся переменной RESERVATION_TTL (в секундах).
+// По умолчанию 15 минут, как в Inventory.
+func ReservationTTL() int32 {
+	if ttl, err := strconv.Atoi(os.Getenv("RESERVATION_TTL")); err == nil && ttl > 0 {
+		return int32(ttl)
+	}
+	return 15 * 60
+}
+
+func NewReservationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Резервирование всех строк корзины в Inventory
+func ReserveCart(id string, cart Cart) (*pb.ReserveReply, error) {
+	req := &pb.ReserveRequest{
+		ReservationId: id,
+		TtlSeconds:    ReservationTTL(),
+	}
+	for _, line := range cart.Prods {
+		req.Items = append(req.Items, &pb.ReserveItem{Id: line.ID, Quantity: int32(line.Quantity)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GrpcTimeout)
+	defer cancel()
+	return connect.client.ReserveStock(ctx, req)
+}
+
+// Снятие резерва, если заказ не создан
+func ReleaseReservation(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), GrpcTimeout)
+	defer cancel()
+	status, err := connect.client.ReleaseReservation(ctx, &pb.ReservationRequest{ReservationId: id})
+	if err != nil {
+		log.Printf("reservation %s is not released: %v\n", id, err)
+		return
+	}
+	if !status.GetFlag() {
+		log.Printf("reservation %s is not released: %s\n", id, status.GetMessage())
+	}
+}
+
+// Ответ 409 с отчётом по строкам, которых не хватает на складе
+func StockErrorResponse(w http.ResponseWriter, reply *pb.ReserveReply) {
+	res := StockError{
+		Error:   "Not enough stock",
+		Message: "Some products of the cart are not available in the requested quantity.",
+		Lines:   []StockLine{},
+	}
+	for _, line := range reply.GetLines() {
+		res.Lines = append(res.Lines, StockLine{
+			ItemID:    line.GetId(),
+			Requested: int(line.GetRequested()),
+			Available: int(line.GetAvailable()),
+			OK:        line.GetOk(),
+			Message:   line.GetMessage(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Передача корзины в Order. Код резерва служит ключом идемпотентности, поэтому запрос можно
+// безопасно повторить: при ошибке связи и пока Order ещё выполняет первый запрос с этим ключом.
+func PostOrder(checkout Checkout) (*http.Response, error) {
+	jsonData, _ := json.Marshal(checkout)
+	var err error
+	for attempt := 1; attempt <= OrderAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		req, _ := http.NewRequest(http.MethodPost, OrderURL, bytes.NewReader(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyHeader, checkout.ReservationID)
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("order for reservation %s, attempt %d: %v\n", checkout.ReservationID, attempt, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusConflict && resp.Header.Get("Retry-After") != "" && attempt < OrderAttempts {
+			resp.Body.Close()
+			err = fmt.Errorf("order for reservation %s is in progress", checkout.ReservationID)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Заголовок с ключом идемпотентности
+const IdempotencyHeader = "Idempotency-Key"
+
+const (
+	IdempotencyLock  = time.Minute // Запрос с ключом считается выполняющимся не дольше этого времени
+	IdempotencyPurge = time.Hour   // Период удаления просроченных ключей
+)
+
+var (
+	ErrKeyReused     = errors.New("idempotency key is already used with a different request")
+	ErrKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// Время хранения ответа, переопределяется переменной IDEMPOTENCY_TTL (в секундах)
+func IdempotencyTTL() time.Duration {
+	if ttl, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL")); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// Сохранённый ответ на запрос с ключом
+type StoredResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Ответ обработчика, который записывается, прежде чем уйти клиенту
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+func (r *recordedResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+type idempotencyTokenKey struct{}
+
+// Код выполнения запроса с ключом: одинаковый для повторов одной попытки, в том числе после
+// падения сервиса, и новый после ответа 5xx, когда запрос можно выполнить заново.
+// Пустая строка, если ключ не передан.
+func IdempotencyToken(r *http.Request) string {
+	token, _ := r.Context().Value(idempotencyTokenKey{}).(string)
+	return token
+}
+
+// Обработчик, повтор которого с тем же заголовком Idempotency-Key возвращает первый ответ
+// без повторного выполнения. scope отделяет ключи разных клиентов.
+// Ответы 5xx не сохраняются, такой запрос можно повторить с тем же ключом.
+func Idempotent(scope func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid idempotency key", "The "+IdempotencyHeader+" header must not be longer than 255 characters.")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The request body could not be read.")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		sc := scope(r)
+
+		stored, attempt, err := ClaimIdempotencyKey(sc, key, hex.EncodeToString(sum[:]))
+		switch {
+		case err == ErrKeyReused:
+			ErrorResponse(w, http.StatusConflict, "Idempotency key reused", "The key was already used with a different request.")
+			return
+		case err == ErrKeyInProgress:
+			w.Header().Set("Retry-After", "1")
+			ErrorResponse(w, http.StatusConflict, "Request in progress", "The request with this key is still being processed, retry later.")
+			return
+		case err != nil:
+			InternalError(w, err)
+			return
+		case stored != nil:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		token := sha256.Sum256([]byte(sc + "\n" + key + "\n" + strconv.Itoa(attempt)))
+		ctx := context.WithValue(r.Context(), idempotencyTokenKey{}, hex.EncodeToString(token[:16]))
+		rec := &recordedResponse{header: http.Header{}}
+		next(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= 500 {
+			err = ReleaseIdempotencyKey(sc, key)
+		} else {
+			err = SaveIdempotentResponse(sc, key, StoredResponse{rec.status, rec.header.Get("Content-Type"), rec.body.Bytes()})
+		}
+		if err != nil {
+			log.Printf("idempotency key %s: %v\n", key, err)
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// Захват ключа для выполнения запроса. Если запрос с этим ключом уже выполнен, возвращается
+// сохранённый ответ, иначе - номер попытки выполнения.
+func ClaimIdempotencyKey(scope, key, hash string) (*StoredResponse, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	lock, ttl := IdempotencyLock.Seconds(), IdempotencyTTL().Seconds()
+	attempt := 1
+	err = tx.QueryRow(`INSERT INTO idempotency_keys (scope, key, request_hash, locked_until, expires_at)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4), now() + make_interval(secs => $5))
+		ON CONFLICT (scope, key) DO NOTHING RETURNING attempt`, scope, key, hash, lock, ttl).Scan(&attempt)
+	if err == nil {
+		return nil, attempt, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+
+	var storedHash string
+	var status sql.NullInt64
+	var res StoredResponse
+	var locked, expired bool
+	err = tx.QueryRow(`SELECT request_hash, attempt, status_code, content_type, body, locked_until > now(), expires_at <= now()
+		FROM idempotency_keys WHERE scope = $1 AND key = $2 FOR UPDATE`, scope, key).
+		Scan(&storedHash, &attempt, &status, &res.ContentType, &res.Body, &locked, &expired)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case expired:
+		// Просроченный ключ ещё не удалён, запрос выполняется как новый
+		attempt++
+		_, err = tx.Exec(`UPDATE idempotency_keys SET request_hash = $3, attempt = $4, status_code = NULL,
+			content_type = '', body = NULL, locked_until = now() + make_interval(secs => $5),
+			created_at = now(), expires_at = now() + make_interval(secs => $6)
+			WHERE scope = $1 AND key = $2`, scope, key, hash, attempt, lock, ttl)
+	case storedHash != hash:
+		return nil, 0, ErrKeyReused
+	case status.Valid:
+		res.Status = int(status.Int64)
+		return &res, 0, nil
+	case locked:
+		return nil, 0, ErrKeyInProgress
+	default:
+		// Прошлое выполнение прервано или завершилось ошибкой 5xx
+		_, err = tx.Exec(`UPDATE idempotency_keys SET locked_until = now() + make_interval(secs => $3)
+			WHERE scope = $1 AND key = $2`, scope, key, lock)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return nil, attempt, tx.Commit()
+}
+
+func SaveIdempotentResponse(scope, key string, res StoredResponse) error {
+	_, err := db.Exec("UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5 WHERE scope = $1 AND key = $2",
+		scope, key, res.Status, res.ContentType, res.Body)
+	return err
+}
+
+// Освобождение ключа после ответа 5xx: следующий повтор выполнится как новая попытка
+func ReleaseIdempotencyKey(scope, key string) error {
+	_, err := db.Exec("UPDATE idempotency_keys SET locked_until = now(), attempt = attempt + 1 WHERE scope = $1 AND key = $2",
+		scope, key)
+	return err
+}
+
+// Периодическое удаление просроченных ключей
+func PurgeIdempotencyKeys(interval time.Duration) {
+	for {
+		res, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= now()")
+		if err != nil {
+			log.Println(err)
+		} else if count, _ := res.RowsAffected(); count > 0 {
+			log.Printf("%d idempotency keys expired\n", count)
+		}
+		time.Sleep(interval)
+	}
+}
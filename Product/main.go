@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
 	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+	"github.com/ALbikov-R/4ServicesGRPC/money"
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
@@ -30,16 +31,22 @@ type Product struct {
 }
 type Fproduct struct {
 	Product
-	Price    string `json:"price"`
-	Quantity int    `json:"quantity"`
+	Price    money.Money `json:"price"`
+	Quantity int         `json:"quantity"`
 }
 
+type CartLine struct {
+	Product
+	Quantity int `json:"quantity"`
+}
+type CartQuantity struct {
+	Quantity int `json:"quantity"`
+}
 type Cart struct {
-	Prods []Product `json:"product"`
+	Prods []CartLine `json:"product"`
 }
 
 var (
-	cart     Cart
 	PortAddr = os.Getenv("PORT_router")
 	db       *sql.DB
 )
@@ -59,15 +66,32 @@ func main() {
 	fmt.Println("Подключение к PostgreSQL успешно!")
 
 	ConnectGrpc()
+	go RelayOutbox(OutboxInterval)
+	go PurgeIdempotencyKeys(IdempotencyPurge)
 	router := mux.NewRouter()
 	router.HandleFunc("/products", GetProducts).Methods("GET")           //Получить информацию о всех продуктах
+	router.HandleFunc("/products/search", SearchProducts).Methods("GET") //Полнотекстовый поиск продуктов
 	router.HandleFunc("/products/{id}", GetProduct).Methods("GET")       //Получить информацию о продукте с номером ID
 	router.HandleFunc("/products", CreateProduct).Methods("POST")        //Добавить продукт
 	router.HandleFunc("/products/{id}", UpdateProduct).Methods("PUT")    //Изменить продукт по ID
 	router.HandleFunc("/products/{id}", DeleteProduct).Methods("DELETE") //Удалить продукт ID
 	router.HandleFunc("/products/{id}", AddProd).Methods("POST")
 	router.HandleFunc("/cart", GETCart).Methods("GET")
-	router.HandleFunc("/cart", POSTCart).Methods("POST")
+	router.HandleFunc("/cart", Idempotent(cartScope, POSTCart)).Methods("POST")
+	router.HandleFunc("/cart", DELETECart).Methods("DELETE")
+	router.HandleFunc("/cart/{id}", PATCHCart).Methods("PATCH")
+	router.HandleFunc("/cart/{id}", DELETECartItem).Methods("DELETE")
+	router.HandleFunc("/categories", GetCategories).Methods("GET")                      //Дерево категорий
+	router.HandleFunc("/categories", CreateCategory).Methods("POST")                    //Добавить категорию
+	router.HandleFunc("/categories/{id}", GetCategory).Methods("GET")                   //Категория с подкатегориями
+	router.HandleFunc("/categories/{id}", UpdateCategory).Methods("PUT")                //Изменить категорию
+	router.HandleFunc("/categories/{id}", DeleteCategory).Methods("DELETE")             //Удалить категорию
+	router.HandleFunc("/categories/{id}/products", GetCategoryProducts).Methods("GET")  //Продукты категории и подкатегорий
+	router.HandleFunc("/products/{id}/categories", GetProductCategories).Methods("GET") //Категории продукта
+	router.HandleFunc("/products/{id}/categories/{cid}", AddProductCategory).Methods("PUT")
+	router.HandleFunc("/products/{id}/categories/{cid}", RemoveProductCategory).Methods("DELETE")
+	router.HandleFunc("/products/{id}/reconcile", ReconcileProduct).Methods("POST") //Сверить продукт с Inventory
+	router.HandleFunc("/outbox", GetOutbox).Methods("GET")                          //Неотправленные в Inventory события
 
 	fmt.Println("Сервер слушате порт " + PortAddr)
 	log.Fatal(http.ListenAndServe(PortAddr, router))
@@ -97,23 +121,31 @@ func ConnectGrpc() {
 	connect.client = pb.NewInvOrdClient(connect.con)
 }
 
-func Insert(item Product) (int64, error) {
-	res, err := db.Exec("INSERT INTO items (id, naming, weight, description) VALUES ($1,$2,$3,$4)", item.ID, item.Naming, item.Weight, item.Description)
+// Добавление продукта вместе с событием для Inventory в одной транзакции
+func Insert(item Fproduct) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return -1, err
+		return err
 	}
-	rowcount, err := res.RowsAffected()
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO items (id, naming, weight, description) VALUES ($1,$2,$3,$4)", item.ID, item.Naming, item.Weight, item.Description)
 	if err != nil {
-		return rowcount, err
+		return err
+	}
+	if err := InsertOutbox(tx, OutboxProductCreated, item.ID, item); err != nil {
+		return err
 	}
-	return rowcount, nil
+	return tx.Commit()
 }
+
+// Изменение продукта вместе с событием для Inventory, sql.ErrNoRows если продукта нет
 func UpdateID(item Product) (int64, error) {
-	_, err := GetDataID(item.ID)
+	tx, err := db.Begin()
 	if err != nil {
 		return -1, err
 	}
-	res, err := db.Exec("UPDATE items SET naming = $2, weight =$3, description = $4 WHERE id=$1",
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE items SET naming = $2, weight =$3, description = $4 WHERE id=$1",
 		item.ID, item.Naming, item.Weight, item.Description)
 	if err != nil {
 		return -1, err
@@ -122,10 +154,23 @@ func UpdateID(item Product) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	return rowcount, nil
+	if rowcount == 0 {
+		return -1, sql.ErrNoRows
+	}
+	if err := InsertOutbox(tx, OutboxProductUpdated, item.ID, item); err != nil {
+		return -1, err
+	}
+	return rowcount, tx.Commit()
 }
+
+// Удаление продукта вместе с событием для Inventory
 func DeleteID(IDNAME string) (int64, error) {
-	res, err := db.Exec("DELETE FROM items WHERE ID = $1", IDNAME)
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM items WHERE ID = $1", IDNAME)
 	if err != nil {
 		return -1, err
 	}
@@ -133,10 +178,16 @@ func DeleteID(IDNAME string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	return rowcount, nil
+	if rowcount == 0 {
+		return 0, nil
+	}
+	if err := InsertOutbox(tx, OutboxProductDeleted, IDNAME, Product{ID: IDNAME}); err != nil {
+		return -1, err
+	}
+	return rowcount, tx.Commit()
 }
 func GetDataID(IDNAME string) (Product, error) { //Обработать ошибку после работы функции
-	rows := db.QueryRow("SELECT * FROM items WHERE id=$1", IDNAME)
+	rows := db.QueryRow("SELECT id, naming, weight, description FROM items WHERE id=$1", IDNAME)
 	var prod Product
 	// Обработка результатов запроса
 	err := rows.Scan(&prod.ID, &prod.Naming, &prod.Weight, &prod.Description)
@@ -145,25 +196,6 @@ func GetDataID(IDNAME string) (Product, error) { //Обработать ошиб
 	}
 	return prod, nil
 }
-func GetData() []Product {
-	rows, err := db.Query("SELECT * FROM items")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer rows.Close()
-	var prod []Product
-	// Обработка результатов запроса
-	for rows.Next() {
-		var id, naming, description string
-		var weight float64
-		err := rows.Scan(&id, &naming, &weight, &description)
-		if err != nil {
-			panic(err)
-		}
-		prod = append(prod, Product{ID: id, Naming: naming, Weight: weight, Description: description})
-	}
-	return prod
-}
 func ConnectDd() *sql.DB {
 	var err error
 	for {
@@ -204,10 +236,19 @@ func DatabaseURL() string {
 	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
 }
 func GetProducts(w http.ResponseWriter, r *http.Request) {
-	prods := GetData()
-	w.WriteHeader(http.StatusOK)
+	query, err := ParseProductQuery(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	page, err := FindProducts(query)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(prods)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
 }
 func GetProduct(w http.ResponseWriter, r *http.Request) {
 	prod, err := GetDataID(mux.Vars(r)["id"])
@@ -230,104 +271,146 @@ func GetProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(prod)
 }
 func CreateProduct(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("here")
 	var prod Fproduct
-	_ = json.NewDecoder(r.Body).Decode(&prod)
-	_, err := Insert(prod.Product)
-	fmt.Println(prod)
-
+	if err := json.NewDecoder(r.Body).Decode(&prod); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must be a JSON product.")
+		return
+	}
+	if err := prod.Price.Validate(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid price", err.Error())
+		return
+	}
+	// Inventory получит продукт через outbox, даже если сейчас он недоступен
+	err := Insert(prod)
 	if err != nil {
 		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Product is already exist",
-				"message": "The resource with the specified ID already exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
+			ErrorResponse(w, http.StatusNotFound, "Product is already exist", "The resource with the specified ID already exist.")
 			return
-		} else {
-			log.Fatal(err)
 		}
+		InternalError(w, err)
+		return
 	}
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(prod.Product)
-	status, err := connect.client.SendProduct(context.Background(), &pb.CreateRequest{
-		Prod: &pb.Product{
-			Id:       prod.ID,
-			Name:     prod.Naming,
-			Quantity: int32(prod.Quantity),
-			Price:    prod.Price,
-		},
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println(status.Message)
 }
 func UpdateProduct(w http.ResponseWriter, r *http.Request) {
 	var prod Product
-	_ = json.NewDecoder(r.Body).Decode(&prod)
+	if err := json.NewDecoder(r.Body).Decode(&prod); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid request body", "The body must be a JSON product.")
+		return
+	}
+	prod.ID = mux.Vars(r)["id"]
 	_, err := UpdateID(prod)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Resource not found",
-				"message": "The resource with the specified ID does not exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
+			ErrorResponse(w, http.StatusNotFound, "Resource not found", "The resource with the specified ID does not exist.")
 			return
-		} else {
-			log.Fatal(err)
 		}
-	} else {
-		w.WriteHeader(http.StatusNoContent)
+		InternalError(w, err)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func POSTCart(w http.ResponseWriter, r *http.Request) {
-	jsonData, _ := json.Marshal(cart)
-	fmt.Println(string(jsonData))
-	resp, err := http.Post("http://order:8081/orders", "application/json", bytes.NewBuffer(jsonData))
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
+	}
+	cart, err := GetCartData(owner)
 	if err != nil {
-		log.Fatal(err)
+		InternalError(w, err)
+		return
+	}
+	if len(cart.Prods) == 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Cart is empty", "Add products to the cart before checkout.")
+		return
+	}
+	// С ключом идемпотентности повтор запроса использует тот же резерв и тот же заказ
+	reservationID := IdempotencyToken(r)
+	if reservationID == "" {
+		reservationID = NewReservationID()
+	}
+	reservation, err := ReserveCart(reservationID, cart)
+	if err != nil {
+		log.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, "Inventory service unavailable", "The stock could not be reserved, the cart is kept.")
+		return
+	}
+	if !reservation.GetFlag() {
+		StockErrorResponse(w, reservation)
+		return
+	}
+	resp, err := PostOrder(Checkout{Cart: cart, ReservationID: reservation.GetReservationId(), CustomerID: CheckoutCustomer(r)})
+	if err != nil {
+		log.Println(err)
+		ReleaseReservation(reservation.GetReservationId())
+		ErrorResponse(w, http.StatusBadGateway, "Order service unavailable", "The order could not be created, the cart is kept.")
+		return
 	}
 	defer resp.Body.Close()
+	// Order повторно проверяет резерв: если он истёк или не совпадает с корзиной, отчёт по строкам передаётся клиенту
+	if resp.StatusCode == http.StatusConflict {
+		ReleaseReservation(reservation.GetReservationId())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		io.Copy(w, resp.Body)
+		return
+	}
+	// Заказ сохранён, но ещё оформляется: резервом теперь распоряжается сага Order
+	if resp.StatusCode == http.StatusAccepted {
+		if _, err := ClearCartData(owner); err != nil {
+			log.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		io.Copy(w, resp.Body)
+		return
+	}
+	if resp.StatusCode != http.StatusCreated {
+		log.Printf("order service responded %d for cart of %s\n", resp.StatusCode, owner)
+		ReleaseReservation(reservation.GetReservationId())
+		ErrorResponse(w, http.StatusBadGateway, "Order is not created", "The order could not be created, the cart is kept.")
+		return
+	}
+	// Резерв списан со склада сервисом Order при создании заказа
+	if _, err := ClearCartData(owner); err != nil {
+		log.Println(err)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 func GETCart(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cart.Prods)
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
+	}
+	writeCart(w, owner)
 }
 func AddProd(w http.ResponseWriter, r *http.Request) {
-	prod, err := GetDataID(mux.Vars(r)["id"])
-	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			errorResponse := map[string]string{
-				"error":   "Resource not found",
-				"message": "The resource with the specified ID does not exist.",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(errorResponse)
-			return
-		} else {
-			log.Fatal(err)
-		}
+	owner, ok := RequireCartOwner(w, r)
+	if !ok {
+		return
 	}
-	cart.Prods = append(cart.Prods, prod)
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cart.Prods)
+	quantity, ok := decodeQuantity(w, r, 1)
+	if !ok {
+		return
+	}
+	prod, ok := cartProduct(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := InsertCartItem(owner, prod.ID, quantity); err != nil {
+		InternalError(w, err)
+		return
+	}
+	writeCart(w, owner)
 }
 func DeleteProduct(w http.ResponseWriter, r *http.Request) {
 	count, err := DeleteID(mux.Vars(r)["id"])
 	if err != nil {
-		log.Fatal(err)
+		InternalError(w, err)
+		return
 	}
 	if count == 0 {
 		w.WriteHeader(http.StatusNotFound)
@@ -341,3 +424,19 @@ func DeleteProduct(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+// Ответ с ошибкой в формате JSON
+func ErrorResponse(w http.ResponseWriter, status int, errorText, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   errorText,
+		"message": message,
+	})
+}
+
+// Внутренняя ошибка: пишется в лог, клиенту возвращается 500
+func InternalError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	ErrorResponse(w, http.StatusInternalServerError, "Internal server error", "The request could not be processed.")
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS carts (
+    id SERIAL PRIMARY KEY,
+    owner varchar(255) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS cart_items (
+    id SERIAL PRIMARY KEY,
+    cart_id INT NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS cart_items_cart_id_idx ON cart_items (cart_id);
\ No newline at end of file
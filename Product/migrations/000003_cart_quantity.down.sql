@@ -0,0 +1,2 @@
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_cart_id_item_id_key;
+ALTER TABLE cart_items DROP COLUMN IF EXISTS quantity;
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS quantity INT NOT NULL DEFAULT 1 CHECK (quantity > 0);
+UPDATE cart_items SET quantity = d.total
+    FROM (SELECT min(id) AS id, count(*) AS total FROM cart_items GROUP BY cart_id, item_id) d
+    WHERE cart_items.id = d.id;
+DELETE FROM cart_items WHERE id NOT IN (SELECT min(id) FROM cart_items GROUP BY cart_id, item_id);
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_cart_id_item_id_key UNIQUE (cart_id, item_id);
\ No newline at end of file
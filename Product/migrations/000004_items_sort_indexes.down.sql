@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS items_weight_id_idx;
+DROP INDEX IF EXISTS items_naming_id_idx;
\ No newline at end of file
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS items_naming_id_idx ON items (naming, id);
+CREATE INDEX IF NOT EXISTS items_weight_id_idx ON items (weight, id);
\ No newline at end of file
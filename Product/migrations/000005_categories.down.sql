@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS product_categories;
+DROP TABLE IF EXISTS categories;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INT REFERENCES categories (id) ON DELETE RESTRICT,
+    name varchar(255) NOT NULL,
+    description varchar(255) NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+CREATE TABLE IF NOT EXISTS product_categories (
+    product_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    category_id INT NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+    PRIMARY KEY (product_id, category_id)
+);
+CREATE INDEX IF NOT EXISTS product_categories_category_id_idx ON product_categories (category_id);
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS items_search_idx;
+ALTER TABLE items DROP COLUMN IF EXISTS search;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- Конфигурация russian стеммит кириллицу русским стеммером, а слова латиницей - английским,
+-- поэтому одного вектора хватает для смешанного каталога
+ALTER TABLE items ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('russian', naming), 'A') ||
+    setweight(to_tsvector('russian', description), 'B')
+) STORED;
+CREATE INDEX IF NOT EXISTS items_search_idx ON items USING GIN (search);
\ No newline at end of file
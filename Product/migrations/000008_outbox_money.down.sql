@@ -0,0 +1,5 @@
+UPDATE outbox SET payload = jsonb_set(payload, '{price}', to_jsonb(
+    CASE WHEN (payload->'price'->>'amount')::bigint % 100 = 0 THEN ((payload->'price'->>'amount')::bigint / 100)::text
+        ELSE to_char((payload->'price'->>'amount')::bigint / 100.0, 'FM999999999999990.00') END ||
+    CASE payload->'price'->>'currency' WHEN 'RUB' THEN ' руб.' ELSE ' ' || (payload->'price'->>'currency') END))
+WHERE jsonb_typeof(payload->'price') = 'object';
\ No newline at end of file
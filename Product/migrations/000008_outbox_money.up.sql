@@ -0,0 +1,47 @@
+-- Цены в неотправленных и отправленных событиях создания продукта переводятся из строки
+-- вида "12500 руб." в сумму в минимальных единицах и код валюты, как в Inventory.
+-- Сумма цены в минимальных единицах или NULL, если числа нет или оно неоднозначно. Пробелы
+-- разделяют тысячи. Один знак "." или "," перед 1-2 последними цифрами отделяет дробную часть.
+-- Тысячи разделяются точкой или запятой, только если это однозначно: знак повторяется
+-- ("1,000,000") или дробная часть отделена другим знаком ("1,000.50", "1.234,56").
+-- Цена вида "1,000" или "1.234" (тысяча или единица) не угадывается.
+CREATE OR REPLACE FUNCTION pg_temp.price_amount(price TEXT) RETURNS BIGINT AS $f$
+DECLARE
+    num TEXT := replace(substring(price from '[0-9](?:[0-9 .,]*[0-9])?'), ' ', '');
+BEGIN
+    IF num ~ '^[0-9]+$' THEN
+        NULL;
+    ELSIF num ~ '^[0-9]+[.,][0-9]{1,2}$' THEN
+        num := replace(num, ',', '.');
+    ELSIF num ~ '^[0-9]{1,3}(,[0-9]{3})+(\.[0-9]{1,2})?$' AND num ~ '(,.*,|\.)' THEN
+        num := replace(num, ',', '');
+    ELSIF num ~ '^[0-9]{1,3}(\.[0-9]{3})+(,[0-9]{1,2})?$' AND num ~ '(\..*\.|,)' THEN
+        num := replace(replace(num, '.', ''), ',', '.');
+    ELSE
+        RETURN NULL;
+    END IF;
+    RETURN round(num::numeric * 100);
+END
+$f$ LANGUAGE plpgsql IMMUTABLE;
+-- Событие с ценой без числа или с неоднозначным числом останавливает миграцию: по последнему
+-- событию создания, даже отправленному, сверка восстанавливает цену в Inventory.
+DO $$
+DECLARE
+    bad TEXT;
+BEGIN
+    SELECT string_agg(id::text || ' (' || (payload->>'price') || ')', ', ') INTO bad
+    FROM outbox
+    WHERE jsonb_typeof(payload->'price') = 'string' AND pg_temp.price_amount(payload->>'price') IS NULL;
+    IF bad IS NOT NULL THEN
+        RAISE EXCEPTION 'cannot convert prices of outbox events: %', bad;
+    END IF;
+END
+$$;
+UPDATE outbox SET payload = jsonb_set(payload, '{price}', jsonb_build_object(
+    'amount', pg_temp.price_amount(payload->>'price'),
+    'currency', CASE
+        WHEN payload->>'price' ~* '(usd|\$)' THEN 'USD'
+        WHEN payload->>'price' ~* '(eur|€)' THEN 'EUR'
+        ELSE 'RUB'
+    END))
+WHERE jsonb_typeof(payload->'price') = 'string';
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope TEXT NOT NULL,
+    key varchar(255) NOT NULL,
+    request_hash char(64) NOT NULL,
+    attempt INT NOT NULL DEFAULT 1,
+    status_code INT,
+    content_type TEXT NOT NULL DEFAULT '',
+    body BYTEA,
+    locked_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
\ No newline at end of file
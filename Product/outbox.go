@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+// События продукта, которые передаются в Inventory через outbox
+const (
+	OutboxProductCreated = "product.created"
+	OutboxProductUpdated = "product.updated"
+	OutboxProductDeleted = "product.deleted"
+)
+
+const (
+	// Интервал опроса outbox, когда готовых к отправке событий нет
+	OutboxInterval = 2 * time.Second
+	// Наибольшая пауза между повторными попытками доставки
+	OutboxMaxBackoff = 5 * time.Minute
+)
+
+// Ответ Inventory на повторное создание продукта: событие уже было доставлено
+const itemExistsMessage = "item already exists"
+
+type OutboxMessage struct {
+	ID       int64
+	Event    string
+	ItemID   string
+	Payload  []byte
+	Attempts int
+}
+
+// Запись события в outbox в транзакции изменения продукта
+func InsertOutbox(tx *sql.Tx, event string, itemID string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox (event, item_id, payload) VALUES ($1,$2,$3)", event, itemID, data)
+	return err
+}
+
+// Пауза перед следующей попыткой: удваивается с каждой неудачей
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempts && backoff < OutboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > OutboxMaxBackoff {
+		backoff = OutboxMaxBackoff
+	}
+	return backoff
+}
+
+// Фоновая доставка событий outbox в Inventory
+func RelayOutbox(interval time.Duration) {
+	for {
+		for {
+			relayed, err := RelayNext()
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if !relayed {
+				break
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Доставка одного события. Событие продукта отправляется только после всех более ранних
+// событий того же продукта, чтобы Inventory получал изменения в исходном порядке.
+// Возвращает false, если готовых к отправке событий нет.
+func RelayNext() (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var msg OutboxMessage
+	err = tx.QueryRow(`SELECT id, event, item_id, payload, attempts FROM outbox o
+		WHERE sent_at IS NULL AND next_attempt_at <= now()
+		AND NOT EXISTS (SELECT 1 FROM outbox e WHERE e.item_id = o.item_id AND e.sent_at IS NULL AND e.id < o.id)
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED`).Scan(&msg.ID, &msg.Event, &msg.ItemID, &msg.Payload, &msg.Attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if deliverErr := DeliverOutbox(msg); deliverErr != nil {
+		backoff := outboxBackoff(msg.Attempts + 1)
+		log.Printf("outbox %d (%s item %s) failed, retry in %s: %v\n", msg.ID, msg.Event, msg.ItemID, backoff, deliverErr)
+		_, err = tx.Exec(`UPDATE outbox SET attempts = attempts + 1, last_error = $2,
+			next_attempt_at = now() + make_interval(secs => $3) WHERE id = $1`, msg.ID, deliverErr.Error(), backoff.Seconds())
+	} else {
+		log.Printf("outbox %d (%s item %s) delivered\n", msg.ID, msg.Event, msg.ItemID)
+		_, err = tx.Exec("UPDATE outbox SET attempts = attempts + 1, last_error = '', sent_at = now() WHERE id = $1", msg.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Отправка события в Inventory по gRPC
+func DeliverOutbox(msg OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), GrpcTimeout)
+	defer cancel()
+	switch msg.Event {
+	case OutboxProductCreated:
+		var prod Fproduct
+		if err := json.Unmarshal(msg.Payload, &prod); err != nil {
+			return err
+		}
+		status, err := connect.client.SendProduct(ctx, &pb.CreateRequest{
+			Prod: &pb.Product{
+				Id:       prod.ID,
+				Name:     prod.Naming,
+				Quantity: int32(prod.Quantity),
+				Price:    prod.Price.Proto(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if !status.GetFlag() && status.GetMessage() != itemExistsMessage {
+			return errors.New(status.GetMessage())
+		}
+		return nil
+	case OutboxProductUpdated:
+		var prod Product
+		if err := json.Unmarshal(msg.Payload, &prod); err != nil {
+			return err
+		}
+		// Остаток и цена ведутся в Inventory, поэтому меняется только наименование
+		status, err := connect.client.UpdProduct(ctx, &pb.CreateRequest{
+			Prod:       &pb.Product{Id: prod.ID, Name: prod.Naming},
+			UpdateMask: []string{"name"},
+		})
+		if err != nil {
+			return err
+		}
+		if !status.GetFlag() {
+			return errors.New(status.GetMessage())
+		}
+		return nil
+	case OutboxProductDeleted:
+		// Отсутствие продукта в Inventory означает, что удаление уже выполнено
+		_, err := connect.client.DelProduct(ctx, &pb.IdRequest{Id: msg.ItemID})
+		return err
+	default:
+		return fmt.Errorf("unknown outbox event %s", msg.Event)
+	}
+}
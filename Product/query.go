@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// Поля сортировки каталога: параметр запроса -> колонка и её тип для сравнения с курсором
+var sortColumns = map[string]struct{ column, cast string }{
+	"id":     {"id", "int"},
+	"name":   {"naming", "text"},
+	"weight": {"weight", "float8"},
+}
+
+// Параметры выборки GET /products
+type ProductQuery struct {
+	Name      string
+	MinWeight *float64
+	MaxWeight *float64
+	Sort      string
+	Desc      bool
+	Limit     int
+	After     *Cursor
+	// Код категории: продукты этой категории и всех её подкатегорий
+	Category *int
+}
+
+// Позиция последнего отданного продукта: значение поля сортировки и код продукта
+type Cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// Страница каталога
+type ProductPage struct {
+	Items      []Product `json:"items"`
+	Total      int       `json:"total"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+func EncodeCursor(c Cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("cursor is malformed")
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("cursor is malformed")
+	}
+	return &c, nil
+}
+
+func parseWeight(values url.Values, key string) (*float64, error) {
+	raw := values.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", key)
+	}
+	return &f, nil
+}
+
+// Разбор параметров name, min_weight, max_weight, sort, order, limit, cursor
+func ParseProductQuery(r *http.Request) (ProductQuery, error) {
+	values := r.URL.Query()
+	q := ProductQuery{Name: values.Get("name"), Sort: "id", Limit: DefaultPageSize}
+	var err error
+	if q.MinWeight, err = parseWeight(values, "min_weight"); err != nil {
+		return q, err
+	}
+	if q.MaxWeight, err = parseWeight(values, "max_weight"); err != nil {
+		return q, err
+	}
+	if s := values.Get("sort"); s != "" {
+		if _, ok := sortColumns[s]; !ok {
+			return q, errors.New("sort must be one of id, name, weight")
+		}
+		q.Sort = s
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	if l := values.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit <= 0 {
+			return q, errors.New("limit must be a positive number")
+		}
+		if q.Limit > MaxPageSize {
+			q.Limit = MaxPageSize
+		}
+	}
+	if c := values.Get("cursor"); c != "" {
+		if q.After, err = DecodeCursor(c); err != nil {
+			return q, err
+		}
+		if q.After.Sort != q.Sort || q.After.Desc != q.Desc {
+			return q, errors.New("cursor does not match sort and order")
+		}
+	}
+	return q, nil
+}
+
+// Экранирование % и _ для поиска подстроки через ILIKE
+func likePattern(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	s = strings.ReplaceAll(s, "_", `\_`)
+	return "%" + s + "%"
+}
+
+// Выборка страницы каталога по фильтрам с курсорной пагинацией
+func FindProducts(q ProductQuery) (ProductPage, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.Name != "" {
+		where = append(where, "naming ILIKE "+arg(likePattern(q.Name)))
+	}
+	if q.MinWeight != nil {
+		where = append(where, "weight >= "+arg(*q.MinWeight))
+	}
+	if q.MaxWeight != nil {
+		where = append(where, "weight <= "+arg(*q.MaxWeight))
+	}
+	if q.Category != nil {
+		subtree := strings.Replace(categorySubtree, "$1", arg(*q.Category), 1)
+		where = append(where, "id IN ("+subtree+` SELECT pc.product_id FROM product_categories pc
+			JOIN subtree ON subtree.id = pc.category_id)`)
+	}
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+	page := ProductPage{Items: []Product{}}
+	if err := db.QueryRow("SELECT count(*) FROM items"+filter, args...).Scan(&page.Total); err != nil {
+		return ProductPage{}, err
+	}
+
+	col := sortColumns[q.Sort]
+	dir, cmp := "ASC", ">"
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if q.After != nil {
+		if q.Sort == "id" {
+			where = append(where, "id "+cmp+" "+arg(q.After.ID))
+		} else {
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s)", col.column, cmp, arg(q.After.Value), col.cast, arg(q.After.ID)))
+		}
+	}
+	query := "SELECT id, naming, weight, description FROM items"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", col.column, dir, dir, arg(q.Limit+1))
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var prod Product
+		if err := rows.Scan(&prod.ID, &prod.Naming, &prod.Weight, &prod.Description); err != nil {
+			return ProductPage{}, err
+		}
+		page.Items = append(page.Items, prod)
+	}
+	if err := rows.Err(); err != nil {
+		return ProductPage{}, err
+	}
+	// Лишняя запись означает, что есть следующая страница
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[q.Limit-1]
+		next := Cursor{Sort: q.Sort, Desc: q.Desc}
+		next.ID, _ = strconv.ParseInt(last.ID, 10, 64)
+		switch q.Sort {
+		case "name":
+			next.Value = last.Naming
+		case "weight":
+			next.Value = strconv.FormatFloat(last.Weight, 'g', -1, 64)
+		}
+		page.NextCursor = EncodeCursor(next)
+	}
+	return page, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Действия сверки продукта с Inventory
+const (
+	ReconcileNone    = "none"
+	ReconcileCreated = "created"
+	ReconcileUpdated = "updated"
+	ReconcileDeleted = "deleted"
+)
+
+// Результат сверки: что изменено в Inventory и сколько неотправленных событий стало ненужными
+type ReconcileResult struct {
+	ItemID    string `json:"item_id"`
+	Action    string `json:"action"`
+	Discarded int64  `json:"discarded_events"`
+}
+
+// Неотправленное событие outbox
+type PendingEvent struct {
+	ID            int64     `json:"id"`
+	Event         string    `json:"event"`
+	ItemID        string    `json:"item_id"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func SelectPendingEvents() ([]PendingEvent, error) {
+	rows, err := db.Query(`SELECT id, event, item_id, attempts, last_error, next_attempt_at, created_at
+		FROM outbox WHERE sent_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []PendingEvent{}
+	for rows.Next() {
+		var ev PendingEvent
+		if err := rows.Scan(&ev.ID, &ev.Event, &ev.ItemID, &ev.Attempts, &ev.LastError, &ev.NextAttemptAt, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Приведение продукта в Inventory к состоянию в Product. Неотправленные события продукта
+// блокируются на время сверки, а после неё помечаются отправленными: их результат уже достигнут.
+func Reconcile(ctx context.Context, id string) (ReconcileResult, error) {
+	res := ReconcileResult{ItemID: id, Action: ReconcileNone}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var lastEvent int64
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM
+		(SELECT id FROM outbox WHERE item_id = $1 AND sent_at IS NULL FOR UPDATE) pending`, id).Scan(&lastEvent)
+	if err != nil {
+		return res, err
+	}
+	var local Product
+	err = tx.QueryRowContext(ctx, "SELECT id, naming, weight, description FROM items WHERE id = $1", id).
+		Scan(&local.ID, &local.Naming, &local.Weight, &local.Description)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return res, err
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, GrpcTimeout)
+	defer cancel()
+	remote, err := connect.client.GetProduct(callCtx, &pb.IdRequest{Id: id})
+	remoteExists := err == nil
+	if err != nil && status.Code(err) != codes.NotFound {
+		return res, err
+	}
+
+	var reply *pb.StatusReply
+	switch {
+	case exists && !remoteExists:
+		// Остаток и цену Inventory берём из последнего события создания, если оно сохранилось
+		var prod Fproduct
+		var payload []byte
+		err := tx.QueryRowContext(ctx, "SELECT payload FROM outbox WHERE item_id = $1 AND event = $2 ORDER BY id DESC LIMIT 1",
+			id, OutboxProductCreated).Scan(&payload)
+		if err == nil {
+			if err := json.Unmarshal(payload, &prod); err != nil {
+				return res, err
+			}
+		} else if err != sql.ErrNoRows {
+			return res, err
+		}
+		res.Action = ReconcileCreated
+		reply, err = connect.client.SendProduct(callCtx, &pb.CreateRequest{Prod: &pb.Product{
+			Id:       id,
+			Name:     local.Naming,
+			Quantity: int32(prod.Quantity),
+			Price:    prod.Price.Proto(),
+		}})
+		if err != nil {
+			return res, err
+		}
+	case exists && remote.GetProd().GetName() != local.Naming:
+		res.Action = ReconcileUpdated
+		reply, err = connect.client.UpdProduct(callCtx, &pb.CreateRequest{
+			Prod:       &pb.Product{Id: id, Name: local.Naming},
+			UpdateMask: []string{"name"},
+		})
+		if err != nil {
+			return res, err
+		}
+	case !exists && remoteExists:
+		res.Action = ReconcileDeleted
+		reply, err = connect.client.DelProduct(callCtx, &pb.IdRequest{Id: id})
+		if err != nil {
+			return res, err
+		}
+	}
+	if reply != nil && !reply.GetFlag() {
+		return res, errors.New(reply.GetMessage())
+	}
+
+	if lastEvent > 0 {
+		sqlRes, err := tx.ExecContext(ctx, `UPDATE outbox SET sent_at = now(), last_error = 'reconciled'
+			WHERE item_id = $1 AND sent_at IS NULL AND id <= $2`, id, lastEvent)
+		if err != nil {
+			return res, err
+		}
+		if res.Discarded, err = sqlRes.RowsAffected(); err != nil {
+			return res, err
+		}
+	}
+	return res, tx.Commit()
+}
+
+// Неотправленные в Inventory события
+func GetOutbox(w http.ResponseWriter, r *http.Request) {
+	events, err := SelectPendingEvents()
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
+
+// Сверка продукта с Inventory
+func ReconcileProduct(w http.ResponseWriter, r *http.Request) {
+	res, err := Reconcile(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("reconcile of item %s failed: %v\n", mux.Vars(r)["id"], err)
+		ErrorResponse(w, http.StatusBadGateway, "Reconcile failed", "The product could not be reconciled with Inventory, try again later.")
+		return
+	}
+	log.Printf("item %s reconciled: %s\n", res.ItemID, res.Action)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
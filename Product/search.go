@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Границы найденных слов в ts_headline - управляющие символы, а не теги: ts_headline возвращает
+// текст продукта как есть, поэтому он сначала экранируется для HTML, и только потом границы
+// заменяются тегом <mark>. Такие символы удаляются из текста до выделения.
+const (
+	markStart = "\x02"
+	markStop  = "\x03"
+)
+
+// Параметры ts_headline
+const (
+	headlineName        = "StartSel=" + markStart + ", StopSel=" + markStop + ", HighlightAll=true"
+	headlineDescription = "StartSel=" + markStart + ", StopSel=" + markStop + ", MaxWords=35, MinWords=15, MaxFragments=2"
+)
+
+var markTags = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// Фрагмент текста в HTML с выделенными тегом <mark> совпадениями
+func snippetHTML(headline string) string {
+	return markTags.Replace(html.EscapeString(headline))
+}
+
+// Параметры выборки GET /products/search
+type SearchQuery struct {
+	Text   string
+	Limit  int
+	Offset int
+}
+
+// Найденный продукт с релевантностью и фрагментами текста с выделенными совпадениями
+type SearchResult struct {
+	Product
+	Rank    float64       `json:"rank"`
+	Snippet SearchSnippet `json:"snippet"`
+}
+type SearchSnippet struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+type SearchPage struct {
+	Items []SearchResult `json:"items"`
+	Total int            `json:"total"`
+}
+
+// Разбор параметров q, limit, offset
+func ParseSearchQuery(r *http.Request) (SearchQuery, error) {
+	values := r.URL.Query()
+	q := SearchQuery{Text: strings.TrimSpace(values.Get("q")), Limit: DefaultPageSize}
+	if q.Text == "" {
+		return q, errors.New("q must not be empty")
+	}
+	var err error
+	if l := values.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit <= 0 {
+			return q, errors.New("limit must be a positive number")
+		}
+		if q.Limit > MaxPageSize {
+			q.Limit = MaxPageSize
+		}
+	}
+	if o := values.Get("offset"); o != "" {
+		q.Offset, err = strconv.Atoi(o)
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("offset must not be negative")
+		}
+	}
+	return q, nil
+}
+
+// Полнотекстовый поиск по наименованию и описанию, результаты упорядочены по релевантности.
+// Запрос понимает синтаксис websearch_to_tsquery: "фраза в кавычках", or, -исключение.
+func SearchItems(q SearchQuery) (SearchPage, error) {
+	page := SearchPage{Items: []SearchResult{}}
+	err := db.QueryRow("SELECT count(*) FROM items WHERE search @@ websearch_to_tsquery('russian', $1)", q.Text).Scan(&page.Total)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	rows, err := db.Query(`SELECT id, naming, weight, description, rank,
+			ts_headline('russian', translate(naming, $6, ''), query, $4),
+			ts_headline('russian', translate(description, $6, ''), query, $5)
+		FROM (
+			SELECT i.*, ts_rank_cd(i.search, query) AS rank, query
+			FROM items i, websearch_to_tsquery('russian', $1) query
+			WHERE i.search @@ query
+			ORDER BY rank DESC, i.id
+			LIMIT $2 OFFSET $3
+		) found
+		ORDER BY rank DESC, id`, q.Text, q.Limit, q.Offset, headlineName, headlineDescription, markStart+markStop)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var res SearchResult
+		err := rows.Scan(&res.ID, &res.Naming, &res.Weight, &res.Description, &res.Rank,
+			&res.Snippet.Name, &res.Snippet.Description)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		res.Snippet.Name = snippetHTML(res.Snippet.Name)
+		res.Snippet.Description = snippetHTML(res.Snippet.Description)
+		page.Items = append(page.Items, res)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, err
+	}
+	return page, nil
+}
+
+// Поиск продуктов
+func SearchProducts(w http.ResponseWriter, r *http.Request) {
+	query, err := ParseSearchQuery(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid query parameters", err.Error())
+		return
+	}
+	page, err := SearchItems(query)
+	if err != nil {
+		InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
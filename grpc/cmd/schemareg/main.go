@@ -0,0 +1,69 @@
+// Проверка схем событий по реестру events/schemas.
+//
+//	go run ./cmd/schemareg         - проверить, что текущие схемы зарегистрированы
+//	go run ./cmd/schemareg -write  - зарегистрировать изменённые схемы новой версией
+//
+// Несовместимое изменение не регистрируется, команда завершается с ошибкой.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ALbikov-R/4ServicesGRPC/events"
+)
+
+func main() {
+	dir := flag.String("dir", "events/schemas", "schema registry directory")
+	write := flag.Bool("write", false, "register changed schemas as new versions")
+	flag.Parse()
+
+	reg, err := events.OpenRegistry(os.DirFS(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	for _, s := range events.Current() {
+		if version, ok := reg.Find(s); ok {
+			fmt.Printf("%s: v%d\n", s.Event, version)
+			continue
+		}
+		latest, ok := reg.Latest(s.Event)
+		if ok {
+			if err := events.Compatible(latest, s); err != nil {
+				fmt.Printf("%s: incompatible with v%d:\n%v\n", s.Event, latest.Version, err)
+				failed = true
+				continue
+			}
+		}
+		s.Version = latest.Version + 1
+		if !*write {
+			fmt.Printf("%s: not registered, run with -write to register v%d\n", s.Event, s.Version)
+			failed = true
+			continue
+		}
+		if err := save(*dir, s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: registered v%d\n", s.Event, s.Version)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func save(dir string, s events.Schema) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, s.Event, fmt.Sprintf("v%d.json", s.Version))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
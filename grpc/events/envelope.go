@@ -0,0 +1,196 @@
+// Package events описывает события, которые сервисы передают через Kafka: конверт с
+// метаданными (код события, тип, версия схемы, время, код корреляции) и типизированную
+// нагрузку. Событие кодируется в protobuf или JSON, кодировка передаётся заголовком
+// сообщения content-type.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Кодировки события
+const (
+	ContentTypeJSON  = "application/json"
+	ContentTypeProto = "application/x-protobuf"
+)
+
+// Заголовок сообщения Kafka с кодировкой события
+const ContentTypeHeader = "content-type"
+
+// Типы событий
+const (
+	TypeOrderCreated       = "OrderCreated"
+	TypeOrderUpdated       = "OrderUpdated"
+	TypeOrderDeleted       = "OrderDeleted"
+	TypeOrderStatusChanged = "OrderStatusChanged"
+	TypeNotification       = "Notification"
+	TypeReturnRequested    = "ReturnRequested"
+	TypeReturnApproved     = "ReturnApproved"
+	TypeReturnRejected     = "ReturnRejected"
+	TypeReturnReceived     = "ReturnReceived"
+	TypeReturnRefunded     = "ReturnRefunded"
+)
+
+// Нагрузка каждого типа события
+var payloads = map[string]func() proto.Message{
+	TypeOrderCreated:       func() proto.Message { return &OrderEvent{} },
+	TypeOrderUpdated:       func() proto.Message { return &OrderEvent{} },
+	TypeOrderDeleted:       func() proto.Message { return &OrderEvent{} },
+	TypeOrderStatusChanged: func() proto.Message { return &OrderStatusChanged{} },
+	TypeNotification:       func() proto.Message { return &Notification{} },
+	TypeReturnRequested:    func() proto.Message { return &ReturnEvent{} },
+	TypeReturnApproved:     func() proto.Message { return &ReturnEvent{} },
+	TypeReturnRejected:     func() proto.Message { return &ReturnEvent{} },
+	TypeReturnReceived:     func() proto.Message { return &ReturnEvent{} },
+	TypeReturnRefunded:     func() proto.Message { return &ReturnEvent{} },
+}
+
+var (
+	ErrUnknownEvent       = errors.New("unknown event type")
+	ErrUnknownContentType = errors.New("unknown event content type")
+)
+
+// Событие с метаданными и типизированной нагрузкой
+type Event struct {
+	ID            string
+	Type          string
+	SchemaVersion int32
+	OccurredAt    time.Time
+	CorrelationID string
+	Source        string
+	Payload       proto.Message
+}
+
+// Конверт события в JSON: нагрузка встраивается объектом, а не строкой
+type jsonEnvelope struct {
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	SchemaVersion int32           `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Source        string          `json:"source"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+var (
+	jsonPayload   = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+	jsonUnmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// Новое событие текущей версии схемы
+func New(eventType, source, correlationID string, payload proto.Message) (Event, error) {
+	version, err := Version(eventType)
+	if err != nil {
+		return Event{}, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:            hex.EncodeToString(b),
+		Type:          eventType,
+		SchemaVersion: version,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: correlationID,
+		Source:        source,
+		Payload:       payload,
+	}, nil
+}
+
+// Кодирование события в protobuf или JSON
+func Marshal(e Event, contentType string) ([]byte, error) {
+	switch contentType {
+	case ContentTypeProto:
+		payload, err := proto.Marshal(e.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(&Envelope{
+			EventId:       e.ID,
+			EventType:     e.Type,
+			SchemaVersion: e.SchemaVersion,
+			OccurredAt:    e.OccurredAt.UnixMilli(),
+			CorrelationId: e.CorrelationID,
+			Source:        e.Source,
+			ContentType:   ContentTypeProto,
+			Payload:       payload,
+		})
+	case ContentTypeJSON:
+		payload, err := jsonPayload.Marshal(e.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(jsonEnvelope{
+			EventID:       e.ID,
+			EventType:     e.Type,
+			SchemaVersion: e.SchemaVersion,
+			OccurredAt:    e.OccurredAt,
+			CorrelationID: e.CorrelationID,
+			Source:        e.Source,
+			Payload:       payload,
+		})
+	}
+	return nil, ErrUnknownContentType
+}
+
+// Декодирование события. Схемы совместимы между версиями, поэтому нагрузка любой
+// зарегистрированной версии читается в текущий тип, неизвестные поля пропускаются.
+func Unmarshal(data []byte, contentType string) (Event, error) {
+	var e Event
+	var payload func(proto.Message) error
+	switch contentType {
+	case ContentTypeProto:
+		var env Envelope
+		if err := proto.Unmarshal(data, &env); err != nil {
+			return Event{}, err
+		}
+		e = Event{
+			ID:            env.EventId,
+			Type:          env.EventType,
+			SchemaVersion: env.SchemaVersion,
+			OccurredAt:    time.UnixMilli(env.OccurredAt).UTC(),
+			CorrelationID: env.CorrelationId,
+			Source:        env.Source,
+		}
+		payload = func(m proto.Message) error { return proto.Unmarshal(env.Payload, m) }
+	case ContentTypeJSON:
+		var env jsonEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return Event{}, err
+		}
+		e = Event{
+			ID:            env.EventID,
+			Type:          env.EventType,
+			SchemaVersion: env.SchemaVersion,
+			OccurredAt:    env.OccurredAt,
+			CorrelationID: env.CorrelationID,
+			Source:        env.Source,
+		}
+		payload = func(m proto.Message) error { return jsonUnmarshal.Unmarshal(env.Payload, m) }
+	default:
+		return Event{}, ErrUnknownContentType
+	}
+	newPayload, ok := payloads[e.Type]
+	if !ok {
+		return e, fmt.Errorf("%w: %q", ErrUnknownEvent, e.Type)
+	}
+	e.Payload = newPayload()
+	if err := payload(e.Payload); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// Нагрузка в JSON, например для хранения или вывода
+func PayloadJSON(e Event) ([]byte, error) {
+	return jsonPayload.Marshal(e.Payload)
+}
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	payload := &OrderStatusChanged{
+		Order: &Order{
+			Id:         "65f6142530646341eeaa9481",
+			CustomerId: "42",
+			Status:     "paid",
+			History:    []*StatusChange{{From: "created", To: "paid", At: 1710614429000}},
+			Lines:      []*OrderLine{{ItemId: "1", Name: "Phone", Quantity: 2, Price: &Money{Amount: 1250000, Currency: "RUB"}, Total: &Money{Amount: 2500000, Currency: "RUB"}}},
+			Totals:     &OrderTotals{Currency: "RUB", Subtotal: 2500000, Tax: 416667, TaxIncluded: true, GrandTotal: 2500000},
+		},
+		From:        "created",
+		To:          "paid",
+		Description: "Order 65f6142530646341eeaa9481 created -> paid",
+	}
+	for _, contentType := range []string{ContentTypeProto, ContentTypeJSON} {
+		t.Run(contentType, func(t *testing.T) {
+			e, err := New(TypeOrderStatusChanged, "order", "corr-1", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := Marshal(e, contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Unmarshal(data, contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != e.ID || got.Type != e.Type || got.SchemaVersion != e.SchemaVersion ||
+				got.CorrelationID != e.CorrelationID || got.Source != e.Source {
+				t.Errorf("envelope = %+v, want %+v", got, e)
+			}
+			// В protobuf время передаётся с точностью до миллисекунды
+			if !got.OccurredAt.Equal(e.OccurredAt.Truncate(time.Millisecond)) && !got.OccurredAt.Equal(e.OccurredAt) {
+				t.Errorf("occurred at = %v, want %v", got.OccurredAt, e.OccurredAt)
+			}
+			if !proto.Equal(got.Payload, payload) {
+				t.Errorf("payload = %v, want %v", got.Payload, payload)
+			}
+		})
+	}
+}
+
+// Потребитель старой версии пропускает поля, добавленные в новой
+func TestUnmarshalUnknownFields(t *testing.T) {
+	data := []byte(`{"event_id":"1","event_type":"Notification","schema_version":9,"occurred_at":"2024-03-16T18:50:29Z","source":"order",
+		"payload":{"order_id":"7","subject":"Order found","description":"Order 7 exist","priority":"high"}}`)
+	e, err := Unmarshal(data, ContentTypeJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Notification{OrderId: "7", Subject: "Order found", Description: "Order 7 exist"}
+	if !proto.Equal(e.Payload, want) || e.SchemaVersion != 9 {
+		t.Errorf("event = %+v, payload %v, want %v", e, e.Payload, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	if _, err := Unmarshal([]byte(`{}`), "text/plain"); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("content type: err = %v, want ErrUnknownContentType", err)
+	}
+	if _, err := Unmarshal([]byte(`{"event_type":"OrderShipped","payload":{}}`), ContentTypeJSON); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("event type: err = %v, want ErrUnknownEvent", err)
+	}
+	if _, err := New("OrderShipped", "order", "", &Notification{}); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("New: err = %v, want ErrUnknownEvent", err)
+	}
+}
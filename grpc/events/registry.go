@@ -0,0 +1,249 @@
+package events
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Реестр схем: файлы schemas/<тип события>/v<версия>.json. Зарегистрированная версия не
+// меняется, новая версия добавляется командой go run ./cmd/schemareg -write, только если
+// совместима с последней.
+//
+//go:embed schemas
+var schemaFiles embed.FS
+
+// Поле сообщения
+type FieldSchema struct {
+	Number   int32  `json:"number"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Message  string `json:"message,omitempty"` // Тип вложенного сообщения
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+// Сообщение: поля и номера удалённых полей, которые нельзя использовать снова
+type MessageSchema struct {
+	Fields   []FieldSchema `json:"fields"`
+	Reserved []int32       `json:"reserved,omitempty"`
+}
+
+// Версия схемы нагрузки события
+type Schema struct {
+	Event    string                   `json:"event"`
+	Version  int32                    `json:"version"`
+	Message  string                   `json:"message"`
+	Messages map[string]MessageSchema `json:"messages"`
+}
+
+// Схема нагрузки по описанию сообщения, включая все вложенные сообщения
+func SchemaOf(event string, desc protoreflect.MessageDescriptor) Schema {
+	s := Schema{Event: event, Message: string(desc.FullName()), Messages: map[string]MessageSchema{}}
+	var walk func(protoreflect.MessageDescriptor)
+	walk = func(md protoreflect.MessageDescriptor) {
+		name := string(md.FullName())
+		if _, ok := s.Messages[name]; ok {
+			return
+		}
+		var m MessageSchema
+		s.Messages[name] = m
+		fields := md.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			f := FieldSchema{Number: int32(fd.Number()), Name: string(fd.Name()), Type: fd.Kind().String(), Repeated: fd.IsList()}
+			if fd.Message() != nil {
+				f.Message = string(fd.Message().FullName())
+				walk(fd.Message())
+			}
+			m.Fields = append(m.Fields, f)
+		}
+		ranges := md.ReservedRanges()
+		for i := 0; i < ranges.Len(); i++ {
+			for n := ranges.Get(i)[0]; n < ranges.Get(i)[1]; n++ {
+				m.Reserved = append(m.Reserved, int32(n))
+			}
+		}
+		s.Messages[name] = m
+	}
+	walk(desc)
+	return s
+}
+
+// Схемы, зарегистрированные для каждого события, по возрастанию версии
+type Registry map[string][]Schema
+
+// Чтение реестра из каталога
+func OpenRegistry(fsys fs.FS) (Registry, error) {
+	reg := Registry{}
+	files, err := fs.Glob(fsys, "*/v*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		var s Schema
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path.Base(file), "v"), ".json"))
+		if err != nil || int32(version) != s.Version || path.Dir(file) != s.Event {
+			return nil, fmt.Errorf("%s: file name does not match event %q version %d", file, s.Event, s.Version)
+		}
+		reg[s.Event] = append(reg[s.Event], s)
+	}
+	for event, versions := range reg {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+		for i, s := range versions {
+			if s.Version != int32(i+1) {
+				return nil, fmt.Errorf("%s: versions must be numbered from 1 without gaps", event)
+			}
+		}
+	}
+	return reg, nil
+}
+
+// Последняя версия схемы события
+func (reg Registry) Latest(event string) (Schema, bool) {
+	versions := reg[event]
+	if len(versions) == 0 {
+		return Schema{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// Зарегистрированная версия, совпадающая со схемой
+func (reg Registry) Find(s Schema) (int32, bool) {
+	s = normalize(s)
+	for _, old := range reg[s.Event] {
+		s.Version = old.Version
+		if reflect.DeepEqual(normalize(old), s) {
+			return old.Version, true
+		}
+	}
+	return 0, false
+}
+
+// Копия схемы, в которой пустые списки заменены на nil. Исходная схема не меняется:
+// схемы реестра читаются одновременно из разных горутин.
+func normalize(s Schema) Schema {
+	messages := make(map[string]MessageSchema, len(s.Messages))
+	for name, m := range s.Messages {
+		if len(m.Reserved) == 0 {
+			m.Reserved = nil
+		}
+		if len(m.Fields) == 0 {
+			m.Fields = nil
+		}
+		messages[name] = m
+	}
+	s.Messages = messages
+	return s
+}
+
+// Проверка совместимости новой схемы со старой: потребитель старой версии читает
+// события новой и наоборот. Поле нельзя переименовать или сменить ему тип, удалённое поле
+// должно быть зарезервировано, номер зарезервированного поля нельзя использовать снова.
+func Compatible(old, new Schema) error {
+	if old.Message != new.Message {
+		return fmt.Errorf("payload message changed from %s to %s", old.Message, new.Message)
+	}
+	var errs []error
+	for name, om := range old.Messages {
+		nm, ok := new.Messages[name]
+		if !ok {
+			continue // Сообщение больше не используется в нагрузке
+		}
+		fields := map[int32]FieldSchema{}
+		for _, f := range nm.Fields {
+			fields[f.Number] = f
+		}
+		reserved := map[int32]bool{}
+		for _, n := range nm.Reserved {
+			reserved[n] = true
+		}
+		for _, of := range om.Fields {
+			nf, ok := fields[of.Number]
+			switch {
+			case !ok && !reserved[of.Number]:
+				errs = append(errs, fmt.Errorf("%s: field %d (%s) removed without reserving its number", name, of.Number, of.Name))
+			case ok && nf != of:
+				errs = append(errs, fmt.Errorf("%s: field %d changed from %s to %s", name, of.Number, describe(of), describe(nf)))
+			}
+		}
+		for _, n := range om.Reserved {
+			if f, ok := fields[n]; ok {
+				errs = append(errs, fmt.Errorf("%s: reserved field number %d reused by %s", name, n, f.Name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func describe(f FieldSchema) string {
+	t := f.Type
+	if f.Message != "" {
+		t = f.Message
+	}
+	if f.Repeated {
+		t = "repeated " + t
+	}
+	return t + " " + f.Name
+}
+
+// Текущие схемы нагрузок всех событий
+func Current() []Schema {
+	var schemas []Schema
+	for event, payload := range payloads {
+		schemas = append(schemas, SchemaOf(event, payload().ProtoReflect().Descriptor()))
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Event < schemas[j].Event })
+	return schemas
+}
+
+var registered = func() Registry {
+	schemas, err := fs.Sub(schemaFiles, "schemas")
+	if err != nil {
+		panic(err)
+	}
+	reg, err := OpenRegistry(schemas)
+	if err != nil {
+		panic(err)
+	}
+	return reg
+}()
+
+// Версия схемы, которой соответствует текущая нагрузка события
+func Version(event string) (int32, error) {
+	payload, ok := payloads[event]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownEvent, event)
+	}
+	version, ok := registered.Find(SchemaOf(event, payload().ProtoReflect().Descriptor()))
+	if !ok {
+		return 0, fmt.Errorf("schema of %s is not registered, run go run ./cmd/schemareg -write in the grpc module", event)
+	}
+	return version, nil
+}
+
+// Проверка при запуске сервиса, что схемы всех событий зарегистрированы
+func Verify() error {
+	var errs []error
+	for event := range payloads {
+		if _, err := Version(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	if err := Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Версия определяется при каждом New, в том числе из параллельных обработчиков HTTP
+// (go test -race)
+func TestVersionConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				version, err := Version(TypeOrderStatusChanged)
+				if err != nil || version != 2 {
+					t.Errorf("Version = %d, %v, want 2", version, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFindIgnoresEmptyLists(t *testing.T) {
+	reg := Registry{"Test": {testSchema(1, MessageSchema{Fields: []FieldSchema{{Number: 1, Name: "id", Type: "string"}}, Reserved: []int32{}})}}
+	version, ok := reg.Find(testSchema(0, MessageSchema{Fields: []FieldSchema{{Number: 1, Name: "id", Type: "string"}}}))
+	if !ok || version != 1 {
+		t.Errorf("Find = %d, %v, want 1, true", version, ok)
+	}
+	if reg["Test"][0].Messages["events.Test"].Reserved == nil {
+		t.Error("Find changed the registered schema")
+	}
+	if _, ok := reg.Find(testSchema(0, MessageSchema{Fields: []FieldSchema{{Number: 1, Name: "code", Type: "string"}}})); ok {
+		t.Error("Find matched a different schema")
+	}
+}
+
+func testSchema(version int32, m MessageSchema) Schema {
+	return Schema{Event: "Test", Version: version, Message: "events.Test", Messages: map[string]MessageSchema{"events.Test": m}}
+}
+
+func TestCompatible(t *testing.T) {
+	id := FieldSchema{Number: 1, Name: "id", Type: "string"}
+	name := FieldSchema{Number: 2, Name: "name", Type: "string"}
+	line := FieldSchema{Number: 4, Name: "lines", Type: "message", Message: "events.Line", Repeated: true}
+	old := Schema{Event: "Test", Version: 1, Message: "events.Test", Messages: map[string]MessageSchema{
+		"events.Test": {Fields: []FieldSchema{id, name, line}, Reserved: []int32{3}},
+		"events.Line": {Fields: []FieldSchema{{Number: 1, Name: "item_id", Type: "string"}}},
+	}}
+	with := func(test MessageSchema) Schema {
+		s := Schema{Event: "Test", Version: 2, Message: "events.Test", Messages: map[string]MessageSchema{"events.Test": test}}
+		s.Messages["events.Line"] = old.Messages["events.Line"]
+		return s
+	}
+	tests := []struct {
+		name string
+		new  Schema
+		ok   bool
+	}{
+		{name: "same", new: with(MessageSchema{Fields: []FieldSchema{id, name, line}, Reserved: []int32{3}}), ok: true},
+		{name: "field added", new: with(MessageSchema{Fields: []FieldSchema{id, name, line, {Number: 5, Name: "reason", Type: "string"}}, Reserved: []int32{3}}), ok: true},
+		{name: "field removed and reserved", new: with(MessageSchema{Fields: []FieldSchema{id, line}, Reserved: []int32{2, 3}}), ok: true},
+		{name: "field removed without reserving", new: with(MessageSchema{Fields: []FieldSchema{id, line}, Reserved: []int32{3}})},
+		{name: "field renamed", new: with(MessageSchema{Fields: []FieldSchema{id, {Number: 2, Name: "title", Type: "string"}, line}, Reserved: []int32{3}})},
+		{name: "type changed", new: with(MessageSchema{Fields: []FieldSchema{id, {Number: 2, Name: "name", Type: "bytes"}, line}, Reserved: []int32{3}})},
+		{name: "made repeated", new: with(MessageSchema{Fields: []FieldSchema{id, {Number: 2, Name: "name", Type: "string", Repeated: true}, line}, Reserved: []int32{3}})},
+		{name: "reserved number reused", new: with(MessageSchema{Fields: []FieldSchema{id, name, {Number: 3, Name: "code", Type: "string"}, line}})},
+		{
+			name: "nested message no longer used",
+			new: Schema{Event: "Test", Version: 2, Message: "events.Test", Messages: map[string]MessageSchema{
+				"events.Test": {Fields: []FieldSchema{id, name}, Reserved: []int32{3, 4}},
+			}},
+			ok: true,
+		},
+		{
+			name: "nested message field removed",
+			new: Schema{Event: "Test", Version: 2, Message: "events.Test", Messages: map[string]MessageSchema{
+				"events.Test": {Fields: []FieldSchema{id, name, line}, Reserved: []int32{3}},
+				"events.Line": {},
+			}},
+		},
+		{name: "payload message changed", new: Schema{Event: "Test", Version: 2, Message: "events.Other", Messages: old.Messages}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Compatible(old, tt.new)
+			if tt.ok && err != nil {
+				t.Errorf("Compatible: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("Compatible accepted an incompatible schema")
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+// Package money описывает денежные суммы, которыми обмениваются сервисы: в REST, gRPC,
+// событиях и базах данных сумма хранится одинаково.
+package money
+
+import (
+	"errors"
+	"regexp"
+
+	pb "github.com/ALbikov-R/4ServicesGRPC/gen"
+)
+
+// Валюта цены, если она не указана
+const DefaultCurrency = "RUB"
+
+// Денежная сумма: целое число минимальных единиц валюты (копеек, центов) и код валюты ISO 4217
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+var (
+	currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	ErrNegativeAmount  = errors.New("price amount must not be negative")
+	ErrInvalidCurrency = errors.New("price currency must be an ISO 4217 code")
+)
+
+// Проверка суммы, пустая валюта заменяется валютой по умолчанию
+func (m *Money) Validate() error {
+	if m.Currency == "" {
+		m.Currency = DefaultCurrency
+	}
+	if m.Amount < 0 {
+		return ErrNegativeAmount
+	}
+	if !currencyCode.MatchString(m.Currency) {
+		return ErrInvalidCurrency
+	}
+	return nil
+}
+func (m Money) Proto() *pb.Money {
+	return &pb.Money{Amount: m.Amount, Currency: m.Currency}
+}
+func FromProto(m *pb.Money) Money {
+	return Money{Amount: m.GetAmount(), Currency: m.GetCurrency()}
+}